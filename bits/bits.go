@@ -2,6 +2,7 @@ package bits
 
 import (
 	"io"
+	"time"
 )
 
 //KeySize describes the size of each chunk ley
@@ -46,3 +47,23 @@ type Remote interface {
 	ChunkWriter(k K) (wc io.WriteCloser, err error)
 	ListChunks(w io.Writer) (err error)
 }
+
+//ChunkInfo describes a chunk that is stored remotely
+type ChunkInfo struct {
+	K            K
+	Size         int64
+	LastModified time.Time
+}
+
+//ChunkInfoLister is implemented by remotes that can describe the chunks they
+//store, e.g to report how much space they take up
+type ChunkInfoLister interface {
+	ListChunkInfo(fn func(ChunkInfo) error) (err error)
+}
+
+//ChunkDeleter is implemented by remotes that support deleting chunks, it is
+//required for garbage collection of the remote
+type ChunkDeleter interface {
+	ChunkInfoLister
+	DeleteChunk(k K) (err error)
+}
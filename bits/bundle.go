@@ -0,0 +1,298 @@
+package bits
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	//BundleIndexName is the name of the first entry of every chunk bundle,
+	//it holds the BundleIndex
+	BundleIndexName = "git-bits-bundle.json"
+
+	//BundleChunkDir is the directory in the bundle that holds an entry for
+	//each chunk, named after its key
+	BundleChunkDir = "chunks"
+
+	//BundleVersion is the version of the bundle format that is written
+	BundleVersion = 1
+)
+
+//BundleChunk describes a chunk in a bundle and how it can be verified
+type BundleChunk struct {
+	Key string `json:"key"`
+
+	//size of the encrypted chunk as it is stored in the bundle
+	Size int64 `json:"size"`
+
+	//size of the chunk content, -1 for manifest nodes and chunks of
+	//which the length wasn't recorded
+	Length int64 `json:"length"`
+
+	//how the key was derived and the content laid out, as recorded in the
+	//pointer that referenced the chunk
+	Hash        Hash   `json:"hash"`
+	ChunkFormat string `json:"chunk_format"`
+}
+
+//BundleIndex lists every chunk in a bundle in the order they are stored
+type BundleIndex struct {
+	Version int           `json:"version"`
+	Revs    []string      `json:"revs"`
+	Chunks  []BundleChunk `json:"chunks"`
+}
+
+//BundleStats describes what was loaded from a bundle
+type BundleStats struct {
+	Chunks int
+	Added  int
+	Bytes  int64
+}
+
+//String formats the stats as a human readable report
+func (s BundleStats) String() string {
+	return fmt.Sprintf("verified %d chunks, added %d chunks (%s)", s.Chunks, s.Added, humanize.IBytes(uint64(s.Bytes)))
+}
+
+//CreateBundle writes every chunk referenced by the pointers in the history
+//selected by rev-list arguments 'revs' to 'w' as a tar archive that starts with
+//a BundleIndex. Keys of manifest nodes and the chunks below them are included,
+//chunks that are not stored locally are fetched from the remote
+func (repo *Repository) CreateBundle(w io.Writer, revs []string) (index *BundleIndex, err error) {
+	index = &BundleIndex{Version: BundleVersion, Revs: revs, Chunks: []BundleChunk{}}
+	err = repo.forEachReferencedChunk(revs, repo.remote, func(ptr *Pointer, k K, depth int, length int64) error {
+		err := repo.fetchChunk(k)
+		if err != nil {
+			return err
+		}
+
+		cp, _ := repo.lookup(k)
+		fi, err := os.Stat(cp)
+		if err != nil {
+			return fmt.Errorf("failed to stat chunk '%x': %v", k, err)
+		}
+
+		if depth > 0 {
+			length = -1
+		}
+
+		index.Chunks = append(index.Chunks, BundleChunk{
+			Key:         fmt.Sprintf("%x", k),
+			Size:        fi.Size(),
+			Length:      length,
+			Hash:        ptr.Hash,
+			ChunkFormat: ptr.ChunkFormat,
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	//the index goes first such that chunks can be verified while reading
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode bundle index: %v", err)
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	err = tw.WriteHeader(&tar.Header{Name: BundleIndexName, Mode: 0644, Size: int64(len(data)), ModTime: now})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to write bundle index: %v", err)
+	}
+
+	for _, c := range index.Chunks {
+		err = repo.bundleChunk(tw, c, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to finish bundle: %v", err)
+	}
+
+	return index, nil
+}
+
+//bundleChunk writes the locally stored chunk described by 'c' to 'tw'
+func (repo *Repository) bundleChunk(tw *tar.Writer, c BundleChunk, modTime time.Time) (err error) {
+	k, err := parseBundleKey(c.Key)
+	if err != nil {
+		return err
+	}
+
+	cp, _ := repo.lookup(k)
+	f, err := os.Open(cp)
+	if err != nil {
+		return fmt.Errorf("failed to open chunk '%x': %v", k, err)
+	}
+
+	defer f.Close()
+	err = tw.WriteHeader(&tar.Header{Name: path.Join(BundleChunkDir, c.Key), Mode: 0644, Size: c.Size, ModTime: modTime})
+	if err != nil {
+		return fmt.Errorf("failed to write bundle entry of chunk '%x': %v", k, err)
+	}
+
+	_, err = io.Copy(tw, f)
+	if err != nil {
+		return fmt.Errorf("failed to write chunk '%x' to bundle: %v", k, err)
+	}
+
+	return nil
+}
+
+//Unbundle reads a bundle written by CreateBundle from 'r' and verifies each
+//chunk in it against its key, chunks that are not yet stored locally are
+//added to the local chunk directory. It fails if the bundle holds a chunk
+//that doesn't verify, or if it lacks a chunk that its index lists
+func (repo *Repository) Unbundle(r io.Reader) (stats BundleStats, err error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != BundleIndexName {
+		return stats, fmt.Errorf("not a git-bits bundle, it doesn't start with an index")
+	}
+
+	index := &BundleIndex{}
+	err = json.NewDecoder(tr).Decode(index)
+	if err != nil {
+		return stats, fmt.Errorf("failed to decode bundle index: %v", err)
+	}
+
+	if index.Version > BundleVersion {
+		return stats, fmt.Errorf("bundle has version %d while this version of git-bits supports up to %d, please upgrade", index.Version, BundleVersion)
+	}
+
+	pending := map[K]BundleChunk{}
+	for _, c := range index.Chunks {
+		k, err := parseBundleKey(c.Key)
+		if err != nil {
+			return stats, err
+		}
+
+		pending[k] = c
+	}
+
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return stats, fmt.Errorf("failed to read bundle entry: %v", err)
+		}
+
+		dir, name := path.Split(hdr.Name)
+		k, err := parseBundleKey(name)
+		if err != nil || path.Clean(dir) != BundleChunkDir {
+			return stats, fmt.Errorf("unexpected bundle entry '%s'", hdr.Name)
+		}
+
+		c, ok := pending[k]
+		if !ok {
+			return stats, fmt.Errorf("bundle holds chunk '%x' that its index doesn't list, or holds it twice", k)
+		}
+
+		if hdr.Size != c.Size {
+			return stats, fmt.Errorf("chunk '%x' has %d bytes in the bundle while its index records %d bytes", k, hdr.Size, c.Size)
+		}
+
+		delete(pending, k)
+		added, err := repo.unbundleChunk(k, c, tr)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Chunks++
+		if added {
+			stats.Added++
+			stats.Bytes += c.Size
+		}
+	}
+
+	if len(pending) > 0 {
+		return stats, fmt.Errorf("bundle lacks %d chunk(s) that its index lists, it may be truncated", len(pending))
+	}
+
+	return stats, nil
+}
+
+//unbundleChunk verifies chunk 'k' as described by 'c' and read from 'r' and
+//stores it locally unless it already is. It returns whether it was added
+func (repo *Repository) unbundleChunk(k K, c BundleChunk, r io.Reader) (added bool, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false, fmt.Errorf("failed to read chunk '%x' from bundle: %v", k, err)
+	}
+
+	newHash, err := repo.Hasher(c.Hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to setup chunk hashing: %v", err)
+	}
+
+	n, err := decodeChunk(ioutil.Discard, bytes.NewReader(data), newHash, c.ChunkFormat, k)
+	if err != nil {
+		return false, fmt.Errorf("failed to verify chunk from bundle: %v", err)
+	}
+
+	if c.Length >= 0 && n != c.Length {
+		return false, fmt.Errorf("chunk '%x' has %d bytes while its index records %d bytes", k, n, c.Length)
+	}
+
+	if repo.isLocal(k) {
+		return false, nil
+	}
+
+	p, err := repo.Path(k, true)
+	if err != nil {
+		return false, fmt.Errorf("failed to create chunk path for key '%x': %v", k, err)
+	}
+
+	_, err = writeChunkFile(p, func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader(data))
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("failed to store chunk '%x' from bundle: %v", k, err)
+	}
+
+	repo.update(k, func(u *chunkUpdate) {
+		u.accessed = time.Now()
+		u.cipherSize = c.Size
+		if c.Length >= 0 {
+			u.plainSize = c.Length
+		}
+	})
+
+	return true, nil
+}
+
+//parseBundleKey parses the hex encoded key of a bundled chunk
+func parseBundleKey(s string) (k K, err error) {
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != KeySize {
+		return k, fmt.Errorf("invalid chunk key '%s' in bundle", s)
+	}
+
+	copy(k[:], data)
+	return k, nil
+}
@@ -0,0 +1,123 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestBundle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	_, repo2 := GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 5*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "a.bin"), pointer.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := bytes.NewBuffer(nil)
+	index, err := repo1.CreateBundle(bundle, []string{"HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(pointer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index.Chunks) != len(ptr.Keys) {
+		t.Errorf("expected %d chunks in the bundle, got: %d", len(ptr.Keys), len(index.Chunks))
+	}
+
+	//the other clone has no remote, its chunks only come from the bundle
+	stats, err := repo2.Unbundle(bytes.NewReader(bundle.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Chunks != len(index.Chunks) || stats.Added != len(index.Chunks) {
+		t.Errorf("expected every chunk to be added, got: %s", stats)
+	}
+
+	combined := bytes.NewBuffer(nil)
+	err = repo2.Combine(bytes.NewReader(pointer.Bytes()), combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Errorf("expected the file to combine from unbundled chunks")
+	}
+
+	stats, err = repo2.Unbundle(bytes.NewReader(bundle.Bytes()))
+	if err != nil || stats.Added != 0 {
+		t.Errorf("expected unbundling again to add nothing, got: %s, %v", stats, err)
+	}
+
+	_, err = repo2.Unbundle(bytes.NewReader(bundle.Bytes()[:bundle.Len()/2]))
+	if err == nil {
+		t.Errorf("expected a truncated bundle to fail")
+	}
+
+	//a corrupt chunk is bundled as is but doesn't unbundle
+	p, _ := repo1.Path(ptr.Keys[0], false)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[0] ^= 0xff
+	err = os.Chmod(p, 0666)
+	if err == nil {
+		err = ioutil.WriteFile(p, data, 0666)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle.Reset()
+	_, err = repo1.CreateBundle(bundle, []string{"HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, repo3 := GitCloneWorkspace(remote1, t)
+	_, err = repo3.Unbundle(bytes.NewReader(bundle.Bytes()))
+	if err == nil {
+		t.Errorf("expected a corrupt chunk to fail verification")
+	}
+}
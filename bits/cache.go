@@ -0,0 +1,145 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//ErrNoCacheSize is returned when evicting without a local cache size
+var ErrNoCacheSize = fmt.Errorf("no local cache size configured")
+
+//NeededSet returns the keys of all chunks that are referenced by the current
+//checkout: the tree of HEAD and the index
+func (repo *Repository) NeededSet() (needed map[K]struct{}, err error) {
+	revs := []string{"--no-walk", "--indexed-objects"}
+	if repo.Git(nil, nil, nil, "rev-parse", "-q", "--verify", "HEAD") == nil {
+		revs = append(revs, "HEAD")
+	}
+
+	return repo.liveSet(revs)
+}
+
+//EvictOpts configures eviction of local chunks
+type EvictOpts struct {
+
+	//only report what would be evicted
+	DryRun bool
+
+	//evict until the local chunks take up no more than this many bytes, the
+	//configured local cache size is used if it is zero
+	Size uint64
+}
+
+//evictCandidate is a local chunk that may be evicted
+type evictCandidate struct {
+	k    K
+	size int64
+	at   time.Time
+}
+
+//Evict removes the least recently accessed local chunks until all local chunks
+//take up no more than the local cache size. Only chunks that are known to be
+//pushed and are not needed by the current checkout (see NeededSet) are evicted,
+//as such the local chunks may still exceed the cache size afterwards. Evicted
+//chunks (or those that would be evicted on a dry run) are written to 'w'
+func (repo *Repository) Evict(store *bolt.DB, opts EvictOpts, w io.Writer) (stats GCStats, err error) {
+	limit := opts.Size
+	if limit == 0 {
+		limit = repo.conf.LocalCacheSize
+	}
+
+	if limit == 0 {
+		return stats, ErrNoCacheSize
+	}
+
+	err = repo.SaveChunkRecords(store)
+	if err != nil {
+		return stats, err
+	}
+
+	needed, err := repo.NeededSet()
+	if err != nil {
+		return stats, err
+	}
+
+	total := int64(0)
+	candidates := []evictCandidate{}
+	err = store.View(func(tx *bolt.Tx) error {
+		return repo.ForEachLocalChunk(func(k K, fi os.FileInfo) error {
+			total += fi.Size()
+			stats.Kept++
+			stats.KeptBytes += fi.Size()
+			if _, ok := needed[k]; ok {
+				return nil
+			}
+
+			rec, err := GetChunkRecord(tx, k)
+			if err != nil {
+				return err
+			}
+
+			if rec == nil || !rec.HasRemote(DefaultRemoteName) {
+				return nil //not pushed
+			}
+
+			//chunks that were never accessed since tracking started are
+			//considered accessed when they were last written
+			at := fi.ModTime()
+			if !rec.Accessed.IsZero() {
+				at = rec.Accessed
+			}
+
+			candidates = append(candidates, evictCandidate{k, fi.Size(), at})
+			return nil
+		})
+	})
+
+	if err != nil {
+		return stats, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].at.Equal(candidates[j].at) {
+			return bytes.Compare(candidates[i].k[:], candidates[j].k[:]) < 0
+		}
+
+		return candidates[i].at.Before(candidates[j].at)
+	})
+
+	for _, c := range candidates {
+		if total <= int64(limit) {
+			break
+		}
+
+		if !opts.DryRun {
+			p, _ := repo.Path(c.k, false)
+			err = os.Remove(p)
+			if err != nil {
+				return stats, fmt.Errorf("failed to remove chunk '%x': %v", c.k, err)
+			}
+
+			err = store.Update(func(tx *bolt.Tx) error {
+				return forgetLocalChunk(tx, c.k)
+			})
+
+			if err != nil {
+				return stats, fmt.Errorf("failed to update record of chunk '%x': %v", c.k, err)
+			}
+		}
+
+		total -= c.size
+		stats.Kept--
+		stats.KeptBytes -= c.size
+		stats.Removed++
+		stats.RemovedBytes += c.size
+		fmt.Fprintf(w, "%x\n", c.k)
+	}
+
+	return stats, nil
+}
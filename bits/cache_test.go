@@ -0,0 +1,143 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestEvict(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	chunks := newMemRemote()
+	repo1.SetRemote(chunks)
+
+	pointers := map[string][]byte{}
+	keys := map[string][]bits.K{}
+	for _, name := range []string{"checkout.bin", "old.bin", "recent.bin", "unpushed.bin", "mirrored.bin"} {
+		content := make([]byte, 1024*1024)
+		_, err = rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pointer := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), pointer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptr, err := bits.ReadPointer(bytes.NewReader(pointer.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys[name] = ptr.Keys
+		pointers[name] = pointer.Bytes()
+		//chunks only recorded under another remote can't be fetched again
+		remoteName := "origin"
+		if name == "mirrored.bin" {
+			remoteName = "mirror"
+		}
+
+		if name != "unpushed.bin" {
+			err = repo1.Push(store1, bytes.NewReader(pointer.Bytes()), remoteName)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	//only one file is part of the checkout
+	err = ioutil.WriteFile(filepath.Join(wd1, "checkout.bin"), pointers["checkout.bin"], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "checkout.bin")
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//reading a file makes its chunks recently used
+	err = repo1.Combine(bytes.NewReader(pointers["recent.bin"]), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo1.Evict(store1, bits.EvictOpts{}, ioutil.Discard)
+	if err != bits.ErrNoCacheSize {
+		t.Errorf("expected eviction without a cache size to fail, got: %v", err)
+	}
+
+	total := int64(0)
+	err = repo1.ForEachLocalChunk(func(k bits.K, fi os.FileInfo) error {
+		total += fi.Size()
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := repo1.Evict(store1, bits.EvictOpts{Size: uint64(total - 1)}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Removed < 1 || stats.KeptBytes > total-1 {
+		t.Errorf("expected chunks to be evicted until the cache size is met, got: %s", stats)
+	}
+
+	local := func(k bits.K) bool {
+		p, _ := repo1.Path(k, false)
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	if local(keys["old.bin"][0]) && (len(keys["old.bin"]) < 2 || local(keys["old.bin"][1])) {
+		t.Errorf("expected the least recently used chunks to be evicted first")
+	}
+
+	for _, name := range []string{"recent.bin", "checkout.bin", "unpushed.bin", "mirrored.bin"} {
+		for _, k := range keys[name] {
+			if !local(k) {
+				t.Errorf("expected chunk '%x' of '%s' to be kept", k, name)
+			}
+		}
+	}
+
+	//a tiny cache evicts everything that was pushed and isn't checked out
+	_, err = repo1.Evict(store1, bits.EvictOpts{Size: 1}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{"old.bin": false, "recent.bin": false, "checkout.bin": true, "unpushed.bin": true, "mirrored.bin": true} {
+		for _, k := range keys[name] {
+			if local(k) != expected {
+				t.Errorf("expected chunk '%x' of '%s' to be kept: %v", k, name, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package bits
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/restic/chunker"
+)
+
+//Chunker splits a stream of plain-text bytes into chunks
+type Chunker interface {
+
+	//Next returns the content of the next chunk, it may use 'buf' for storing
+	//the data when it has enough capacity. It returns io.EOF when there are
+	//no more chunks
+	Next(buf []byte) (data []byte, err error)
+}
+
+var (
+	//RabinChunker cuts chunks using rabin fingerprints over a sliding window,
+	//its average chunk size is fixed to 1MiB
+	RabinChunker = "rabin"
+
+	//FastCDCChunker cuts chunks using a gear hash with normalized chunking
+	FastCDCChunker = "fastcdc"
+
+	//FixedChunker cuts chunks at a fixed size, it deduplicates poorly when
+	//bytes are inserted but is cheap and predictable
+	FixedChunker = "fixed"
+)
+
+//Chunking describes the chunker and its parameters, content only deduplicates
+//against chunks that were created with equal chunking
+type Chunking struct {
+	Name string
+	Pol  uint64
+	Min  uint64
+	Avg  uint64
+	Max  uint64
+}
+
+//DefaultChunking returns the chunking that was used before chunking became
+//configurable, pointers that don't record their chunking used it
+func DefaultChunking(pol uint64) Chunking {
+	return Chunking{
+		Name: RabinChunker,
+		Pol:  pol,
+		Min:  chunker.MinSize,
+		Avg:  1024 * 1024,
+		Max:  chunker.MaxSize,
+	}
+}
+
+//ParseChunking parses chunking as formatted by String
+func ParseChunking(s string) (c Chunking, err error) {
+	_, err = fmt.Sscanf(s, "%s %x %d %d %d", &c.Name, &c.Pol, &c.Min, &c.Avg, &c.Max)
+	if err != nil {
+		return c, fmt.Errorf("unexpected format for chunking '%s': %v", s, err)
+	}
+
+	return c, nil
+}
+
+//String formats the chunking such that it fits a pointer attribute
+func (c Chunking) String() string {
+	return fmt.Sprintf("%s %x %d %d %d", c.Name, c.Pol, c.Min, c.Avg, c.Max)
+}
+
+//Validate returns an error if the chunking can't be used for splitting
+func (c Chunking) Validate() error {
+	if c.Min == 0 || c.Min > c.Avg || c.Avg > c.Max {
+		return fmt.Errorf("chunk sizes must satisfy 0 < min <= avg <= max, got min=%d avg=%d max=%d", c.Min, c.Avg, c.Max)
+	}
+
+	switch c.Name {
+	case RabinChunker:
+		if c.Pol == 0 {
+			return fmt.Errorf("the rabin chunker requires a deduplication scope")
+		}
+
+		//only checked when splitting, existing pointers can be combined with any scope
+		err := ValidateScope(c.Pol)
+		if err != nil {
+			return err
+		}
+
+		if c.Min < chunker.MinSize || c.Avg != 1024*1024 {
+			return fmt.Errorf("the rabin chunker requires a minimum size of at least %d bytes and an average size of 1MiB, use the '%s' chunker for other sizes", chunker.MinSize, FastCDCChunker)
+		}
+	case FastCDCChunker:
+		if c.Avg < 256 {
+			return fmt.Errorf("the fastcdc chunker requires an average size of at least 256 bytes")
+		}
+	case FixedChunker:
+	default:
+		return fmt.Errorf("unsupported chunker '%s'", c.Name)
+	}
+
+	return nil
+}
+
+//New returns a chunker that reads content from 'r'
+func (c Chunking) New(r io.Reader) (ch Chunker, err error) {
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Name {
+	case RabinChunker:
+		rc := chunker.New(r, chunker.Pol(c.Pol))
+		rc.MinSize = uint(c.Min)
+		rc.MaxSize = uint(c.Max)
+		return &rabinChunker{rc}, nil
+	case FastCDCChunker:
+		return newFastCDC(r, c), nil
+	default:
+		return &fixedChunker{r: r, size: c.Avg}, nil
+	}
+}
+
+type rabinChunker struct{ *chunker.Chunker }
+
+func (rc *rabinChunker) Next(buf []byte) (data []byte, err error) {
+	chunk, err := rc.Chunker.Next(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk.Data, nil
+}
+
+type fixedChunker struct {
+	r    io.Reader
+	size uint64
+}
+
+func (fc *fixedChunker) Next(buf []byte) (data []byte, err error) {
+	if uint64(cap(buf)) < fc.size {
+		buf = make([]byte, fc.size)
+	}
+
+	n, err := io.ReadFull(fc.r, buf[:fc.size])
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+//fastCDC implements "FastCDC: a Fast and Efficient Content-Defined Chunking
+//Approach for Data Deduplication" (Xia et al.) with normalization level 2. Its
+//gear table is derived from the polynomial such that, like rabin chunking,
+//chunk boundaries depend on the deduplication scope
+type fastCDC struct {
+	r     io.Reader
+	c     Chunking
+	gear  [256]uint64
+	maskS uint64
+	maskL uint64
+
+	buf []byte
+	pos int
+	end int
+	eof bool
+}
+
+func newFastCDC(r io.Reader, c Chunking) *fastCDC {
+	fc := &fastCDC{r: r, c: c, buf: make([]byte, 2*c.Max)}
+	for i := range fc.gear {
+		seed := make([]byte, 16)
+		binary.BigEndian.PutUint64(seed[0:], c.Pol)
+		binary.BigEndian.PutUint64(seed[8:], uint64(i))
+		sum := sha256.Sum256(seed)
+		fc.gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+
+	//the gear hash shifts left, so the top bits are influenced by most of
+	//its window. The small mask is harder to match then the large one
+	nbits := uint(63 - bits.LeadingZeros64(c.Avg))
+	fc.maskS = ^uint64(0) << (64 - (nbits + 2))
+	fc.maskL = ^uint64(0) << (64 - (nbits - 2))
+	return fc
+}
+
+func (fc *fastCDC) fill() error {
+	if fc.eof || uint64(fc.end-fc.pos) >= fc.c.Max {
+		return nil
+	}
+
+	copy(fc.buf, fc.buf[fc.pos:fc.end])
+	fc.end -= fc.pos
+	fc.pos = 0
+	for uint64(fc.end) < fc.c.Max {
+		n, err := fc.r.Read(fc.buf[fc.end:])
+		fc.end += n
+		if err == io.EOF {
+			fc.eof = true
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fc *fastCDC) cut(src []byte) int {
+	n := uint64(len(src))
+	if n <= fc.c.Min {
+		return len(src)
+	}
+
+	if n > fc.c.Max {
+		n = fc.c.Max
+	}
+
+	normal := fc.c.Avg
+	if n < normal {
+		normal = n
+	}
+
+	fp := uint64(0)
+	i := fc.c.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + fc.gear[src[i]]
+		if fp&fc.maskS == 0 {
+			return int(i + 1)
+		}
+	}
+
+	for ; i < n; i++ {
+		fp = (fp << 1) + fc.gear[src[i]]
+		if fp&fc.maskL == 0 {
+			return int(i + 1)
+		}
+	}
+
+	return int(n)
+}
+
+func (fc *fastCDC) Next(buf []byte) (data []byte, err error) {
+	err = fc.fill()
+	if err != nil {
+		return nil, err
+	}
+
+	if fc.pos == fc.end {
+		return nil, io.EOF
+	}
+
+	n := fc.cut(fc.buf[fc.pos:fc.end])
+	data = append(buf[:0], fc.buf[fc.pos:fc.pos+n]...)
+	fc.pos += n
+	return data, nil
+}
@@ -0,0 +1,205 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+	"github.com/restic/chunker"
+)
+
+func chunkAll(t *testing.T, c bits.Chunking, content []byte) (chunks [][]byte) {
+	chunkr, err := c.New(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, c.Max)
+	for {
+		data, err := chunkr.Next(buf)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunks = append(chunks, append([]byte{}, data...))
+	}
+
+	return chunks
+}
+
+func TestChunkers(t *testing.T) {
+	content := make([]byte, 3*1024*1024+17)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []bits.Chunking{
+		bits.DefaultChunking(0x3DA3358B4DC173),
+		{Name: bits.FastCDCChunker, Pol: 0x3DA3358B4DC173, Min: 16 * 1024, Avg: 64 * 1024, Max: 256 * 1024},
+		{Name: bits.FixedChunker, Min: 64 * 1024, Avg: 64 * 1024, Max: 64 * 1024},
+	} {
+		parsed, err := bits.ParseChunking(c.String())
+		if err != nil || parsed != c {
+			t.Errorf("expected chunking '%s' to parse into itself, got: %v (%v)", c, parsed, err)
+		}
+
+		chunks := chunkAll(t, c, content)
+		combined := bytes.Join(chunks, nil)
+		if !bytes.Equal(combined, content) {
+			t.Errorf("%s: expected chunks to combine into the original content", c.Name)
+		}
+
+		for i, chunk := range chunks {
+			if uint64(len(chunk)) > c.Max || (i < len(chunks)-1 && uint64(len(chunk)) < c.Min) {
+				t.Errorf("%s: chunk %d has size %d outside of [%d, %d]", c.Name, i, len(chunk), c.Min, c.Max)
+			}
+		}
+	}
+}
+
+func TestFastCDCDeduplicatesInsertions(t *testing.T) {
+	c := bits.Chunking{Name: bits.FastCDCChunker, Pol: 0x3DA3358B4DC173, Min: 8 * 1024, Avg: 32 * 1024, Max: 128 * 1024}
+	content := make([]byte, 4*1024*1024)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := append(append(append([]byte{}, content[:2*1024*1024]...), []byte("inserted")...), content[2*1024*1024:]...)
+	before := map[string]struct{}{}
+	for _, chunk := range chunkAll(t, c, content) {
+		before[string(chunk)] = struct{}{}
+	}
+
+	changed := 0
+	for _, chunk := range chunkAll(t, c, edited) {
+		if _, ok := before[string(chunk)]; !ok {
+			changed++
+		}
+	}
+
+	if changed > 3 {
+		t.Errorf("expected a small insertion to change at most 3 chunks, changed: %d", changed)
+	}
+}
+
+func TestChunkingValidation(t *testing.T) {
+	for _, c := range []bits.Chunking{
+		{Name: bits.RabinChunker, Pol: 0x3DA3358B4DC173, Min: 64 * 1024, Avg: 1024 * 1024, Max: 8 * 1024 * 1024},
+		{Name: bits.FastCDCChunker, Min: 64 * 1024, Avg: 32 * 1024, Max: 128 * 1024},
+		{Name: "foo", Min: 1, Avg: 1, Max: 1},
+	} {
+		if c.Validate() == nil {
+			t.Errorf("expected chunking '%s' to be invalid", c)
+		}
+	}
+}
+
+func TestCheckChunking(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	committed, err := chunker.RandomPolynomial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "config", "-f", bits.SharedConfFile, "bits.deduplication-scope", strconv.FormatUint(uint64(committed), 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 2*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//pointers from before chunking was recorded don't describe it
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := bits.ReadPointer(pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr.Chunking = nil
+	pointer.Reset()
+	_, err = ptr.WriteTo(pointer)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(wd1, "a.bin"), pointer.Bytes(), 0666)
+	}
+
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "add", "-A")
+	}
+
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := bytes.NewBuffer(nil)
+	repo1, err = bits.NewRepository(wd1, output)
+	if err == nil {
+		err = repo1.CheckChunking("a.bin")
+	}
+
+	if err != nil || output.Len() != 0 {
+		t.Fatalf("expected no warnings for a client that uses the committed scope, got: %v, %s", err, output)
+	}
+
+	//a client that overwrites the committed scope
+	local, err := chunker.RandomPolynomial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	GitConfigure(t, ctx, repo1, map[string]string{"bits.deduplication-scope": strconv.FormatUint(uint64(local), 10)})
+	repo1, err = bits.NewRepository(wd1, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"a.bin", "a.bin", "new.bin"} {
+		err = repo1.CheckChunking(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := strings.Count(output.String(), "sets '"); n != 1 {
+		t.Errorf("expected a single warning about the scope, got %d: %s", n, output)
+	}
+
+	if n := strings.Count(output.String(), "'a.bin' was split using chunking"); n != 2 {
+		t.Errorf("expected the legacy pointer to be compared with the committed scope, got: %s", output)
+	}
+}
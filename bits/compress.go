@@ -0,0 +1,143 @@
+package bits
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+//FramedChunkPrefix is hashed before the frame of framed chunks, such that
+//their keys never collide with those of (unframed) chunks. Framed chunks are
+//keyed over the frame rather than the content, as the key also encrypts it
+//the same content framed with another compression never shares a keystream
+var FramedChunkPrefix = []byte("git-bits framed chunk\x00")
+
+//FramedChunkFormat is the pointer value of the chunk format attribute
+//that indicates each chunk starts with the id of its compression
+var FramedChunkFormat = "framed"
+
+//Compression describes a method of compressing chunk content before it is
+//encrypted, when chunks are framed its id is written as the first byte
+type Compression struct {
+	ID        byte
+	Name      string
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	//NoCompression stores chunk content as is
+	NoCompression = &Compression{
+		ID:   0,
+		Name: "none",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	}
+
+	//DeflateCompression compresses chunk content using DEFLATE (RFC 1951)
+	DeflateCompression = &Compression{
+		ID:   1,
+		Name: "deflate",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+
+	//GzipCompression compresses chunk content using gzip (RFC 1952)
+	GzipCompression = &Compression{
+		ID:   2,
+		Name: "gzip",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	}
+
+	//Compressions lists all supported compression methods, new methods
+	//should be added with an id that was never used before
+	Compressions = []*Compression{NoCompression, DeflateCompression, GzipCompression}
+)
+
+//CompressionByName returns the compression method with the given name
+func CompressionByName(name string) (c *Compression, err error) {
+	for _, c := range Compressions {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported compression '%s'", name)
+}
+
+//CompressionByID returns the compression method with the given id
+func CompressionByID(id byte) (c *Compression, err error) {
+	for _, c := range Compressions {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported compression with id '%d', you may need to upgrade git-bits", id)
+}
+
+//Frame returns chunk 'data' prefixed with the id of compression 'c', the
+//content is compressed unless that doesn't result in fewer bytes, in which
+//case it is framed without compression
+func (c *Compression) Frame(data []byte) (frame []byte, err error) {
+	if c != NoCompression {
+		buf := bytes.NewBuffer([]byte{c.ID})
+		cw, err := c.NewWriter(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup %s compression: %v", c.Name, err)
+		}
+
+		_, err = cw.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress chunk: %v", err)
+		}
+
+		err = cw.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to finish compressing chunk: %v", err)
+		}
+
+		if buf.Len() < len(data)+1 {
+			return buf.Bytes(), nil
+		}
+	}
+
+	return append([]byte{NoCompression.ID}, data...), nil
+}
+
+//Unframe reads the compression id from framed chunk content on 'r' and
+//returns a reader for the decompressed content
+func Unframe(r io.Reader) (rc io.ReadCloser, err error) {
+	id := make([]byte, 1)
+	_, err = io.ReadFull(r, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression id: %v", err)
+	}
+
+	c, err := CompressionByID(id[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return c.NewReader(r)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -5,8 +5,15 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/restic/chunker"
 )
 
 //Conf for the bits repository we're using
@@ -23,8 +30,69 @@ type Conf struct {
 
 	//holds the chunking polynomial
 	DeduplicationScope uint64 `json:"deduplication_scope"`
+
+	//deduplication scope that is committed in the shared configuration, zero
+	//if it doesn't set one. It is kept to detect clients that overwrite it
+	SharedDeduplicationScope uint64 `json:"shared_deduplication_scope"`
+
+	//secret that keys chunk hashes, when set only users with the same
+	//secret can derive (and deduplicate against) chunk keys
+	HashSecret string `json:"hash_secret"`
+
+	//path to a file that holds the hash secret, relative paths are
+	//resolved against the root of the repository
+	HashSecretFile string `json:"hash_secret_file"`
+
+	//name of the compression applied to chunk content before encryption,
+	//chunks are not compressed (nor framed) if it is empty
+	Compression string `json:"compression"`
+
+	//name of the chunker that splits files, defaults to rabin
+	Chunker string `json:"chunker"`
+
+	//minimum, average and maximum chunk sizes in bytes, zero values
+	//fall back to the defaults of the rabin chunker
+	ChunkMinSize uint64 `json:"chunk_min_size"`
+	ChunkAvgSize uint64 `json:"chunk_avg_size"`
+	ChunkMaxSize uint64 `json:"chunk_max_size"`
+
+	//files smaller than this many bytes are stored in git as is instead
+	//of being split into chunks, zero disables it
+	MinSize uint64 `json:"min_size"`
+
+	//files of at least this many bytes are stored as a tree of manifest
+	//nodes instead of listing their chunks in the pointer, zero disables it
+	ManifestThreshold uint64 `json:"manifest_threshold"`
+
+	//local chunks that are pushed and not needed by the checkout are
+	//evicted once the local chunks exceed this many bytes, zero disables it
+	LocalCacheSize uint64 `json:"local_cache_size"`
+
+	//directory that stores chunks and the local index instead of the chunks
+	//directory in the git directory, e.g to share it between clones
+	ChunkDir string `json:"chunk_dir"`
+
+	//read-only chunk directories that are consulted for chunks that are
+	//not stored locally, before fetching them from the remote
+	Alternates []string `json:"alternates"`
+
+	//remote chunk stores that can be addressed by name, e.g to migrate
+	//chunks between buckets
+	Remotes map[string]*RemoteConf `json:"remotes"`
 }
 
+//RemoteConf configures a named remote chunk store, credentials that are not
+//configured fall back to those of the default remote
+type RemoteConf struct {
+	AWSS3BucketName    string `json:"aws_s3_bucket_name"`
+	AWSAccessKeyID     string `json:"aws_access_key_id"`
+	AWSSecretAccessKey string `json:"aws_secret_access_key"`
+}
+
+//RemoteConfPrefix starts the configuration keys of named remote chunk stores,
+//e.g 'bits-remote.archive.aws-s3-bucket-name'
+var RemoteConfPrefix = "bits-remote."
+
 //DefaultConf will setup a default configuration
 func DefaultConf() *Conf {
 	return &Conf{
@@ -32,22 +100,99 @@ func DefaultConf() *Conf {
 	}
 }
 
+//SharedConfFile is the name of a configuration file in the root of the
+//repository that can be committed to share configuration, such as the
+//deduplication scope, with everyone that uses the repository. It uses the
+//git config format and is overwritten by configuration set through git
+var SharedConfFile = ".gitbits"
+
 //LoadGitValues will overwrite values based on configuration
 //set through git
 func (conf *Conf) OverwriteFromGit(repo *Repository) (err error) {
+	err = conf.OverwriteFromShared(repo)
+	if err != nil {
+		return fmt.Errorf("failed to load shared configuration: %v", err)
+	}
+
 	buf := bytes.NewBuffer(nil)
 	err = repo.Git(context.Background(), nil, buf, "config", "--get-regexp", "^bits")
 	if err != nil {
 		return nil //no bits conf, nothing to do
 	}
 
-	s := bufio.NewScanner(buf)
+	return conf.overwrite(buf, false)
+}
+
+//OverwriteFromShared will overwrite values based on the shared configuration
+//file in the root of the repository, if there is one. Credentials, secrets,
+//buckets and local paths are never read from the shared configuration
+func (conf *Conf) OverwriteFromShared(repo *Repository) (err error) {
+	_, err = os.Stat(filepath.Join(repo.rootDir, SharedConfFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(context.Background(), nil, buf, "config", "-f", SharedConfFile, "--get-regexp", "^bits")
+	if err != nil {
+		return nil //no bits conf, nothing to do
+	}
+
+	return conf.overwrite(buf, true)
+}
+
+//ValidateScope returns an error if 'scope' can't be used as the polynomial
+//for content based chunking: it must be irreducible and of degree 53
+func ValidateScope(scope uint64) error {
+	pol := chunker.Pol(scope)
+	if pol.Deg() != 53 || !pol.Irreducible() {
+		return fmt.Errorf("deduplication scope '%d' is not an irreducible polynomial of degree 53", scope)
+	}
+
+	return nil
+}
+
+//sharedConfBlocked returns whether configuration 'key' is ignored when it is
+//read from the shared configuration. Secrets and credentials should never be
+//committed, nor should paths that only exist on a single machine. Buckets and
+//secret files are blocked too, as a commit could otherwise send everyone's
+//chunks (and credentials) to another bucket or read the secret from any file
+func sharedConfBlocked(key string) bool {
+	switch key {
+	case "bits.aws-s3-bucket-name",
+		"bits.aws-access-key-id",
+		"bits.aws-secret-access-key",
+		"bits.hash-secret",
+		"bits.hash-secret-file",
+		"bits.chunk-dir",
+		"bits.alternate":
+		return true
+	}
+
+	return strings.HasPrefix(key, RemoteConfPrefix)
+}
+
+func (conf *Conf) overwrite(r io.Reader, shared bool) (err error) {
+	s := bufio.NewScanner(r)
 	for s.Scan() {
-		fields := strings.Fields(s.Text())
+		fields := strings.SplitN(s.Text(), " ", 2)
 		if len(fields) < 2 {
 			return fmt.Errorf("unexpected configuration returned from git: %v", s.Text())
 		}
 
+		if shared && sharedConfBlocked(fields[0]) {
+			continue
+		}
+
+		if strings.HasPrefix(fields[0], RemoteConfPrefix) {
+			err = conf.overwriteRemote(strings.TrimPrefix(fields[0], RemoteConfPrefix), fields[1])
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
 		switch fields[0] {
 		case "bits.deduplication-scope":
 			scope, err := strconv.ParseUint(fields[1], 10, 64)
@@ -56,14 +201,151 @@ func (conf *Conf) OverwriteFromGit(repo *Repository) (err error) {
 			}
 
 			conf.DeduplicationScope = scope
+			if shared {
+				conf.SharedDeduplicationScope = scope
+			}
 		case "bits.aws-s3-bucket-name":
 			conf.AWSS3BucketName = fields[1]
 		case "bits.aws-access-key-id":
 			conf.AWSAccessKeyID = fields[1]
 		case "bits.aws-secret-access-key":
 			conf.AWSSecretAccessKey = fields[1]
+		case "bits.hash-secret":
+			conf.HashSecret = fields[1]
+		case "bits.hash-secret-file":
+			conf.HashSecretFile = fields[1]
+		case "bits.compression":
+			if _, err := CompressionByName(fields[1]); err != nil {
+				return fmt.Errorf("unexpected configured compression '%v': %v", fields[1], err)
+			}
+
+			conf.Compression = fields[1]
+		case "bits.chunker":
+			conf.Chunker = fields[1]
+		case "bits.chunk-min-size", "bits.chunk-avg-size", "bits.chunk-max-size":
+			size, err := humanize.ParseBytes(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured chunk size '%v', expected a number of bytes (e.g 512KiB)", fields[1])
+			}
+
+			switch fields[0] {
+			case "bits.chunk-min-size":
+				conf.ChunkMinSize = size
+			case "bits.chunk-avg-size":
+				conf.ChunkAvgSize = size
+			default:
+				conf.ChunkMaxSize = size
+			}
+		case "bits.min-size":
+			size, err := humanize.ParseBytes(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured minimum size '%v', expected a number of bytes (e.g 64KiB)", fields[1])
+			}
+
+			conf.MinSize = size
+		case "bits.manifest-threshold":
+			size, err := humanize.ParseBytes(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured manifest threshold '%v', expected a number of bytes (e.g 10GiB)", fields[1])
+			}
+
+			conf.ManifestThreshold = size
+		case "bits.local-cache-size":
+			size, err := humanize.ParseBytes(fields[1])
+			if err != nil {
+				return fmt.Errorf("unexpected format for configured local cache size '%v', expected a number of bytes (e.g 20GiB)", fields[1])
+			}
+
+			conf.LocalCacheSize = size
+		case "bits.chunk-dir":
+			conf.ChunkDir = fields[1]
+		case "bits.alternate":
+			conf.Alternates = append(conf.Alternates, fields[1])
 		}
 	}
 
+	return s.Err()
+}
+
+//overwriteRemote sets 'key' of a named remote to 'val', the key is prefixed by
+//the name of the remote. Credentials are skipped for shared configuration
+func (conf *Conf) overwriteRemote(key, val string) (err error) {
+	i := strings.LastIndex(key, ".")
+	if i < 1 {
+		return fmt.Errorf("unexpected remote configuration '%s%s', expected '%s<name>.<key>'", RemoteConfPrefix, key, RemoteConfPrefix)
+	}
+
+	name := key[:i]
+	if conf.Remotes == nil {
+		conf.Remotes = map[string]*RemoteConf{}
+	}
+
+	rconf, ok := conf.Remotes[name]
+	if !ok {
+		rconf = &RemoteConf{}
+		conf.Remotes[name] = rconf
+	}
+
+	switch key[i+1:] {
+	case "aws-s3-bucket-name":
+		rconf.AWSS3BucketName = val
+	case "aws-access-key-id":
+		rconf.AWSAccessKeyID = val
+	case "aws-secret-access-key":
+		rconf.AWSSecretAccessKey = val
+	}
+
 	return nil
 }
+
+//Chunking returns the chunking parameters that are used to split new files
+func (conf *Conf) Chunking() Chunking {
+	c := DefaultChunking(conf.DeduplicationScope)
+	if conf.Chunker != "" {
+		c.Name = conf.Chunker
+	}
+
+	if conf.ChunkMinSize != 0 {
+		c.Min = conf.ChunkMinSize
+	}
+
+	if conf.ChunkAvgSize != 0 {
+		c.Avg = conf.ChunkAvgSize
+	}
+
+	if conf.ChunkMaxSize != 0 {
+		c.Max = conf.ChunkMaxSize
+	}
+
+	return c
+}
+
+//HashKey returns the secret that keys chunk hashes, it is read from the key
+//file if no secret is configured directly. Relative key file paths are
+//resolved against directory 'dir'. An empty key means chunks are not keyed
+func (conf *Conf) HashKey(dir string) (key []byte, err error) {
+	if conf.HashSecret != "" {
+		return []byte(conf.HashSecret), nil
+	}
+
+	if conf.HashSecretFile == "" {
+		return nil, nil
+	}
+
+	p := conf.HashSecretFile
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash secret file '%s': %v", p, err)
+	}
+
+	key = bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("hash secret file '%s' is empty", p)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,96 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/boltdb/bolt"
+	"github.com/dustin/go-humanize"
+)
+
+//ExportOpts configures Export
+type ExportOpts struct {
+
+	//fast-export arguments that select the refs to rewrite, e.g "--branches"
+	Refs []string
+
+	//rewrite even if the working tree has uncommitted changes
+	Force bool
+}
+
+//ExportStats describes what Export did
+type ExportStats struct {
+	RewriteStats
+
+	//distinct pointers that were converted, the size of their content and the
+	//size of the pointers themselves
+	Blobs        int
+	BlobBytes    int64
+	PointerBytes int64
+}
+
+//String formats the stats as a human readable report
+func (s ExportStats) String() string {
+	b := func(n int64) string { return humanize.IBytes(uint64(n)) }
+	return fmt.Sprintf("%s\nconverted %d pointer(s) of %s into blobs of %s",
+		s.RewriteStats, s.Blobs, b(s.PointerBytes), b(s.BlobBytes))
+}
+
+//Export replaces every pointer in the history of the selected refs with the
+//content it describes and removes the bits filter from the root .gitattributes
+//of every commit, see RewriteHistory. It is the inverse of Import, e.g to stop
+//using git-bits. Chunks are fetched as needed and every file is verified while
+//it is combined, history is only rewritten if all of them can be combined
+func (repo *Repository) Export(store *bolt.DB, opts ExportOpts) (stats ExportStats, err error) {
+	stats.RewriteStats, err = repo.RewriteHistory(RewriteOpts{
+		Refs:  opts.Refs,
+		Force: opts.Force,
+		Blob: func(path string, size int64, r io.Reader, w io.Writer) (bool, error) {
+			if size == 0 || size%int64(LineWidth+1) != 0 {
+				return false, nil
+			}
+
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return false, err
+			}
+
+			if !IsPointer(data) {
+				return false, nil
+			}
+
+			err = repo.Fetch(bytes.NewReader(data), ioutil.Discard)
+			if err != nil {
+				return false, fmt.Errorf("failed to fetch chunks: %v", err)
+			}
+
+			err = repo.Combine(bytes.NewReader(data), w)
+			if err != nil {
+				return false, fmt.Errorf("failed to combine: %v", err)
+			}
+
+			return true, nil
+		},
+		Attributes: func(data []byte) ([]byte, error) {
+			data, _ = UntrackPatterns(data, TrackedPatterns(data))
+			return data, nil
+		},
+	})
+
+	if err == nil {
+		err = repo.SaveChunkRecords(store)
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Blobs, stats.BlobBytes, stats.PointerBytes, err = repo.convertedSizes(stats.BlobMap)
+	if err != nil {
+		return stats, fmt.Errorf("failed to determine the size of converted pointers: %v", err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,159 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestExport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	chunks := newMemRemote()
+	repo1.SetRemote(chunks)
+
+	a0 := make([]byte, 2*1024*1024)
+	_, err = rand.Read(a0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commits := []map[string][]byte{{
+		"a.bin":    a0,
+		"docs.txt": []byte("documentation\n"),
+	}, {
+		"a.bin":          append(append([]byte{}, a0...), []byte("appended")...),
+		".gitattributes": []byte("*.txt text\n"),
+	}}
+
+	for i, files := range commits {
+		for name, data := range files {
+			err = ioutil.WriteFile(filepath.Join(wd1, name), data, 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = repo1.Git(ctx, nil, nil, "add", "-A")
+		if err == nil {
+			err = repo1.Git(ctx, nil, nil, "commit", "-m", "c"+string('0'+rune(i)))
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revParse := func(rev string) string {
+		buf := bytes.NewBuffer(nil)
+		err := repo1.Git(ctx, nil, buf, "rev-parse", rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.TrimSpace(buf.String())
+	}
+
+	original := revParse("HEAD")
+	_, err = repo1.Import(store1, bits.ImportOpts{Refs: []string{"--branches"}, Include: []string{"*.bin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revParse("HEAD") == original {
+		t.Fatal("expected import to rewrite history")
+	}
+
+	//chunks are only stored remotely, such that they have to be fetched
+	pointers := bytes.NewBuffer(nil)
+	for _, rev := range []string{"HEAD~1", "HEAD"} {
+		err = repo1.Git(ctx, nil, pointers, "cat-file", "blob", rev+":a.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = repo1.Push(store1, bytes.NewReader(pointers.Bytes()), "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.ForEach(bytes.NewReader(pointers.Bytes()), func(k bits.K) error {
+		p, _ := repo1.Path(k, false)
+		os.Remove(p)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := repo1.Export(store1, bits.ExportOpts{Refs: []string{"--branches"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Blobs != 2 || stats.BlobBytes != int64(len(a0)*2+len("appended")) {
+		t.Errorf("expected both pointers to be converted, got: %s", stats)
+	}
+
+	//exporting is the inverse of importing, which yields the original commits
+	if head := revParse("HEAD"); head != original {
+		t.Errorf("expected export to restore the original history '%s', got: '%s'", original, head)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(wd1, "a.bin"))
+	if err != nil || !bytes.Equal(data, commits[1]["a.bin"]) {
+		t.Errorf("expected working tree to hold the content, got: %v", err)
+	}
+
+	//a pointer of which chunks can't be retrieved leaves history as is
+	_, err = repo1.Import(store1, bits.ImportOpts{Refs: []string{"--branches"}, Include: []string{"*.bin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := revParse("HEAD")
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, pointer, "cat-file", "blob", "HEAD:a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1.SetRemote(newMemRemote())
+	err = repo1.ForEach(bytes.NewReader(pointer.Bytes()), func(k bits.K) error {
+		p, _ := repo1.Path(k, false)
+		os.Remove(p)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo1.Export(store1, bits.ExportOpts{Refs: []string{"--branches"}})
+	if err == nil {
+		t.Errorf("expected export to fail when chunks are missing")
+	}
+
+	if head := revParse("HEAD"); head != imported {
+		t.Errorf("expected failed export to leave history as is")
+	}
+}
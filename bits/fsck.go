@@ -0,0 +1,265 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	//FsckMalformed is reported for blobs that start like a pointer but can't be read
+	FsckMalformed = "malformed"
+
+	//FsckMissing is reported for referenced chunks that are stored nowhere
+	FsckMissing = "missing"
+
+	//FsckUnverified is reported for referenced chunks that are not stored locally
+	//when the remote isn't consulted, they are likely stored remotely
+	FsckUnverified = "unverified"
+
+	//FsckCorrupt is reported for referenced chunks whose content doesn't match their key
+	FsckCorrupt = "corrupt"
+
+	//FsckDanglingLocal is reported for local chunks that are not referenced
+	FsckDanglingLocal = "dangling-local"
+
+	//FsckDanglingRemote is reported for remote chunks that are not referenced
+	FsckDanglingRemote = "dangling-remote"
+)
+
+//FsckProblem describes a single problem found by Fsck
+type FsckProblem struct {
+	Kind   string `json:"kind"`
+	Key    string `json:"key,omitempty"`
+	Object string `json:"object,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+//Fatal returns whether the problem means content can't be restored, dangling
+//chunks only take up space and unverified chunks may well be stored remotely
+func (p FsckProblem) Fatal() bool {
+	return p.Kind != FsckDanglingLocal && p.Kind != FsckDanglingRemote && p.Kind != FsckUnverified
+}
+
+//String formats the problem as a tab separated line
+func (p FsckProblem) String() string {
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s", p.Kind, p.Key, p.Object, p.Path, p.Detail)
+}
+
+//FsckOpts configures what Fsck checks
+type FsckOpts struct {
+
+	//rev-list arguments that select the history to check, e.g "--all"
+	Revs []string
+
+	//also consider chunks that are stored remotely, and report remote
+	//chunks that are not referenced. Otherwise chunks that are not stored
+	//locally are reported as unverified
+	Remote bool
+
+	//decrypt every referenced chunk and verify its content against its
+	//key, chunks that are not stored locally are downloaded
+	Verify bool
+}
+
+//fsckRef is a referenced chunk and the first pointer that referenced it
+type fsckRef struct {
+	ptr    *Pointer
+	obj    string
+	path   string
+	length int64
+}
+
+//Fsck checks that every chunk referenced by the pointers in the selected history
+//is retrievable (and intact when verifying), each problem is passed to 'fn'. It
+//also reports malformed pointers and chunks that are not referenced
+func (repo *Repository) Fsck(opts FsckOpts, fn func(FsckProblem) error) (err error) {
+	if opts.Remote && repo.remote == nil {
+		return fmt.Errorf("no remote configured")
+	}
+
+	//list what the remote stores upfront
+	remote := map[K]struct{}{}
+	remoteOrder := []K{}
+	if opts.Remote {
+		buf := bytes.NewBuffer(nil)
+		err = repo.remote.ListChunks(buf)
+		if err != nil {
+			return fmt.Errorf("failed to list remote chunks: %v", err)
+		}
+
+		err = repo.ForEach(buf, func(k K) error {
+			remote[k] = struct{}{}
+			remoteOrder = append(remoteOrder, k)
+			return nil
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to read remote chunk list: %v", err)
+		}
+	}
+
+	available := func(k K) bool {
+		if repo.haveChunk(k) {
+			return true
+		}
+
+		_, ok := remote[k]
+		return ok
+	}
+
+	//collect referenced chunks, expanding manifests where possible. Manifest
+	//nodes that fail to fetch are reported while walking
+	refs := map[K]fsckRef{}
+	order := []K{}
+	reported := map[K]struct{}{}
+	err = repo.forEachPointerBlob(opts.Revs, func(obj, path string, data []byte) error {
+		ptr, err := ReadPointer(bytes.NewReader(data))
+		if err != nil {
+			return fn(FsckProblem{Kind: FsckMalformed, Object: obj, Path: path, Detail: err.Error()})
+		}
+
+		for i, k := range ptr.Keys {
+			length := int64(-1)
+			if ptr.Lengths != nil {
+				length = ptr.Lengths[i]
+			}
+
+			var ferr error
+			err = repo.walkManifest(ptr, k, ptr.Manifest, length, func(k K, depth int, length int64) error {
+				if _, ok := refs[k]; !ok {
+					refs[k] = fsckRef{ptr, obj, path, length}
+					order = append(order, k)
+				}
+
+				if !available(k) && (opts.Remote || !opts.Verify) {
+					return errSkipNode
+				}
+
+				if depth == 0 || repo.haveChunk(k) {
+					return nil
+				}
+
+				//a node that the remote lists but that can't be fetched is corrupt
+				err := repo.fetchChunk(k)
+				if err != nil {
+					p := FsckProblem{Kind: FsckMissing, Key: fmt.Sprintf("%x", k), Object: obj, Path: path, Detail: err.Error()}
+					if opts.Remote {
+						p.Kind = FsckCorrupt
+					}
+
+					reported[k] = struct{}{}
+					ferr = fn(p)
+					if ferr != nil {
+						return ferr
+					}
+
+					return errSkipNode
+				}
+
+				return nil
+			})
+
+			if ferr != nil {
+				return ferr
+			}
+
+			if err != nil {
+				err = fn(FsckProblem{Kind: FsckMalformed, Object: obj, Path: path, Detail: fmt.Sprintf("failed to read manifest: %v", err)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	//check each referenced chunk
+	for _, k := range order {
+		ref := refs[k]
+		if _, ok := reported[k]; ok {
+			continue
+		}
+
+		if !available(k) && (opts.Remote || !opts.Verify) {
+			p := FsckProblem{Kind: FsckMissing, Key: fmt.Sprintf("%x", k), Object: ref.obj, Path: ref.path}
+			if !opts.Remote {
+				p.Kind, p.Detail = FsckUnverified, "not stored locally, check the remote with --remote"
+			}
+
+			err = fn(p)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !opts.Verify {
+			continue
+		}
+
+		//without the listing of the remote, chunks that can't be fetched
+		//are the ones that are missing
+		err = nil
+		if !repo.haveChunk(k) {
+			err = repo.fetchChunk(k)
+			if err != nil && !opts.Remote {
+				err = fn(FsckProblem{Kind: FsckMissing, Key: fmt.Sprintf("%x", k), Object: ref.obj, Path: ref.path, Detail: err.Error()})
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+		}
+
+		if err == nil {
+			n := int64(0)
+			n, err = repo.copyChunk(ioutil.Discard, ref.ptr, k)
+			if err == nil && ref.length >= 0 && n != ref.length {
+				err = fmt.Errorf("chunk has %d bytes while %d bytes are recorded", n, ref.length)
+			}
+		}
+
+		if err != nil {
+			err = fn(FsckProblem{Kind: FsckCorrupt, Key: fmt.Sprintf("%x", k), Object: ref.obj, Path: ref.path, Detail: err.Error()})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//report chunks that nothing references
+	err = repo.ForEachLocalChunk(func(k K, fi os.FileInfo) error {
+		if _, ok := refs[k]; ok {
+			return nil
+		}
+
+		return fn(FsckProblem{Kind: FsckDanglingLocal, Key: fmt.Sprintf("%x", k)})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, k := range remoteOrder {
+		if _, ok := refs[k]; ok {
+			continue
+		}
+
+		err = fn(FsckProblem{Kind: FsckDanglingRemote, Key: fmt.Sprintf("%x", k)})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestFsck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	chunks := newMemRemote()
+	repo1.SetRemote(chunks)
+
+	keys := map[string]bits.K{}
+	for _, name := range []string{"ok.bin", "pushed.bin", "lost.bin", "corrupt.bin", "dangling.bin"} {
+		content := make([]byte, 1024)
+		_, err = rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pointer := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), pointer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptr, err := bits.ReadPointer(bytes.NewReader(pointer.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys[name] = ptr.Keys[0]
+		if name == "dangling.bin" {
+			continue
+		}
+
+		err = ioutil.WriteFile(filepath.Join(wd1, name), pointer.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name == "pushed.bin" {
+			err = repo1.Push(store1, bytes.NewReader(pointer.Bytes()), "origin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p, _ := repo1.Path(keys[name], false)
+			err = os.Remove(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if name == "lost.bin" {
+			p, _ := repo1.Path(keys[name], false)
+			err = os.Remove(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if name == "corrupt.bin" {
+			p, _ := repo1.Path(keys[name], false)
+			err = ioutil.WriteFile(p, bytes.Repeat([]byte{0x01}, 1024), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	//a manifest of which the root node and the chunks below it are lost
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunker":            "fixed",
+		"bits.chunk-min-size":     "64KiB",
+		"bits.chunk-avg-size":     "64KiB",
+		"bits.chunk-max-size":     "64KiB",
+		"bits.manifest-threshold": "1MiB",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1.SetRemote(chunks)
+	local := map[bits.K]struct{}{}
+	err = repo1.ForEachLocalChunk(func(k bits.K, fi os.FileInfo) error {
+		local[k] = struct{}{}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(wd1, "manifest.bin"), pointer.Bytes(), 0666)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(pointer.Bytes()))
+	if err != nil || ptr.Manifest < 1 {
+		t.Fatalf("expected a pointer to a manifest, got: %v", err)
+	}
+
+	keys["manifest.bin"] = ptr.Keys[0]
+	err = repo1.ForEachLocalChunk(func(k bits.K, fi os.FileInfo) error {
+		if _, ok := local[k]; ok {
+			return nil
+		}
+
+		p, _ := repo1.Path(k, false)
+		return os.Remove(p)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	malformed := fmt.Sprintf("%s%s\n%s", bits.Header(bits.FlatPointerVersion), strings.Repeat("z", bits.LineWidth), bits.Footer)
+	err = ioutil.WriteFile(filepath.Join(wd1, "malformed.bin"), []byte(malformed), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		opts     bits.FsckOpts
+		expected map[string]string
+	}{
+		{bits.FsckOpts{Revs: []string{"--all"}}, map[string]string{
+			"malformed.bin": bits.FsckMalformed,
+			"pushed.bin":    bits.FsckUnverified,
+			"lost.bin":      bits.FsckUnverified,
+			"manifest.bin":  bits.FsckUnverified,
+			"dangling.bin":  bits.FsckDanglingLocal,
+		}},
+		{bits.FsckOpts{Revs: []string{"--all"}, Verify: true}, map[string]string{
+			"malformed.bin": bits.FsckMalformed,
+			"lost.bin":      bits.FsckMissing,
+			"manifest.bin":  bits.FsckMissing,
+			"corrupt.bin":   bits.FsckCorrupt,
+			"dangling.bin":  bits.FsckDanglingLocal,
+		}},
+		{bits.FsckOpts{Revs: []string{"--all"}, Remote: true, Verify: true}, map[string]string{
+			"malformed.bin": bits.FsckMalformed,
+			"lost.bin":      bits.FsckMissing,
+			"manifest.bin":  bits.FsckMissing,
+			"corrupt.bin":   bits.FsckCorrupt,
+			"dangling.bin":  bits.FsckDanglingLocal,
+		}},
+	} {
+		found := map[string]string{}
+		err = repo1.Fsck(c.opts, func(p bits.FsckProblem) error {
+			name := p.Path
+			for n, k := range keys {
+				if p.Key == fmt.Sprintf("%x", k) {
+					name = n
+				}
+			}
+
+			found[name] = p.Kind
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(found) != fmt.Sprint(c.expected) {
+			t.Errorf("expected problems %v, got: %v", c.expected, found)
+		}
+	}
+}
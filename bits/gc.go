@@ -0,0 +1,578 @@
+package bits
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dustin/go-humanize"
+)
+
+//GCExpire is how long unreferenced local chunks are kept by default, chunks
+//that were just staged may not be referenced by the index yet
+var GCExpire = time.Hour
+
+//GCTempExpire is how long temporary chunk files are kept, a chunk that is being
+//written is moved into place well before. Older ones were left by a process
+//that was interrupted while writing
+var GCTempExpire = 24 * time.Hour
+
+//GCOpts configures garbage collection of local chunks
+type GCOpts struct {
+
+	//only report what would be removed
+	DryRun bool
+
+	//only remove chunks that are known to be stored remotely, this is always
+	//the case when the chunk directory is configured as it may be shared with
+	//clones of which the refs can't be seen
+	PushedOnly bool
+
+	//keep unreferenced chunks that were modified more recently than this
+	Expire time.Duration
+}
+
+//GCStats reports the outcome of garbage collection
+type GCStats struct {
+	Kept         int
+	KeptBytes    int64
+	Removed      int
+	RemovedBytes int64
+
+	//removed remote chunks that were uploaded again because refs that were
+	//pushed while collecting reference them
+	Restored int
+}
+
+//String formats the stats as a human readable report
+func (s GCStats) String() string {
+	str := fmt.Sprintf("removed %d chunks (%s), kept %d chunks (%s)",
+		s.Removed, humanize.IBytes(uint64(s.RemovedBytes)), s.Kept, humanize.IBytes(uint64(s.KeptBytes)))
+	if s.Restored > 0 {
+		str += fmt.Sprintf(", restored %d chunks that were referenced meanwhile", s.Restored)
+	}
+
+	return str
+}
+
+//LiveRevs are the rev-list arguments that select everything that references
+//chunks: any ref, the reflog (which includes the stash) and the index
+var LiveRevs = []string{"--all", "--reflog", "--indexed-objects"}
+
+//LiveSet returns the keys of all chunks that are referenced from the repository,
+//see LiveRevs. Keys of manifest nodes and the chunks below them are included
+func (repo *Repository) LiveSet() (live map[K]struct{}, err error) {
+	return repo.liveSet(LiveRevs)
+}
+
+//liveSet returns the keys of all chunks referenced from objects that are
+//selected by rev-list arguments 'revs'
+func (repo *Repository) liveSet(revs []string) (live map[K]struct{}, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.ScanRevs(revs, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan for referenced chunks: %v", err)
+	}
+
+	live = map[K]struct{}{}
+	err = repo.ForEach(buf, func(k K) error {
+		live[k] = struct{}{}
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scanned keys: %v", err)
+	}
+
+	return live, nil
+}
+
+//refCounts counts the references to each chunk from the pointers (and the
+//manifest nodes below them) in objects that are selected by rev-list arguments
+//'revs'. Manifest nodes that are not available locally are counted but not
+//fetched, the number of such nodes is returned as 'unresolved' as the chunks
+//below them are not counted
+func (repo *Repository) refCounts(revs []string) (refs map[K]int, unresolved int, err error) {
+	refs = map[K]int{}
+	err = repo.forEachPointerBlob(revs, func(obj, path string, data []byte) error {
+		ptr, err := ReadPointer(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to read pointer '%s' at '%s', see fsck: %v", obj, path, err)
+		}
+
+		for _, k := range ptr.Keys {
+			err = repo.walkManifest(ptr, k, ptr.Manifest, -1, func(k K, depth int, length int64) error {
+				refs[k]++
+				if depth > 0 && !repo.haveChunk(k) {
+					unresolved++
+					return errSkipNode
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return fmt.Errorf("failed to read manifest of pointer '%s' at '%s': %v", obj, path, err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count chunk references: %v", err)
+	}
+
+	return refs, unresolved, nil
+}
+
+//ForEachLocalChunk calls 'fn' for every chunk that is stored locally
+func (repo *Repository) ForEachLocalChunk(fn func(k K, fi os.FileInfo) error) (err error) {
+	dirs, err := ioutil.ReadDir(repo.chunkDir)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk dir: %v", err)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 4 {
+			continue
+		}
+
+		fis, err := ioutil.ReadDir(filepath.Join(repo.chunkDir, dir.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read chunk dir '%s': %v", dir.Name(), err)
+		}
+
+		for _, fi := range fis {
+			k := K{}
+			data, err := hex.DecodeString(dir.Name() + fi.Name())
+			if err != nil || len(data) != KeySize || fi.IsDir() {
+				continue //not a chunk
+			}
+
+			copy(k[:], data)
+			err = fn(k, fi)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//GC removes local chunks that are not referenced from the repository, see LiveSet.
+//Removed chunks (or those that would be removed on a dry run) are written to 'w'.
+//The reference counts of chunk records are updated while collecting and stale
+//temporary chunk files are removed, see GCTempExpire. Nothing is fetched, if
+//manifest nodes are not stored locally only pushed chunks are removed
+func (repo *Repository) GC(store *bolt.DB, opts GCOpts, w io.Writer) (stats GCStats, err error) {
+	start := time.Now()
+	if repo.conf.ChunkDir != "" {
+		opts.PushedOnly = true
+	}
+
+	live, unresolved, err := repo.refCounts(LiveRevs)
+	if err != nil {
+		return stats, err
+	}
+
+	//without fetching manifest nodes that are not stored locally, the chunks
+	//below them can't be told apart from garbage. Only chunks that can be
+	//fetched again are removed and the counts are left as they are
+	if unresolved > 0 {
+		opts.PushedOnly = true
+	}
+
+	if !opts.DryRun && unresolved == 0 {
+		err = repo.SaveChunkRecords(store)
+		if err == nil {
+			err = store.Update(func(tx *bolt.Tx) error {
+				counted := map[K]int{}
+				err := ForEachChunkRecord(tx, func(k K, rec *ChunkRecord) error {
+					if rec.Refs != live[k] {
+						counted[k] = live[k]
+					}
+
+					return nil
+				})
+
+				if err != nil {
+					return err
+				}
+
+				for k, n := range counted {
+					err = updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+						rec.Refs = n
+						return true
+					})
+
+					if err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+		}
+
+		if err != nil {
+			return stats, fmt.Errorf("failed to update reference counts: %v", err)
+		}
+	}
+
+	err = repo.ForEachLocalChunk(func(k K, fi os.FileInfo) error {
+		keep := func() error {
+			stats.Kept++
+			stats.KeptBytes += fi.Size()
+			return nil
+		}
+
+		if _, ok := live[k]; ok {
+			return keep()
+		}
+
+		if start.Sub(fi.ModTime()) < opts.Expire {
+			return keep()
+		}
+
+		if opts.PushedOnly {
+			pushed := false
+			err := store.View(func(tx *bolt.Tx) error {
+				rec, err := GetChunkRecord(tx, k)
+				pushed = rec != nil && rec.HasRemote(DefaultRemoteName)
+				return err
+			})
+
+			if err != nil {
+				return fmt.Errorf("failed to read index: %v", err)
+			}
+
+			if !pushed {
+				return keep()
+			}
+		}
+
+		if !opts.DryRun {
+			p, _ := repo.Path(k, false)
+			err := os.Remove(p)
+			if err != nil {
+				return fmt.Errorf("failed to remove chunk '%x': %v", k, err)
+			}
+
+			err = store.Update(func(tx *bolt.Tx) error {
+				return forgetLocalChunk(tx, k)
+			})
+
+			if err != nil {
+				return fmt.Errorf("failed to update record of chunk '%x': %v", k, err)
+			}
+		}
+
+		stats.Removed++
+		stats.RemovedBytes += fi.Size()
+		fmt.Fprintf(w, "%x\n", k)
+		return nil
+	})
+
+	if err != nil || opts.DryRun {
+		return stats, err
+	}
+
+	err = repo.removeStaleTemp(start.Add(-GCTempExpire))
+	if err != nil {
+		return stats, fmt.Errorf("failed to remove temporary chunk files: %v", err)
+	}
+
+	return stats, nil
+}
+
+//removeStaleTemp removes the temporary chunk files that were last modified
+//before 'before', see writeChunkFile
+func (repo *Repository) removeStaleTemp(before time.Time) (err error) {
+	paths, err := filepath.Glob(filepath.Join(repo.chunkDir, "*", ".tmp-*"))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil || fi.IsDir() || !fi.ModTime().Before(before) {
+			continue
+		}
+
+		err = os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//GCGracePeriod is how long unreferenced remote chunks are kept by default, a
+//concurrent push uploads chunks before it updates the refs that reference them.
+//A push that reuses chunks which were uploaded earlier doesn't upload them
+//again, such chunks are restored if their refs are pushed while collecting
+var GCGracePeriod = 7 * 24 * time.Hour
+
+//RemoteGCOpts configures garbage collection of the remote chunk store
+type RemoteGCOpts struct {
+
+	//only report what would be removed
+	DryRun bool
+
+	//git remotes whose refs determine which chunks are referenced
+	Remotes []string
+
+	//keep unreferenced chunks that were uploaded more recently than this
+	GracePeriod time.Duration
+
+	//confirms that the remote chunk store holds the chunks of this repository
+	//only, chunks of other repositories that share it look unreferenced
+	Exclusive bool
+}
+
+//RemoteGC removes chunks from the remote chunk store that are not referenced
+//by any of the refs of the git remotes in the options, it requires the remote
+//to implement ChunkDeleter. The refs are listed on the git remotes and must be
+//fetched, refs that change while collecting are fetched again and the removed
+//chunks they reference are restored. Removed chunks (or those that would be
+//removed on a dry run) are written to 'w'. Only a dry run is allowed unless the
+//options confirm that the chunk store is used by this repository exclusively
+func (repo *Repository) RemoteGC(store *bolt.DB, opts RemoteGCOpts, w io.Writer) (stats GCStats, err error) {
+	if repo.remote == nil {
+		return stats, fmt.Errorf("no remote configured")
+	}
+
+	if !opts.DryRun && !opts.Exclusive {
+		return stats, fmt.Errorf("the remote chunk store may be shared with other repositories whose chunks would be removed, confirm that it holds the chunks of this repository only")
+	}
+
+	deleter, ok := repo.remote.(ChunkDeleter)
+	if !ok {
+		return stats, fmt.Errorf("the configured remote doesn't support deleting chunks")
+	}
+
+	if len(opts.Remotes) < 1 {
+		return stats, fmt.Errorf("no git remotes to determine referenced chunks from")
+	}
+
+	//without refs nothing would be referenced, that is more likely a mistake
+	//than an empty remote
+	refs, revs, err := repo.remoteRevs(opts.Remotes)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, name := range opts.Remotes {
+		if len(refs[name]) == 0 {
+			return stats, fmt.Errorf("no refs found for git remote '%s'", name)
+		}
+	}
+
+	start := time.Now()
+	live, err := repo.liveSet(revs)
+	if err != nil {
+		return stats, err
+	}
+
+	deleted := []K{}
+	err = deleter.ListChunkInfo(func(ci ChunkInfo) error {
+		if _, ok := live[ci.K]; ok || start.Sub(ci.LastModified) < opts.GracePeriod {
+			stats.Kept++
+			stats.KeptBytes += ci.Size
+			return nil
+		}
+
+		if !opts.DryRun {
+			err := repo.deleteRemoteChunk(store, deleter, ci.K)
+			if err != nil {
+				return err
+			}
+
+			deleted = append(deleted, ci.K)
+		}
+
+		stats.Removed++
+		stats.RemovedBytes += ci.Size
+		fmt.Fprintf(w, "%x\n", ci.K)
+		return nil
+	})
+
+	if err != nil || len(deleted) == 0 {
+		return stats, err
+	}
+
+	//a concurrent push may reference chunks that were deleted since the refs
+	//were listed, e.g because it skipped uploading chunks the remote stored.
+	//Refs that changed are fetched and those chunks are uploaded again
+	moved := []string{}
+	for _, name := range opts.Remotes {
+		ids, err := repo.remoteRefs(name)
+		if err != nil {
+			return stats, err
+		}
+
+		if strings.Join(ids, " ") == strings.Join(refs[name], " ") {
+			continue
+		}
+
+		err = repo.Git(nil, nil, nil, "fetch", "--tags", name)
+		if err != nil {
+			return stats, fmt.Errorf("failed to fetch git remote '%s' that changed while collecting: %v", name, err)
+		}
+
+		moved = append(moved, ids...)
+	}
+
+	if len(moved) == 0 {
+		return stats, nil
+	}
+
+	live, err = repo.liveSet(moved)
+	if err != nil {
+		return stats, err
+	}
+
+	lost := []string{}
+	for _, k := range deleted {
+		if _, ok := live[k]; !ok {
+			continue
+		}
+
+		if _, ok := repo.lookup(k); !ok {
+			lost = append(lost, fmt.Sprintf("%x", k))
+			continue
+		}
+
+		_, err = repo.pushChunk(store, k, DefaultRemoteName)
+		if err != nil {
+			return stats, fmt.Errorf("failed to restore chunk '%x': %v", k, err)
+		}
+
+		stats.Restored++
+	}
+
+	if len(lost) > 0 {
+		return stats, fmt.Errorf("refs that were pushed while collecting reference %d deleted chunk(s) that are not stored locally, push them again from the clone that has them: %s", len(lost), strings.Join(lost, ", "))
+	}
+
+	return stats, nil
+}
+
+//deleteRemoteChunk deletes the chunk with key 'k' from the remote chunk store
+//and records that it is no longer stored there, such that it is pushed again
+func (repo *Repository) deleteRemoteChunk(store *bolt.DB, deleter ChunkDeleter, k K) (err error) {
+	err = deleter.DeleteChunk(k)
+	if err != nil {
+		return fmt.Errorf("failed to delete chunk '%x': %v", k, err)
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		return updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+			rec.SetRemote(DefaultRemoteName, false)
+			return len(rec.Remotes) > 0 || repo.isLocal(k)
+		})
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to update record of chunk '%x': %v", k, err)
+	}
+
+	return nil
+}
+
+//remoteRevs lists the refs of the git remotes 'names' on the remotes
+//themselves, as tracking refs may be stale. It fails if they point to objects
+//that are not fetched, the objects are returned by remote and all together
+func (repo *Repository) remoteRevs(names []string) (refs map[string][]string, revs []string, err error) {
+	refs = map[string][]string{}
+	revs = []string{}
+	for _, name := range names {
+		ids, err := repo.remoteRefs(name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		missing, err := repo.missingObjects(ids)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(missing) > 0 {
+			return nil, nil, fmt.Errorf("git remote '%s' has refs that are not fetched (e.g '%s'), fetch it first", name, missing[0])
+		}
+
+		refs[name] = ids
+		revs = append(revs, ids...)
+	}
+
+	return refs, revs, nil
+}
+
+//gitRemotes returns the names of the configured git remotes
+func (repo *Repository) gitRemotes() (names []string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, "remote")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list git remotes: %v", err)
+	}
+
+	return strings.Fields(buf.String()), nil
+}
+
+//remoteRefs lists the objects that the branches and tags of git remote 'name'
+//point to as the remote reports them, which may differ from its tracking refs
+func (repo *Repository) remoteRefs(name string) (ids []string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, "ls-remote", "--heads", "--tags", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs of git remote '%s': %v", name, err)
+	}
+
+	seen := map[string]struct{}{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasSuffix(fields[1], "^{}") {
+			continue //peeled tags are reached through the tag itself
+		}
+
+		if _, ok := seen[fields[0]]; !ok {
+			seen[fields[0]] = struct{}{}
+			ids = append(ids, fields[0])
+		}
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+//missingObjects returns which of the objects 'ids' are not stored locally
+func (repo *Repository) missingObjects(ids []string) (missing []string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, strings.NewReader(strings.Join(ids, "\n")+"\n"), buf, "cat-file", "--batch-check")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for objects: %v", err)
+	}
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[1] == "missing" {
+			missing = append(missing, fields[0])
+		}
+	}
+
+	return missing, nil
+}
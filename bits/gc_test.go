@@ -0,0 +1,287 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+//memRemote stores chunks in memory
+type memRemote struct {
+	sync.Mutex
+	chunks map[bits.K][]byte
+	mtimes map[bits.K]time.Time
+
+	//called after a chunk was deleted, if set
+	deleted func(k bits.K)
+}
+
+func newMemRemote() *memRemote {
+	return &memRemote{chunks: map[bits.K][]byte{}, mtimes: map[bits.K]time.Time{}}
+}
+
+type memWriter struct {
+	bytes.Buffer
+	r *memRemote
+	k bits.K
+}
+
+func (w *memWriter) Close() error {
+	w.r.Lock()
+	defer w.r.Unlock()
+	w.r.chunks[w.k] = w.Bytes()
+	w.r.mtimes[w.k] = time.Now()
+	return nil
+}
+
+func (r *memRemote) ChunkReader(k bits.K) (rc io.ReadCloser, err error) {
+	r.Lock()
+	defer r.Unlock()
+	data, ok := r.chunks[k]
+	if !ok {
+		return nil, fmt.Errorf("chunk '%x' doesn't exist", k)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (r *memRemote) ChunkWriter(k bits.K) (wc io.WriteCloser, err error) {
+	return &memWriter{r: r, k: k}, nil
+}
+
+func (r *memRemote) ListChunks(w io.Writer) (err error) {
+	return r.ListChunkInfo(func(ci bits.ChunkInfo) error {
+		_, err := fmt.Fprintf(w, "%x\n", ci.K)
+		return err
+	})
+}
+
+func (r *memRemote) ListChunkInfo(fn func(bits.ChunkInfo) error) (err error) {
+	r.Lock()
+	infos := []bits.ChunkInfo{}
+	for k, data := range r.chunks {
+		infos = append(infos, bits.ChunkInfo{K: k, Size: int64(len(data)), LastModified: r.mtimes[k]})
+	}
+
+	r.Unlock()
+	for _, ci := range infos {
+		err = fn(ci)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *memRemote) DeleteChunk(k bits.K) (err error) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.chunks, k)
+	delete(r.mtimes, k)
+	if r.deleted != nil {
+		defer r.deleted(k)
+	}
+
+	return nil
+}
+
+func TestRemoteGC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	chunks := newMemRemote()
+	repo1.SetRemote(chunks)
+
+	pointers := bytes.NewBuffer(nil)
+	keys := map[string][]bits.K{}
+	for _, name := range []string{"pushed.bin", "deleted.bin"} {
+		content := make([]byte, 1024*1024)
+		_, err = rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pointer := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), pointer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptr, err := bits.ReadPointer(bytes.NewReader(pointer.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys[name] = ptr.Keys
+		pointers.Write(pointer.Bytes())
+		err = ioutil.WriteFile(filepath.Join(wd1, name), pointer.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = repo1.Push(store1, pointers, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//only one of the files ends up in the history of the git remote
+	for _, args := range [][]string{
+		{"add", "pushed.bin"},
+		{"commit", "-m", "c0"},
+		{"push", "--no-verify", "origin", "HEAD:master"},
+		{"fetch", "origin"},
+	} {
+		err = repo1.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deletedPointer, err := ioutil.ReadFile(filepath.Join(wd1, "deleted.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(filepath.Join(wd1, "deleted.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//refs that were pushed but not fetched may reference chunks
+	wd2, repo2 := GitCloneWorkspace(remote1, t)
+	err = ioutil.WriteFile(filepath.Join(wd2, "other.txt"), []byte("other"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"add", "other.txt"},
+		{"commit", "-m", "c1"},
+		{"push", "--no-verify", "origin", "HEAD:other"},
+	} {
+		err = repo2.Git(ctx, nil, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = repo1.RemoteGC(store1, bits.RemoteGCOpts{Remotes: []string{"origin"}, Exclusive: true}, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "fetch it first") {
+		t.Errorf("expected garbage collection with stale tracking refs to fail, got: %v", err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "fetch", "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := bits.RemoteGCOpts{Remotes: []string{"origin"}, GracePeriod: time.Hour, Exclusive: true}
+	stats, err := repo1.RemoteGC(store1, opts, ioutil.Discard)
+	if err != nil || stats.Removed != 0 {
+		t.Errorf("expected recently uploaded chunks to be kept, got: %s (%v)", stats, err)
+	}
+
+	opts.GracePeriod = 0
+	opts.DryRun = true
+	stats, err = repo1.RemoteGC(store1, opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Removed != len(keys["deleted.bin"]) || stats.RemovedBytes == 0 || len(chunks.chunks) != stats.Kept+stats.Removed {
+		t.Errorf("expected a dry run to report the unreferenced chunks without deleting them, got: %s", stats)
+	}
+
+	//other repositories may share the bucket, removing requires confirmation
+	opts.DryRun, opts.Exclusive = false, false
+	_, err = repo1.RemoteGC(store1, opts, ioutil.Discard)
+	if err == nil || len(chunks.chunks) != stats.Kept+stats.Removed {
+		t.Errorf("expected garbage collection of a bucket that may be shared to be refused, got: %v", err)
+	}
+
+	opts.Exclusive = true
+	_, err = repo1.RemoteGC(store1, opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{"pushed.bin": true, "deleted.bin": false} {
+		for _, k := range keys[name] {
+			if _, ok := chunks.chunks[k]; ok != expected {
+				t.Errorf("expected remote chunk '%x' of '%s' to be kept: %v", k, name, expected)
+			}
+		}
+	}
+
+	//a push that deduplicates against chunks which are deleted meanwhile
+	//references them without uploading them, they are restored
+	err = repo1.Push(store1, bytes.NewReader(deletedPointer), "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "deleted.bin"), deletedPointer, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var once sync.Once
+	chunks.deleted = func(k bits.K) {
+		once.Do(func() {
+			for _, args := range [][]string{
+				{"add", "deleted.bin"},
+				{"commit", "-m", "c2"},
+				{"push", "--no-verify", "origin", "HEAD:master"},
+			} {
+				err := repo1.Git(ctx, nil, nil, args...)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+
+	stats, err = repo1.RemoteGC(store1, opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks.deleted = nil
+	if stats.Restored != len(keys["deleted.bin"]) {
+		t.Errorf("expected the chunks that became referenced to be restored, got: %s", stats)
+	}
+
+	for _, name := range []string{"pushed.bin", "deleted.bin"} {
+		for _, k := range keys[name] {
+			if _, ok := chunks.chunks[k]; !ok {
+				t.Errorf("expected remote chunk '%x' of '%s' to be stored", k, name)
+			}
+		}
+	}
+
+	_, err = repo1.RemoteGC(store1, bits.RemoteGCOpts{Remotes: []string{"upstream"}, Exclusive: true}, ioutil.Discard)
+	if err == nil {
+		t.Errorf("expected garbage collection against a remote without refs to fail")
+	}
+}
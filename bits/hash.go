@@ -0,0 +1,52 @@
+package bits
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+//Hash describes how chunk keys are derived from plain-text chunk content
+type Hash string
+
+var (
+	//SHA256Hash derives keys as the plain sha256 of chunk content, anyone that
+	//can guess the content of a chunk can derive its key
+	SHA256Hash = Hash("sha256")
+
+	//HMACSHA256Hash derives keys as the hmac(sha256) of chunk content using the
+	//repository secret as the key, deduplication only happens between users
+	//that share the secret
+	HMACSHA256Hash = Hash("hmac-sha256")
+)
+
+//Hasher returns a function that creates a new hash.Hash for computing chunk
+//keys using hash 'h'. It will fail if keyed hashing is requested but no
+//secret is configured for the repository
+func (repo *Repository) Hasher(h Hash) (fn func() hash.Hash, err error) {
+	switch h {
+	case SHA256Hash:
+		return sha256.New, nil
+	case HMACSHA256Hash:
+		if len(repo.hashKey) == 0 {
+			return nil, fmt.Errorf("chunks are keyed using '%s' but no hash secret is configured, set 'bits.hash-secret' or 'bits.hash-secret-file'", h)
+		}
+
+		return func() hash.Hash {
+			return hmac.New(sha256.New, repo.hashKey)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported chunk hash '%s'", h)
+	}
+}
+
+//Hash returns the hash that is used for keying new chunks, keyed hashing
+//is enabled by configuring a hash secret for the repository
+func (repo *Repository) Hash() Hash {
+	if len(repo.hashKey) > 0 {
+		return HMACSHA256Hash
+	}
+
+	return SHA256Hash
+}
@@ -0,0 +1,357 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/dustin/go-humanize"
+)
+
+//ImportOpts configures Import
+type ImportOpts struct {
+
+	//fast-export arguments that select the refs to rewrite, e.g "--branches"
+	Refs []string
+
+	//patterns in the gitattributes syntax of the files that are converted, they
+	//are tracked in the root .gitattributes of every commit
+	Include []string
+
+	//only convert blobs larger than this many bytes, then the exact paths of
+	//the converted blobs are tracked instead of the patterns
+	Above int64
+
+	//rewrite even if the working tree has uncommitted changes
+	Force bool
+}
+
+//ImportStats describes what Import did
+type ImportStats struct {
+	RewriteStats
+
+	//distinct blobs that were converted, their size and the size of the
+	//pointers that replaced them
+	Blobs        int
+	BlobBytes    int64
+	PointerBytes int64
+
+	//storage of the chunks that the rewritten history references
+	After *Stats
+}
+
+//String formats the stats as a human readable report
+func (s ImportStats) String() string {
+	b := func(n int64) string { return humanize.IBytes(uint64(n)) }
+	change := "reducing the blobs in history by " + b(s.BlobBytes-s.PointerBytes)
+	if s.PointerBytes > s.BlobBytes {
+		change = "growing the blobs in history by " + b(s.PointerBytes-s.BlobBytes)
+	}
+
+	return fmt.Sprintf("%s\nconverted %d blob(s) of %s into pointers of %s, %s\nthe chunks take up %s (dedup %.2fx)",
+		s.RewriteStats, s.Blobs, b(s.BlobBytes), b(s.PointerBytes), change,
+		b(s.After.UniqueBytes), s.After.DedupRatio)
+}
+
+//Import converts the files that match the included patterns in the history of
+//the selected refs into pointers, e.g when adopting git-bits in a repository
+//that already holds large files. Matching blobs are split and replaced by their
+//pointers, and the patterns are tracked in every commit, see RewriteHistory.
+//Blobs that are already pointers or that Split would store as is are kept. With
+//a size threshold the paths of the converted blobs are tracked instead, such
+//that smaller files that match are not split once staged again. The chunks are
+//stored locally, pushing the rewritten history pushes them too
+func (repo *Repository) Import(store *bolt.DB, opts ImportOpts) (stats ImportStats, err error) {
+	if len(opts.Include) == 0 {
+		return stats, fmt.Errorf("no patterns to include")
+	}
+
+	res := []*regexp.Regexp{}
+	for _, p := range opts.Include {
+		re, err := attrPatternRegexp(p)
+		if err != nil {
+			return stats, err
+		}
+
+		res = append(res, re)
+	}
+
+	match := func(path string) bool {
+		for _, re := range res {
+			if re.MatchString(path) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	//keep what Split would copy as is
+	convert := func(size int64, hdr []byte) bool {
+		return size > opts.Above && !IsPointer(hdr) && (uint64(size) >= repo.conf.MinSize || HoldsKeys(hdr))
+	}
+
+	tracked := opts.Include
+	if opts.Above > 0 {
+		paths, err := repo.convertedPaths(opts.Refs, match, opts.Above, convert)
+		if err != nil {
+			return stats, err
+		}
+
+		tracked = []string{}
+		for _, p := range paths {
+			if strings.ContainsAny(p, " \t\n\r") {
+				return stats, fmt.Errorf("cannot track '%s' in .gitattributes as it contains whitespace, import without a size threshold", p)
+			}
+
+			tracked = append(tracked, "/"+attrEscaper.Replace(p))
+		}
+	}
+
+	stats.RewriteStats, err = repo.RewriteHistory(RewriteOpts{
+		Refs:  opts.Refs,
+		Force: opts.Force,
+		Match: match,
+		Blob: func(path string, size int64, r io.Reader, w io.Writer) (bool, error) {
+			bufr := bufio.NewReaderSize(r, LineWidth+1)
+			hdr, _ := bufr.Peek(LineWidth + 1)
+			if !convert(size, hdr) {
+				return false, nil
+			}
+
+			err := repo.Split(bufr, w)
+			if err != nil {
+				return false, fmt.Errorf("failed to split: %v", err)
+			}
+
+			return true, nil
+		},
+		Attributes: func(data []byte) ([]byte, error) {
+			data, _ = TrackPatterns(data, tracked)
+			return data, nil
+		},
+	})
+
+	if err != nil {
+		return stats, err
+	}
+
+	err = repo.SaveChunkRecords(store)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Blobs, stats.BlobBytes, stats.PointerBytes, err = repo.convertedSizes(stats.BlobMap)
+	if err != nil {
+		return stats, fmt.Errorf("failed to determine the size of converted blobs: %v", err)
+	}
+
+	stats.After, err = repo.Stats(store, StatsOpts{Revs: opts.Refs})
+	if err != nil {
+		return stats, fmt.Errorf("failed to gather stats after importing: %v", err)
+	}
+
+	return stats, nil
+}
+
+//attrEscaper escapes the characters that have a meaning in gitattributes
+//patterns, such that a path only matches itself
+var attrEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+//convertedPaths returns the sorted paths of the blobs in the history selected by
+//'revs' that match and that 'convert' accepts, it is passed their size and the
+//first bytes of blobs larger than 'above'. The diffs of every commit against
+//each of its parents are listed, such that every path a blob was stored at is
+//found
+func (repo *Repository) convertedPaths(revs []string, match func(path string) bool, above int64, convert func(size int64, hdr []byte) bool) (paths []string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, append([]string{"log", "--raw", "-z", "--no-abbrev", "--no-renames", "-m", "--root", "--diff-filter=d", "--format="}, revs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changed files: %v", err)
+	}
+
+	//records are ':<old mode> <new mode> <old id> <new id> <status>\0<path>\0'
+	blobPaths := map[string][]string{}
+	fields := strings.Split(buf.String(), "\x00")
+	for i := 0; i+1 < len(fields); i++ {
+		meta := strings.Fields(strings.TrimLeft(fields[i], "\n"))
+		if len(meta) != 5 || !strings.HasPrefix(meta[0], ":") {
+			continue
+		}
+
+		path := fields[i+1]
+		i++
+		if (meta[1] != "100644" && meta[1] != "100755") || !match(path) {
+			continue
+		}
+
+		blobPaths[meta[3]] = append(blobPaths[meta[3]], path)
+	}
+
+	ids := bytes.NewBuffer(nil)
+	for id := range blobPaths {
+		fmt.Fprintf(ids, "%s\n", id)
+	}
+
+	buf.Reset()
+	err = repo.Git(nil, ids, buf, "cat-file", "--batch-check")
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine blob sizes: %v", err)
+	}
+
+	cat, err := repo.startCatFile()
+	if err != nil {
+		return nil, err
+	}
+
+	defer cat.Close()
+	found := map[string]struct{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			continue
+		}
+
+		size, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil || size <= above {
+			continue
+		}
+
+		var hdr []byte
+		err = cat.Read(f[0], func(_ int64, r io.Reader) error {
+			hdr = make([]byte, LineWidth+1)
+			n, _ := io.ReadFull(r, hdr)
+			hdr = hdr[:n]
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !convert(size, hdr) {
+			continue
+		}
+
+		for _, p := range blobPaths[f[0]] {
+			found[p] = struct{}{}
+		}
+	}
+
+	for p := range found {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+//convertedSizes counts the blobs in 'blobMap' that were converted between
+//a pointer and content, in either direction, and sums the sizes of the
+//content and of the pointers. Other rewritten blobs are not counted
+func (repo *Repository) convertedSizes(blobMap map[string]string) (blobs int, contentBytes, pointerBytes int64, err error) {
+	cat, err := repo.startCatFile()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	defer cat.Close()
+	describe := func(id string) (size int64, isPointer bool, err error) {
+		err = cat.Read(id, func(n int64, r io.Reader) error {
+			hdr := make([]byte, LineWidth+1)
+			_, err := io.ReadFull(r, hdr)
+			size, isPointer = n, err == nil && IsPointer(hdr)
+			return nil
+		})
+
+		return size, isPointer, err
+	}
+
+	for old, id := range blobMap {
+		if id == "" {
+			continue
+		}
+
+		oldSize, oldPointer, err := describe(old)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		newSize, newPointer, err := describe(id)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		switch {
+		case newPointer && !oldPointer:
+			contentBytes += oldSize
+			pointerBytes += newSize
+		case oldPointer && !newPointer:
+			contentBytes += newSize
+			pointerBytes += oldSize
+		default:
+			continue
+		}
+
+		blobs++
+	}
+
+	return blobs, contentBytes, pointerBytes, nil
+}
+
+//attrPatternRegexp compiles a pattern in the gitattributes syntax into a regular
+//expression that matches the paths it applies to: patterns without a slash match
+//the file name in any directory, others match relative to the root, '*' and '?'
+//don't match a slash while '**' matches any number of directories
+func attrPatternRegexp(pattern string) (re *regexp.Regexp, err error) {
+	if pattern == "" || strings.ContainsAny(pattern, " \t\n") || strings.HasPrefix(pattern, "#") || strings.HasPrefix(pattern, "!") {
+		return nil, fmt.Errorf("unsupported pattern '%s', it must not be empty, contain whitespace or start with '#' or '!'", pattern)
+	}
+
+	expr := "^"
+	if !strings.Contains(pattern, "/") {
+		expr += "(?:.*/)?"
+	}
+
+	pattern = strings.TrimPrefix(pattern, "/")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr += "(?:.*/)?"
+			i += 2
+		case pattern[i:] == "**":
+			expr += ".*"
+			i++
+		case c == '*':
+			expr += "[^/]*"
+		case c == '?':
+			expr += "[^/]"
+		case c == '[' && strings.IndexByte(pattern[i+1:], ']') > 0:
+			class := pattern[i+1 : i+1+strings.IndexByte(pattern[i+1:], ']')]
+			i += len(class) + 1
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expr += "[" + class + "]"
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		default:
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+
+	re, err = regexp.Compile(expr + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+	}
+
+	return re, nil
+}
@@ -0,0 +1,153 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestImport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	a0 := make([]byte, 2*1024*1024)
+	_, err = rand.Read(a0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1 := append(append([]byte{}, a0...), []byte("appended")...)
+	commits := []map[string][]byte{{
+		"a.bin":          a0,
+		"small.bin":      []byte("tiny\n"),
+		"docs.txt":       []byte("documentation\n"),
+		".gitattributes": []byte("*.txt text\n"),
+	}, {
+		"a.bin":     a1,
+		"sub/b.bin": a0,
+	}}
+
+	for i, files := range commits {
+		for name, data := range files {
+			p := filepath.Join(wd1, filepath.FromSlash(name))
+			err = os.MkdirAll(filepath.Dir(p), 0777)
+			if err == nil {
+				err = ioutil.WriteFile(p, data, 0666)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = repo1.Git(ctx, nil, nil, "add", "-A")
+		if err == nil {
+			err = repo1.Git(ctx, nil, nil, "commit", "-m", "c"+string('0'+rune(i)))
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	show := func(obj string) []byte {
+		buf := bytes.NewBuffer(nil)
+		err := repo1.Git(ctx, nil, buf, "cat-file", "blob", obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.Bytes()
+	}
+
+	stats, err := repo1.Import(store1, bits.ImportOpts{
+		Refs:    []string{"--branches"},
+		Include: []string{"*.bin"},
+		Above:   64,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Commits != 2 || stats.Blobs != 2 || stats.BlobBytes != int64(len(a0)+len(a1)) {
+		t.Errorf("expected two distinct blobs to be converted in two commits, got: %s", stats)
+	}
+
+	if stats.PointerBytes >= 64*1024 || stats.After.LogicalBytes != int64(len(a0)+len(a1)) {
+		t.Errorf("expected pointers to be small and to reference both versions, got: %s", stats)
+	}
+
+	for _, rev := range []string{"HEAD~1", "HEAD"} {
+		if attrs := string(show(rev + ":.gitattributes")); attrs != "*.txt text\n/a.bin filter=bits\n/sub/b.bin filter=bits\n" {
+			t.Errorf("expected '%s' to track the converted paths only, got attributes: %q", rev, attrs)
+		}
+
+		if small := string(show(rev + ":small.bin")); small != "tiny\n" {
+			t.Errorf("expected small file to be kept as is in '%s', got: %q", rev, small)
+		}
+	}
+
+	for obj, content := range map[string][]byte{"HEAD~1:a.bin": a0, "HEAD:a.bin": a1, "HEAD:sub/b.bin": a0} {
+		pointer := show(obj)
+		if !bits.IsPointer(pointer) {
+			t.Fatalf("expected '%s' to be a pointer", obj)
+		}
+
+		combined := bytes.NewBuffer(nil)
+		err = repo1.Combine(bytes.NewReader(pointer), combined)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(combined.Bytes(), content) {
+			t.Errorf("expected '%s' to combine into its original content", obj)
+		}
+	}
+
+	//importing again doesn't convert anything
+	stats, err = repo1.Import(store1, bits.ImportOpts{Refs: []string{"--branches"}, Include: []string{"*.bin"}, Above: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Blobs != 0 || len(stats.BlobMap) != 0 {
+		t.Errorf("expected a second import to be a no-op, got: %s", stats)
+	}
+
+	_, err = repo1.Import(store1, bits.ImportOpts{Refs: []string{"--branches"}, Include: []string{"!*.bin"}})
+	if err == nil {
+		t.Errorf("expected negated pattern to be rejected")
+	}
+
+	//remote-tracking refs are not ours to rewrite
+	err = repo1.Git(ctx, nil, nil, "push", "--no-verify", "origin", "HEAD:master")
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "fetch", "origin")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo1.Import(store1, bits.ImportOpts{Refs: []string{"--all"}, Include: []string{"*.bin"}})
+	if err == nil || !strings.Contains(err.Error(), "refs/remotes/origin/master") {
+		t.Errorf("expected rewriting remote-tracking refs to be refused, got: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package bits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	//ManifestFanout is the average number of entries in a manifest node, node
+	//boundaries are derived from the keys of the entries such that an edit
+	//only rewrites the nodes that hold the affected chunks (and their parents)
+	ManifestFanout uint32 = 256
+
+	//ManifestMaxFanout is the maximum number of entries in a manifest node
+	ManifestMaxFanout = 1024
+
+	//ManifestMagic starts the plain-text of every manifest node
+	ManifestMagic = []byte("git-bits manifest\n")
+
+	//errSkipNode can be returned by walk functions to skip the children
+	//of a manifest node
+	errSkipNode = errors.New("skip manifest node")
+)
+
+//ManifestEntry refers to a chunk, or another manifest node, and the number
+//of plain-text file bytes that it covers
+type ManifestEntry struct {
+	K      K
+	Length int64
+}
+
+//encodeManifest formats entries as the plain-text of a manifest node
+func encodeManifest(entries []ManifestEntry) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(ManifestMagic)+len(entries)*(KeySize+8)))
+	buf.Write(ManifestMagic)
+	for _, e := range entries {
+		buf.Write(e.K[:])
+		binary.Write(buf, binary.BigEndian, e.Length)
+	}
+
+	return buf.Bytes()
+}
+
+//decodeManifest parses the plain-text of a manifest node
+func decodeManifest(data []byte) (entries []ManifestEntry, err error) {
+	if !bytes.HasPrefix(data, ManifestMagic) || (len(data)-len(ManifestMagic))%(KeySize+8) != 0 {
+		return nil, fmt.Errorf("chunk is not a manifest node")
+	}
+
+	data = data[len(ManifestMagic):]
+	for len(data) > 0 {
+		e := ManifestEntry{}
+		copy(e.K[:], data[:KeySize])
+		e.Length = int64(binary.BigEndian.Uint64(data[KeySize:]))
+		entries = append(entries, e)
+		data = data[KeySize+8:]
+	}
+
+	return entries, nil
+}
+
+//buildManifest stores the tree of manifest nodes over the chunks with keys
+//'keys' and plain-text lengths 'lengths' using 'store'. It returns the key of
+//the root node and the depth of the tree
+func buildManifest(keys []K, lengths []int64, store func(data []byte) (K, error)) (root K, depth int, err error) {
+	level := make([]ManifestEntry, len(keys))
+	for i, k := range keys {
+		level[i] = ManifestEntry{k, lengths[i]}
+	}
+
+	for depth == 0 || len(level) > 1 {
+		parents := []ManifestEntry{}
+		node := []ManifestEntry{}
+		for i, e := range level {
+			node = append(node, e)
+			if i < len(level)-1 && len(node) < ManifestMaxFanout && binary.BigEndian.Uint32(e.K[KeySize-4:])%ManifestFanout != 0 {
+				continue
+			}
+
+			parent := ManifestEntry{}
+			for _, e := range node {
+				parent.Length += e.Length
+			}
+
+			parent.K, err = store(encodeManifest(node))
+			if err != nil {
+				return root, depth, fmt.Errorf("failed to store manifest node: %v", err)
+			}
+
+			parents = append(parents, parent)
+			node = node[:0]
+		}
+
+		level = parents
+		depth++
+	}
+
+	return level[0].K, depth, nil
+}
+
+//readManifest decrypts and parses the locally stored manifest node with key
+//'k', chunks are decoded as described by pointer 'ptr'
+func (repo *Repository) readManifest(ptr *Pointer, k K) (entries []ManifestEntry, err error) {
+	buf := bytes.NewBuffer(nil)
+	_, err = repo.copyChunk(buf, ptr, k)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err = decodeManifest(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode manifest node '%x': %v", k, err)
+	}
+
+	return entries, nil
+}
+
+//walkManifest calls 'fn' for the manifest node with key 'k' at 'depth' and
+//everything below it in file order, nodes are passed before their children and
+//chunks are passed with a depth of zero. The node must be stored locally once
+//'fn' returns, which allows 'fn' to fetch it. If 'fn' returns errSkipNode the
+//children of the node are skipped
+func (repo *Repository) walkManifest(ptr *Pointer, k K, depth int, length int64, fn func(k K, depth int, length int64) error) (err error) {
+	err = fn(k, depth, length)
+	if err == errSkipNode {
+		return nil
+	}
+
+	if err != nil || depth == 0 {
+		return err
+	}
+
+	entries, err := repo.readManifest(ptr, k)
+	if err != nil {
+		return err
+	}
+
+	total := int64(0)
+	for _, e := range entries {
+		total += e.Length
+		err = repo.walkManifest(ptr, e.K, depth-1, e.Length, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if length >= 0 && total != length {
+		return fmt.Errorf("manifest node '%x' covers %d bytes while its parent records %d bytes", k, total, length)
+	}
+
+	return nil
+}
+
+//haveChunk returns whether the chunk with key 'k' is stored locally, or in
+//one of the alternate chunk directories
+func (repo *Repository) haveChunk(k K) bool {
+	_, ok := repo.lookup(k)
+	return ok
+}
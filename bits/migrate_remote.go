@@ -0,0 +1,338 @@
+package bits
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/dustin/go-humanize"
+)
+
+//MigrateRemoteParallel is the default number of chunks that are transferred
+//between remotes concurrently
+var MigrateRemoteParallel = 8
+
+//MigrateRemoteOpts configures MigrateRemote
+type MigrateRemoteOpts struct {
+
+	//names of the remote chunk stores to copy chunks from and to
+	From string
+	To   string
+
+	//rev-list arguments that select the history of which referenced chunks
+	//are copied, e.g "--all"
+	Revs []string
+
+	//number of chunks that are transferred concurrently, defaults to
+	//MigrateRemoteParallel
+	Parallel int
+
+	//don't list the destination upfront, chunks are only skipped if the
+	//local store records them as stored by the destination, e.g to resume
+	//a migration to a large bucket
+	NoList bool
+
+	//verify the content of every copied chunk against its key by reading
+	//it back from the destination, instead of only checking that it's listed
+	VerifyContent bool
+}
+
+//MigrateRemoteStats describes what was copied by MigrateRemote
+type MigrateRemoteStats struct {
+	Chunks      int
+	Skipped     int
+	Copied      int
+	CopiedBytes int64
+
+	//chunks of which the content was read back from the destination
+	Verified int
+}
+
+//String formats the stats as a human readable report
+func (s MigrateRemoteStats) String() string {
+	check := fmt.Sprintf("checked that the destination lists %d chunks", s.Chunks)
+	if s.Verified > 0 {
+		check = fmt.Sprintf("verified the content of %d chunks", s.Verified)
+	}
+
+	return fmt.Sprintf("copied %d chunks (%s), skipped %d chunks that were already present, %s",
+		s.Copied, humanize.IBytes(uint64(s.CopiedBytes)), s.Skipped, check)
+}
+
+//MigrateRemote copies every chunk referenced by the pointers in the selected
+//history from one named remote chunk store to another, see NamedRemote. Chunks
+//are skipped if the destination lists them or if the local store records them
+//as stored by the destination, and each copied chunk is recorded as such right
+//away, which allows an interrupted migration to be resumed. Copied chunks are
+//written to 'w'. The migration ends by checking that the destination stores
+//every referenced chunk
+func (repo *Repository) MigrateRemote(store *bolt.DB, opts MigrateRemoteOpts, w io.Writer) (stats MigrateRemoteStats, err error) {
+	if opts.From == opts.To {
+		return stats, fmt.Errorf("can't migrate chunks from remote '%s' to itself", opts.From)
+	}
+
+	from, err := repo.NamedRemote(opts.From)
+	if err != nil {
+		return stats, err
+	}
+
+	to, err := repo.NamedRemote(opts.To)
+	if err != nil {
+		return stats, err
+	}
+
+	if opts.Parallel < 1 {
+		opts.Parallel = MigrateRemoteParallel
+	}
+
+	//collect referenced chunks, manifest nodes are read from the source
+	keys := []K{}
+	ptrs := map[K]*Pointer{}
+	err = repo.forEachReferencedChunk(opts.Revs, from, func(ptr *Pointer, k K, depth int, length int64) error {
+		keys = append(keys, k)
+		ptrs[k] = ptr
+		return nil
+	})
+
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Chunks = len(keys)
+
+	//update what the local store knows about the destination
+	if !opts.NoList {
+		listed, err := listRemote(to)
+		if err != nil {
+			return stats, fmt.Errorf("failed to list chunks of remote '%s': %v", opts.To, err)
+		}
+
+		err = store.Update(func(tx *bolt.Tx) error {
+			for _, k := range keys {
+				_, ok := listed[k]
+				err := updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+					rec.SetRemote(opts.To, ok)
+					return len(rec.Remotes) > 0 || repo.isLocal(k)
+				})
+
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return stats, fmt.Errorf("failed to record chunks of remote '%s': %v", opts.To, err)
+		}
+	}
+
+	todo := []K{}
+	err = store.View(func(tx *bolt.Tx) error {
+		for _, k := range keys {
+			rec, err := GetChunkRecord(tx, k)
+			if err != nil {
+				return err
+			}
+
+			if rec != nil && rec.HasRemote(opts.To) {
+				stats.Skipped++
+				continue
+			}
+
+			todo = append(todo, k)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return stats, fmt.Errorf("failed to read chunk records: %v", err)
+	}
+
+	//copy chunks concurrently, recording each as it completes
+	mu := sync.Mutex{}
+	sizes := map[K]int64{}
+	err = forEachParallel(todo, opts.Parallel, func(k K) error {
+		n, err := copyRemoteChunk(from, to, k)
+		if err != nil {
+			return err
+		}
+
+		err = store.Batch(func(tx *bolt.Tx) error {
+			return updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+				rec.SetRemote(opts.To, true)
+				return true
+			})
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to record chunk '%x' as copied: %v", k, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		sizes[k] = n
+		stats.Copied++
+		stats.CopiedBytes += n
+		fmt.Fprintf(w, "%x (copied %s)\n", k, humanize.IBytes(uint64(n)))
+		return nil
+	})
+
+	if err != nil {
+		return stats, fmt.Errorf("failed to copy chunks: %v", err)
+	}
+
+	//verify that the destination stores everything that is referenced
+	listed, err := listRemote(to)
+	if err != nil {
+		return stats, fmt.Errorf("failed to list chunks of remote '%s' for verification: %v", opts.To, err)
+	}
+
+	problems := []string{}
+	for _, k := range keys {
+		size, ok := listed[k]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("chunk '%x' is not stored", k))
+		} else if n, copied := sizes[k]; copied && size >= 0 && size != n {
+			problems = append(problems, fmt.Sprintf("chunk '%x' is stored with %d bytes while %d bytes were copied", k, size, n))
+		}
+	}
+
+	if len(problems) > 0 {
+		return stats, fmt.Errorf("remote '%s' failed verification: \n\t%s", opts.To, strings.Join(problems, "\n\t"))
+	}
+
+	if opts.VerifyContent {
+		err = forEachParallel(keys, opts.Parallel, func(k K) error {
+			return repo.verifyRemoteChunk(to, ptrs[k], k)
+		})
+
+		if err != nil {
+			return stats, fmt.Errorf("remote '%s' failed verification: %v", opts.To, err)
+		}
+
+		stats.Verified = len(keys)
+	}
+
+	return stats, nil
+}
+
+//listRemote returns the keys of the chunks that 'remote' stores with their
+//sizes, which are -1 if the remote can't describe its chunks
+func listRemote(remote Remote) (listed map[K]int64, err error) {
+	listed = map[K]int64{}
+	if lister, ok := remote.(ChunkInfoLister); ok {
+		err = lister.ListChunkInfo(func(ci ChunkInfo) error {
+			listed[ci.K] = ci.Size
+			return nil
+		})
+
+		return listed, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(remote.ListChunks(pw))
+	}()
+
+	defer pr.Close()
+	err = forEachLine(pr, nil, nil, func(k K) error {
+		listed[k] = -1
+		return nil
+	})
+
+	return listed, err
+}
+
+//copyRemoteChunk streams chunk 'k' from remote 'from' to remote 'to'
+func copyRemoteChunk(from, to Remote, k K) (n int64, err error) {
+	rc, err := from.ChunkReader(k)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get chunk reader for key '%x': %v", k, err)
+	}
+
+	defer rc.Close()
+	wc, err := to.ChunkWriter(k)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get chunk writer for key '%x': %v", k, err)
+	}
+
+	n, err = io.Copy(wc, rc)
+	if err != nil {
+		wc.Close()
+		return n, fmt.Errorf("failed to copy chunk '%x' after %d bytes: %v", k, n, err)
+	}
+
+	err = wc.Close()
+	if err != nil {
+		return n, fmt.Errorf("failed to finish writing chunk '%x': %v", k, err)
+	}
+
+	return n, nil
+}
+
+//verifyRemoteChunk reads chunk 'k' from 'remote' and verifies its content
+//against its key, it is decoded as described by pointer 'ptr'
+func (repo *Repository) verifyRemoteChunk(remote Remote, ptr *Pointer, k K) (err error) {
+	newHash, err := repo.Hasher(ptr.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to setup chunk hashing: %v", err)
+	}
+
+	rc, err := remote.ChunkReader(k)
+	if err != nil {
+		return fmt.Errorf("failed to get chunk reader for key '%x': %v", k, err)
+	}
+
+	defer rc.Close()
+	_, err = decodeChunk(ioutil.Discard, rc, newHash, ptr.ChunkFormat, k)
+	return err
+}
+
+//forEachParallel calls 'fn' for each key using 'n' goroutines, keys that are
+//not yet handled are skipped once 'fn' fails. It returns the errors of all
+//failed calls
+func forEachParallel(keys []K, n int, fn func(k K) error) (err error) {
+	keyCh := make(chan K)
+	mu := sync.Mutex{}
+	errs := []string{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keyCh {
+				err := fn(k)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err.Error())
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, k := range keys {
+		mu.Lock()
+		failed := len(errs) > 0
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		keyCh <- k
+	}
+
+	close(keyCh)
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("%d chunk(s) failed: \n\t%s", len(errs), strings.Join(errs, "\n\t"))
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestMigrateRemote(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits-remote.archive.aws-s3-bucket-name": "archive-bucket",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	_, err = repo1.NamedRemote("archive")
+	if err != nil {
+		t.Errorf("expected a configured remote to be setup, got: %v", err)
+	}
+
+	_, err = repo1.NamedRemote("unknown")
+	if err == nil {
+		t.Errorf("expected a remote that isn't configured to fail")
+	}
+
+	origin := newMemRemote()
+	archive := newMemRemote()
+	repo1.SetRemote(origin)
+	repo1.SetNamedRemote("archive", archive)
+
+	content := make([]byte, 5*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store1, bytes.NewReader(pointer.Bytes()), "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "a.bin"), pointer.Bytes(), 0666)
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "add", "-A")
+	}
+
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(pointer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ptr.Keys) < 2 {
+		t.Fatalf("expected content to split into multiple chunks, got: %d", len(ptr.Keys))
+	}
+
+	//the destination already stores one of the chunks
+	archive.chunks[ptr.Keys[0]] = origin.chunks[ptr.Keys[0]]
+	opts := bits.MigrateRemoteOpts{From: "origin", To: "archive", Revs: []string{"HEAD"}, Parallel: 2, VerifyContent: true}
+	stats, err := repo1.MigrateRemote(store1, opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Chunks != len(ptr.Keys) || stats.Skipped != 1 || stats.Copied != len(ptr.Keys)-1 || stats.Verified != len(ptr.Keys) {
+		t.Errorf("expected every chunk but one to be copied and all to be verified, got: %s", stats)
+	}
+
+	for _, k := range ptr.Keys {
+		if !bytes.Equal(archive.chunks[k], origin.chunks[k]) {
+			t.Errorf("expected chunk '%x' to be copied", k)
+		}
+	}
+
+	//without listing the destination the local store decides what is skipped
+	delete(archive.chunks, ptr.Keys[1])
+	opts.NoList = true
+	stats, err = repo1.MigrateRemote(store1, opts, ioutil.Discard)
+	if err == nil || stats.Copied != 0 {
+		t.Errorf("expected a chunk that is recorded as copied to be skipped and fail verification, got: %s, %v", stats, err)
+	}
+
+	opts.NoList, opts.VerifyContent = false, false
+	stats, err = repo1.MigrateRemote(store1, opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Copied != 1 || archive.chunks[ptr.Keys[1]] == nil {
+		t.Errorf("expected the missing chunk to be copied again, got: %s", stats)
+	}
+
+	if stats.Verified != 0 || strings.Contains(stats.String(), "verified") {
+		t.Errorf("expected chunks to only be reported as listed without verifying their content, got: %s", stats)
+	}
+
+	_, err = repo1.MigrateRemote(store1, bits.MigrateRemoteOpts{From: "origin", To: "origin"}, ioutil.Discard)
+	if err == nil {
+		t.Errorf("expected migrating a remote to itself to fail")
+	}
+}
@@ -0,0 +1,179 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+//forEachPointerBlob calls 'fn' with the content of every blob that is selected
+//by rev-list arguments 'revs' and starts with a pointer header, the path is the
+//first path rev-list found the blob at. Pointers are not parsed such that 'fn'
+//can handle malformed pointers. Objects are streamed through a single pipeline:
+//
+//   rev-list --objects <revs> | cat-file --batch-check | filter | cat-file --batch
+//
+func (repo *Repository) forEachPointerBlob(revs []string, fn func(obj, path string, data []byte) error) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//closing the readers unblocks the stages if 'fn' stops early
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	r3, w3 := io.Pipe()
+	r4, w4 := io.Pipe()
+	for _, r := range []*io.PipeReader{r1, r2, r3, r4} {
+		defer r.Close()
+	}
+
+	go func() {
+		err := repo.Git(ctx, nil, w1, append([]string{"rev-list", "--objects"}, revs...)...)
+		if err != nil {
+			err = fmt.Errorf("failed to list objects: %v", err)
+		}
+
+		w1.CloseWithError(err)
+	}()
+
+	format := "%(objectname) %(objecttype) %(objectsize) %(rest)"
+	go func() {
+		err := repo.Git(ctx, r1, w2, "cat-file", "--batch-check="+format)
+		if err != nil {
+			err = fmt.Errorf("failed to check objects: %v", err)
+		}
+
+		w2.CloseWithError(err)
+	}()
+
+	//keep blobs that could be pointers, rev-list lists every object once
+	go func() {
+		s := bufio.NewScanner(r2)
+		for s.Scan() {
+			fields := bytes.SplitN(s.Bytes(), []byte(" "), 4)
+			if len(fields) < 3 || !bytes.Equal(fields[1], []byte("blob")) {
+				continue
+			}
+
+			size, err := strconv.ParseInt(string(fields[2]), 10, 64)
+			if err != nil || size == 0 || size%int64(LineWidth+1) != 0 {
+				continue
+			}
+
+			path := []byte{}
+			if len(fields) > 3 {
+				path = fields[3]
+			}
+
+			_, err = fmt.Fprintf(w3, "%s %s\n", fields[0], path)
+			if err != nil {
+				w3.CloseWithError(err)
+				return
+			}
+		}
+
+		w3.CloseWithError(s.Err())
+	}()
+
+	go func() {
+		err := repo.Git(ctx, r3, w4, "cat-file", "--batch="+format)
+		if err != nil {
+			err = fmt.Errorf("failed to read objects: %v", err)
+		}
+
+		w4.CloseWithError(err)
+	}()
+
+	//read candidates: "<sha> blob <size> <path>\n<content>\n"
+	bufr := bufio.NewReader(r4)
+	for {
+		line, err := bufr.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read object header: %v", err)
+		}
+
+		fields := bytes.SplitN(bytes.TrimSuffix(line, []byte("\n")), []byte(" "), 4)
+		if len(fields) < 3 {
+			return fmt.Errorf("unexpected object header '%s'", bytes.TrimSpace(line))
+		}
+
+		size, err := strconv.ParseInt(string(fields[2]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected object size in '%s'", bytes.TrimSpace(line))
+		}
+
+		data := make([]byte, size+1)
+		_, err = io.ReadFull(bufr, data)
+		if err != nil {
+			return fmt.Errorf("failed to read object '%s': %v", fields[0], err)
+		}
+
+		if !IsPointer(data[:size]) {
+			continue
+		}
+
+		path := ""
+		if len(fields) > 3 {
+			path = string(fields[3])
+		}
+
+		err = fn(string(fields[0]), path, data[:size])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//forEachReferencedChunk calls 'fn' once for every distinct chunk that is
+//referenced by the pointers in the objects selected by rev-list arguments
+//'revs', including manifest nodes and the chunks below them. The first pointer
+//that referenced the chunk is passed along, manifest nodes have a depth above
+//zero. Manifest nodes that are not available locally are fetched from 'remote'
+func (repo *Repository) forEachReferencedChunk(revs []string, remote Remote, fn func(ptr *Pointer, k K, depth int, length int64) error) (err error) {
+	seen := map[K]struct{}{}
+	return repo.forEachPointerBlob(revs, func(obj, path string, data []byte) error {
+		ptr, err := ReadPointer(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to read pointer '%s' at '%s', see fsck: %v", obj, path, err)
+		}
+
+		for i, k := range ptr.Keys {
+			length := int64(-1)
+			if ptr.Lengths != nil {
+				length = ptr.Lengths[i]
+			}
+
+			err = repo.walkManifest(ptr, k, ptr.Manifest, length, func(k K, depth int, length int64) error {
+				if _, ok := seen[k]; ok {
+					return errSkipNode
+				}
+
+				seen[k] = struct{}{}
+				err := fn(ptr, k, depth, length)
+				if err != nil {
+					return err
+				}
+
+				if depth > 0 && !repo.haveChunk(k) {
+					return repo.fetchChunkFrom(remote, k)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return fmt.Errorf("failed to collect chunks of pointer '%s' at '%s': %v", obj, path, err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,507 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//LineWidth is the width of each line in a pointer file (excluding the
+//newline), pointer sizes are therefore always a multiple of LineWidth+1
+var LineWidth = hex.EncodedLen(KeySize)
+
+//PointerVersion is the newest version of the pointer format, pointers with
+//a newer version can't be read
+var PointerVersion = 3
+
+var (
+	//FlatPointerVersion is the version of pointers that list the keys of all
+	//chunks. Pointers are written with the oldest version that can describe
+	//them, such that older clients can keep reading them
+	FlatPointerVersion = 2
+
+	//ManifestPointerVersion is the version of pointers that list the keys
+	//of manifest nodes instead of the chunks themselves
+	ManifestPointerVersion = 3
+)
+
+var (
+	//LegacyHeader starts pointers of the first version, these only hold keys
+	//(and attributes written by some pre-release versions)
+	LegacyHeader = []byte("--- to use this file decode it with the 'git-bits' extension ---\n")
+
+	//HeaderPrefix starts the header of versioned pointers, it is followed
+	//by the version number
+	HeaderPrefix = []byte("--- git-bits pointer v")
+
+	//Footer ends every pointer
+	Footer = []byte("----------------------- end of chunks --------------------------\n")
+)
+
+var (
+	//AttrHash records how the keys of the chunks in the pointer were derived
+	AttrHash = "hash"
+
+	//AttrChunkFormat records how chunk content is laid out before encryption
+	AttrChunkFormat = "chunk-format"
+
+	//AttrChunker records the chunker and its parameters that split the file
+	AttrChunker = "chunker"
+
+	//AttrCipher records how chunks are encrypted
+	AttrCipher = "cipher"
+
+	//AttrSize records the size of the original file in bytes
+	AttrSize = "size"
+
+	//AttrSHA256 records the base64 encoded sha256 of the original file
+	AttrSHA256 = "sha256"
+
+	//AttrHMACSHA256 records the base64 encoded hmac(sha256) of the original
+	//file keyed with the hash secret, keyed pointers record it instead of the
+	//sha256 such that it can't be used to confirm guesses of the content
+	AttrHMACSHA256 = "hmac-sha256"
+
+	//AttrLengths records the plain-text length of chunks, in the order of
+	//their keys. It is repeated as many times as required to fit all lengths
+	AttrLengths = "lengths"
+
+	//AttrManifest records the depth of the manifest tree that the keys in
+	//the pointer refer to, pointers without it refer to chunks directly
+	AttrManifest = "manifest"
+)
+
+var (
+	//PlainChunkFormat indicates chunks hold their content as is
+	PlainChunkFormat = "plain"
+
+	//AES256OFBCipher encrypts chunks with AES-256 in OFB mode, using the
+	//chunk key as the encryption key and a zero IV as each key is unique
+	AES256OFBCipher = "aes256-ofb"
+)
+
+//Header returns the first line of a pointer with format version 'v'
+func Header(v int) []byte {
+	if v < 2 {
+		return LegacyHeader
+	}
+
+	line := []byte(fmt.Sprintf("%s%d, decode it with the git-bits extension ", HeaderPrefix, v))
+	if len(line) < LineWidth {
+		line = append(line, bytes.Repeat([]byte("-"), LineWidth-len(line))...)
+	}
+
+	return append(line[:LineWidth], '\n')
+}
+
+//ParseHeader returns the format version of the pointer if 'line' (without
+//newline) is a pointer header, ok is false if it isn't.
+func ParseHeader(line []byte) (v int, ok bool) {
+	if bytes.Equal(line, LegacyHeader[:len(LegacyHeader)-1]) {
+		return 1, true
+	}
+
+	if len(line) != LineWidth || !bytes.HasPrefix(line, HeaderPrefix) {
+		return 0, false
+	}
+
+	digits := line[len(HeaderPrefix):]
+	if i := bytes.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = digits[:i]
+	}
+
+	v, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return 0, false
+	}
+
+	return v, true
+}
+
+//IsPointer returns whether 'data' starts with a pointer header line
+func IsPointer(data []byte) bool {
+	if len(data) < LineWidth+1 || data[LineWidth] != '\n' {
+		return false
+	}
+
+	_, ok := ParseHeader(data[:LineWidth])
+	return ok
+}
+
+//HoldsKeys returns whether 'data' starts with a pointer header or a line that
+//holds a chunk key. Fetch and Combine interpret such input as a list of keys
+//while anything else is passed through as is
+func HoldsKeys(data []byte) bool {
+	if IsPointer(data) {
+		return true
+	}
+
+	if len(data) < LineWidth+1 || data[LineWidth] != '\n' {
+		return false
+	}
+
+	_, err := hex.DecodeString(string(data[:LineWidth]))
+	return err == nil
+}
+
+//CheckVersion returns an error if pointers of version 'v' can't be read
+func CheckVersion(v int) error {
+	if v > PointerVersion {
+		return fmt.Errorf("pointer format version %d is not supported by this version of git-bits (supports up to version %d), please upgrade git-bits", v, PointerVersion)
+	}
+
+	return nil
+}
+
+//FormatAttr formats a named pointer attribute as a line that is padded with
+//spaces to the width of a key line, such that the size of the pointer remains
+//a multiple of the line width
+func FormatAttr(name, val string) (line []byte, err error) {
+	line = []byte(fmt.Sprintf("%s %s", name, val))
+	if len(line) > LineWidth {
+		return nil, fmt.Errorf("attribute '%s' with value '%s' doesn't fit on a single line of %d characters", name, val, LineWidth)
+	}
+
+	line = append(line, bytes.Repeat([]byte(" "), LineWidth-len(line))...)
+	if !IsAttr(line) {
+		return nil, fmt.Errorf("attribute name '%s' is invalid", name)
+	}
+
+	return append(line, '\n'), nil
+}
+
+//IsAttr returns whether a line (without newline) holds a pointer attribute
+//instead of a chunk key: it starts with a lower case name that is seperated
+//from its value by a space, chunk keys never contain spaces.
+func IsAttr(line []byte) bool {
+	if len(line) != LineWidth || line[0] < 'a' || line[0] > 'z' {
+		return false
+	}
+
+	return bytes.IndexByte(line, ' ') > 0
+}
+
+//ParseAttr returns the name and value of the attribute in 'line', ok is
+//false if the line doesn't hold an attribute
+func ParseAttr(line []byte) (name, val string, ok bool) {
+	if !IsAttr(line) {
+		return "", "", false
+	}
+
+	fields := bytes.SplitN(bytes.TrimRight(line, " "), []byte(" "), 2)
+	if len(fields) < 2 {
+		return string(fields[0]), "", true
+	}
+
+	return string(fields[0]), string(fields[1]), true
+}
+
+//Pointer describes a file that was split into chunks, it is what is stored
+//in git instead of the file content
+type Pointer struct {
+
+	//version of the pointer format
+	Version int
+
+	//how chunk keys were derived from their content
+	Hash Hash
+
+	//how chunk content is laid out before encryption
+	ChunkFormat string
+
+	//how chunks are encrypted
+	Cipher string
+
+	//chunking that split the file, nil if it wasn't recorded
+	Chunking *Chunking
+
+	//depth of the manifest tree the keys refer to, zero if the keys
+	//refer to chunks directly
+	Manifest int
+
+	//size and checksum of the original file, Size is -1 and the checksums
+	//are nil if they weren't recorded. Keyed pointers record the hmac(sha256)
+	//instead of the sha256, see Checksum
+	Size       int64
+	SHA256     []byte
+	HMACSHA256 []byte
+
+	//keys of the chunks that make up the file and their plain-text
+	//lengths, Lengths is nil if they weren't recorded
+	Keys    []K
+	Lengths []int64
+}
+
+//NewPointer returns a pointer that lists its chunks directly, with the defaults
+//that apply to pointers that don't record attributes
+func NewPointer() *Pointer {
+	return &Pointer{
+		Version:     FlatPointerVersion,
+		Hash:        SHA256Hash,
+		ChunkFormat: PlainChunkFormat,
+		Cipher:      AES256OFBCipher,
+		Size:        -1,
+	}
+}
+
+//Checksum returns the checksum of the original file that the pointer records
+//and the hash that computed it, 'sum' is nil if no checksum is recorded
+func (p *Pointer) Checksum() (h Hash, sum []byte) {
+	if p.HMACSHA256 != nil {
+		return HMACSHA256Hash, p.HMACSHA256
+	}
+
+	return SHA256Hash, p.SHA256
+}
+
+//SetAttr updates the pointer with attribute 'name', it fails for attributes
+//and values that are not supported
+func (p *Pointer) SetAttr(name, val string) (err error) {
+	switch name {
+	case AttrHash:
+		p.Hash = Hash(val)
+	case AttrChunkFormat:
+		if val != PlainChunkFormat && val != FramedChunkFormat {
+			return fmt.Errorf("unsupported chunk format '%s', you may need to upgrade git-bits", val)
+		}
+
+		p.ChunkFormat = val
+	case AttrCipher:
+		if val != AES256OFBCipher {
+			return fmt.Errorf("unsupported cipher '%s', you may need to upgrade git-bits", val)
+		}
+
+		p.Cipher = val
+	case AttrChunker:
+		c, err := ParseChunking(val)
+		if err != nil {
+			return err
+		}
+
+		p.Chunking = &c
+	case AttrManifest:
+		p.Manifest, err = strconv.Atoi(val)
+		if err != nil || p.Manifest < 0 {
+			return fmt.Errorf("unexpected format for manifest depth '%s'", val)
+		}
+	case AttrSize:
+		p.Size, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected format for size '%s': %v", val, err)
+		}
+	case AttrSHA256:
+		p.SHA256, err = base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return fmt.Errorf("unexpected format for sha256 '%s': %v", val, err)
+		}
+	case AttrHMACSHA256:
+		p.HMACSHA256, err = base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return fmt.Errorf("unexpected format for hmac-sha256 '%s': %v", val, err)
+		}
+	case AttrLengths:
+		for _, f := range strings.Fields(val) {
+			l, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected format for chunk length '%s': %v", f, err)
+			}
+
+			p.Lengths = append(p.Lengths, l)
+		}
+	default:
+		return fmt.Errorf("unsupported pointer attribute '%s', you may need to upgrade git-bits", name)
+	}
+
+	return nil
+}
+
+//ReadPointer reads a complete pointer from 'r', it fails if the pointer
+//is malformed or has a format version that is not supported
+func ReadPointer(r io.Reader) (p *Pointer, err error) {
+	p = NewPointer()
+	p.Version = 0
+	err = forEachLine(r, func(v int) error {
+		p.Version = v
+		return nil
+	}, p.SetAttr, func(k K) error {
+		p.Keys = append(p.Keys, k)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Version == 0 {
+		return nil, fmt.Errorf("no pointer header found")
+	}
+
+	if p.Lengths != nil && len(p.Lengths) != len(p.Keys) {
+		return nil, fmt.Errorf("pointer records %d chunk lengths for %d keys", len(p.Lengths), len(p.Keys))
+	}
+
+	return p, nil
+}
+
+//WriteTo writes the pointer to 'w' using the oldest format version that can
+//describe it. Attributes that describe chunks are written before the keys,
+//attributes that describe the whole file after them
+func (p *Pointer) WriteTo(w io.Writer) (n int64, err error) {
+	v := p.Version
+	if v < FlatPointerVersion {
+		v = FlatPointerVersion
+	}
+
+	if p.Manifest > 0 && v < ManifestPointerVersion {
+		v = ManifestPointerVersion
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(Header(v))
+	attr := func(name, val string) {
+		if err != nil {
+			return
+		}
+
+		line, ferr := FormatAttr(name, val)
+		if ferr != nil {
+			err = ferr
+			return
+		}
+
+		buf.Write(line)
+	}
+
+	attr(AttrHash, string(p.Hash))
+	attr(AttrChunkFormat, p.ChunkFormat)
+	attr(AttrCipher, p.Cipher)
+	if p.Chunking != nil {
+		attr(AttrChunker, p.Chunking.String())
+	}
+
+	if p.Manifest > 0 {
+		attr(AttrManifest, strconv.Itoa(p.Manifest))
+	}
+
+	for _, k := range p.Keys {
+		fmt.Fprintf(buf, "%x\n", k)
+	}
+
+	if p.Size >= 0 {
+		attr(AttrSize, strconv.FormatInt(p.Size, 10))
+	}
+
+	if p.SHA256 != nil {
+		attr(AttrSHA256, base64.StdEncoding.EncodeToString(p.SHA256))
+	}
+
+	if p.HMACSHA256 != nil {
+		attr(AttrHMACSHA256, base64.StdEncoding.EncodeToString(p.HMACSHA256))
+	}
+
+	lengths := []string{}
+	width := len(AttrLengths)
+	for _, l := range p.Lengths {
+		s := strconv.FormatInt(l, 10)
+		if width+1+len(s) > LineWidth {
+			attr(AttrLengths, strings.Join(lengths, " "))
+			lengths = lengths[:0]
+			width = len(AttrLengths)
+		}
+
+		lengths = append(lengths, s)
+		width += 1 + len(s)
+	}
+
+	if len(lengths) > 0 {
+		attr(AttrLengths, strings.Join(lengths, " "))
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to format pointer: %v", err)
+	}
+
+	buf.Write(Footer)
+	return buf.WriteTo(w)
+}
+
+//forEachLine scans a pointer (or plain list of keys) on 'r' and calls 'hfn'
+//for the header, 'afn' for each attribute and 'kfn' for each key. Any of the
+//functions may be nil to skip those lines. It fails on headers with a format
+//version that is not supported.
+func forEachLine(r io.Reader, hfn func(v int) error, afn func(name, val string) error, kfn func(K) error) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+
+		//check the version of headers
+		if v, ok := ParseHeader(s.Bytes()); ok {
+			err := CheckVersion(v)
+			if err != nil {
+				return err
+			}
+
+			if hfn != nil {
+				err = hfn(v)
+				if err != nil {
+					return fmt.Errorf("failed to handle header: %v", err)
+				}
+			}
+
+			continue
+		}
+
+		//and in any case skip the footer
+		if bytes.Equal(s.Bytes(), Footer[:len(Footer)-1]) {
+			continue
+		}
+
+		//hand over attributes
+		if name, val, ok := ParseAttr(s.Bytes()); ok {
+			if afn == nil {
+				continue
+			}
+
+			err := afn(name, val)
+			if err != nil {
+				return fmt.Errorf("failed to handle attribute '%s': %v", name, err)
+			}
+
+			continue
+		}
+
+		//decode the actual keys
+		data := make([]byte, hex.DecodedLen(len(s.Bytes())))
+		_, err := hex.Decode(data, s.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to decode '%x' as hex: %v", s.Bytes(), err)
+		}
+
+		//check key length
+		k := K{}
+		if len(k) != len(data) {
+			return fmt.Errorf("decoded chunk key '%x' has an invalid length %d, expected %d", data, len(data), len(k))
+		}
+
+		//fill K and hand it over
+		if kfn == nil {
+			continue
+		}
+
+		copy(k[:], data[:KeySize])
+		err = kfn(k)
+		if err != nil {
+			return fmt.Errorf("failed to handle key '%x': %v", k, err)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("failed to scan chunk keys: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package bits_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestPointerRoundTrip(t *testing.T) {
+	c := bits.DefaultChunking(0x3DA3358B4DC173)
+	sum := sha256.Sum256([]byte("foo"))
+	ptr := bits.NewPointer()
+	ptr.Hash = bits.HMACSHA256Hash
+	ptr.ChunkFormat = bits.FramedChunkFormat
+	ptr.Chunking = &c
+	ptr.SHA256 = sum[:]
+	ptr.Lengths = []int64{}
+	ptr.Size = 0
+	for i := 0; i < 100; i++ {
+		k := bits.K{}
+		k[0] = byte(i)
+		ptr.Keys = append(ptr.Keys, k)
+		ptr.Lengths = append(ptr.Lengths, int64(524288+i))
+		ptr.Size += int64(524288 + i)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	_, err := ptr.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len()%(bits.LineWidth+1) != 0 {
+		t.Errorf("expected pointer size to be a multiple of %d, got: %d", bits.LineWidth+1, buf.Len())
+	}
+
+	if !bits.IsPointer(buf.Bytes()) {
+		t.Errorf("expected written pointer to be recognized as such")
+	}
+
+	read, err := bits.ReadPointer(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ptr, read) {
+		t.Errorf("expected pointer to read back equal, wrote: %+v, read: %+v", ptr, read)
+	}
+}
+
+func TestReadLegacyPointer(t *testing.T) {
+	k := bits.K{0x01}
+	legacy := fmt.Sprintf("%s%x\n%s", bits.LegacyHeader, k, bits.Footer)
+	ptr, err := bits.ReadPointer(strings.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr.Version != 1 || ptr.Hash != bits.SHA256Hash || ptr.Size != -1 || ptr.Lengths != nil || len(ptr.Keys) != 1 || ptr.Keys[0] != k {
+		t.Errorf("expected legacy pointer to be read with defaults, got: %+v", ptr)
+	}
+}
+
+func TestReadUnsupportedPointer(t *testing.T) {
+	future := fmt.Sprintf("%s%x\n%s", bits.Header(bits.PointerVersion+1), bits.K{}, bits.Footer)
+	if !bits.IsPointer([]byte(future)) {
+		t.Errorf("expected pointer of a future version to be recognized as pointer")
+	}
+
+	_, err := bits.ReadPointer(strings.NewReader(future))
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected pointer of a future version to fail clearly, got: %v", err)
+	}
+}
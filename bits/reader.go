@@ -0,0 +1,174 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+//Reader provides random access to the content of a file that was split into
+//chunks. Only chunks that cover the requested range are fetched and decrypted,
+//it uses the chunk lengths recorded in the pointer to locate them
+type Reader struct {
+	repo    *Repository
+	ptr     *Pointer
+	offsets []int64
+	pos     int64
+
+	mu    sync.Mutex
+	cidx  int
+	cdata []byte
+}
+
+//Open returns a reader for the file described by the pointer on 'r'. Pointers
+//that don't record chunk lengths (those of the first format version) can't be
+//opened, stage the file again to upgrade its pointer
+func (repo *Repository) Open(r io.Reader) (rd *Reader, err error) {
+	ptr, err := ReadPointer(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pointer: %v", err)
+	}
+
+	//pointers that refer to manifests are expanded into the chunks
+	//that make up the file, fetching manifest nodes as required
+	if ptr.Manifest > 0 {
+		keys, lengths := []K{}, []int64{}
+		for _, root := range ptr.Keys {
+			err = repo.walkManifest(ptr, root, ptr.Manifest, -1, func(k K, depth int, length int64) error {
+				if depth > 0 {
+					return repo.fetchChunk(k)
+				}
+
+				keys = append(keys, k)
+				lengths = append(lengths, length)
+				return nil
+			})
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to read manifest: %v", err)
+			}
+		}
+
+		ptr.Keys, ptr.Lengths, ptr.Manifest = keys, lengths, 0
+	}
+
+	if ptr.Lengths == nil || ptr.Size < 0 {
+		return nil, fmt.Errorf("pointer doesn't record chunk lengths, re-stage the file to allow random access")
+	}
+
+	if len(ptr.Lengths) != len(ptr.Keys) {
+		return nil, fmt.Errorf("pointer records %d chunk lengths for %d keys, it may be truncated or corrupt", len(ptr.Lengths), len(ptr.Keys))
+	}
+
+	rd = &Reader{repo: repo, ptr: ptr, cidx: -1}
+	rd.offsets = make([]int64, len(ptr.Lengths)+1)
+	for i, l := range ptr.Lengths {
+		rd.offsets[i+1] = rd.offsets[i] + l
+	}
+
+	if rd.offsets[len(ptr.Lengths)] != ptr.Size {
+		return nil, fmt.Errorf("pointer chunk lengths add up to %d bytes while it records %d bytes", rd.offsets[len(ptr.Lengths)], ptr.Size)
+	}
+
+	return rd, nil
+}
+
+//Size returns the size of the file in bytes
+func (rd *Reader) Size() int64 {
+	return rd.ptr.Size
+}
+
+//chunk returns the plain-text content of the i-th chunk, fetching it from the
+//remote if it isn't stored locally. The last chunk is kept in memory such that
+//small sequential reads don't decrypt the same chunk over and over
+func (rd *Reader) chunk(i int) (data []byte, err error) {
+	if i == rd.cidx {
+		return rd.cdata, nil
+	}
+
+	k := rd.ptr.Keys[i]
+	err = rd.repo.fetchChunk(k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunk '%x': %v", k, err)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, rd.ptr.Lengths[i]))
+	_, err = rd.repo.copyChunk(buf, rd.ptr, k)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(buf.Len()) != rd.ptr.Lengths[i] {
+		return nil, fmt.Errorf("chunk '%x' has %d bytes while its pointer records %d bytes", k, buf.Len(), rd.ptr.Lengths[i])
+	}
+
+	rd.cidx, rd.cdata = i, buf.Bytes()
+	return rd.cdata, nil
+}
+
+//ReadAt implements io.ReaderAt, it is safe to call concurrently
+func (rd *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	//find the chunk that holds the offset, offsets has a trailing
+	//entry that holds the size of the file
+	i := sort.Search(len(rd.offsets)-1, func(i int) bool { return rd.offsets[i+1] > off })
+	for n < len(p) && i < len(rd.ptr.Keys) {
+		data, err := rd.chunk(i)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], data[off+int64(n)-rd.offsets[i]:])
+		i++
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+//Read implements io.Reader
+func (rd *Reader) Read(p []byte) (n int, err error) {
+	if rd.pos >= rd.ptr.Size {
+		return 0, io.EOF
+	}
+
+	n, err = rd.ReadAt(p, rd.pos)
+	rd.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+//Seek implements io.Seeker
+func (rd *Reader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += rd.pos
+	case io.SeekEnd:
+		pos += rd.ptr.Size
+	default:
+		return rd.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if pos < 0 {
+		return rd.pos, fmt.Errorf("negative position %d", pos)
+	}
+
+	rd.pos = pos
+	return pos, nil
+}
@@ -0,0 +1,80 @@
+package bits
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+	"github.com/dustin/go-humanize"
+)
+
+//RechunkOpts configures Rechunk
+type RechunkOpts struct {
+
+	//fast-export arguments that select the refs to rewrite, e.g "--branches"
+	Refs []string
+
+	//rewrite even if the working tree has uncommitted changes
+	Force bool
+}
+
+//RechunkStats describes what Rechunk did, and the storage that the
+//rewritten history takes up before and after
+type RechunkStats struct {
+	RewriteStats
+	Before *Stats
+	After  *Stats
+}
+
+//String formats the stats as a human readable report
+func (s RechunkStats) String() string {
+	b := func(n int64) string { return humanize.IBytes(uint64(n)) }
+	delta := s.After.UniqueBytes - s.Before.UniqueBytes
+	sign := "+"
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+
+	return fmt.Sprintf("%s\nbefore: %d chunks, %s (dedup %.2fx)\nafter:  %d chunks, %s (dedup %.2fx)\ndelta:  %s%s",
+		s.RewriteStats,
+		s.Before.Chunks, b(s.Before.UniqueBytes), s.Before.DedupRatio,
+		s.After.Chunks, b(s.After.UniqueBytes), s.After.DedupRatio,
+		sign, b(delta))
+}
+
+//Rechunk re-splits every file that is stored as a pointer in the history of
+//the selected refs using the current chunking configuration, such that files
+//deduplicate against each other again after the chunking changed. Chunks are
+//fetched as needed and pointer blobs are replaced by rewriting history, see
+//RewriteHistory. The unique chunk bytes of the history are reported from
+//before and after, chunks that are no longer referenced are left for gc
+func (repo *Repository) Rechunk(store *bolt.DB, opts RechunkOpts) (stats RechunkStats, err error) {
+	stats.Before, err = repo.Stats(store, StatsOpts{Revs: opts.Refs})
+	if err != nil {
+		return stats, fmt.Errorf("failed to gather stats before re-chunking: %v", err)
+	}
+
+	stats.RewriteStats, err = repo.RewriteHistory(RewriteOpts{
+		Refs:  opts.Refs,
+		Force: opts.Force,
+		Blob: func(path string, size int64, r io.Reader, w io.Writer) (bool, error) {
+			return repo.resplitBlob(repo, size, r, w)
+		},
+	})
+
+	if err != nil {
+		return stats, err
+	}
+
+	err = repo.SaveChunkRecords(store)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.After, err = repo.Stats(store, StatsOpts{Revs: opts.Refs})
+	if err != nil {
+		return stats, fmt.Errorf("failed to gather stats after re-chunking: %v", err)
+	}
+
+	return stats, nil
+}
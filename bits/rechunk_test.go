@@ -0,0 +1,109 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestRechunk(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunker":        "fixed",
+		"bits.chunk-min-size": "512KiB",
+		"bits.chunk-avg-size": "512KiB",
+		"bits.chunk-max-size": "512KiB",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//fixed size chunks don't deduplicate content that shifted
+	a := make([]byte, 2*1024*1024)
+	_, err = rand.Read(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{"a.bin": a, "b.bin": append([]byte("shifted"), a...)}
+	for name, content := range files {
+		pointer := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), pointer)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(wd1, name), pointer.Bytes(), 0666)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunker":        "fastcdc",
+		"bits.chunk-min-size": "16KiB",
+		"bits.chunk-avg-size": "64KiB",
+		"bits.chunk-max-size": "256KiB",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	stats, err := repo1.Rechunk(store1, bits.RechunkOpts{Refs: []string{"--branches"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats.BlobMap) != 2 || stats.Before.LogicalBytes != stats.After.LogicalBytes {
+		t.Errorf("expected both pointers to be rewritten, got: %s", stats)
+	}
+
+	if stats.After.UniqueBytes >= stats.Before.UniqueBytes || stats.After.DedupRatio < 1.5 {
+		t.Errorf("expected re-chunking to deduplicate shifted content, got: %s", stats)
+	}
+
+	for name, content := range files {
+		pointer, err := ioutil.ReadFile(filepath.Join(wd1, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		combined := bytes.NewBuffer(nil)
+		err = repo1.Combine(bytes.NewReader(pointer), combined)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(combined.Bytes(), content) {
+			t.Errorf("expected '%s' to combine into its original content", name)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/boltdb/bolt"
+)
+
+//RekeyOpts configures Rekey
+type RekeyOpts struct {
+
+	//fast-export arguments that select the refs to rewrite, e.g "--branches"
+	Refs []string
+
+	//secret that keyed the chunks of the existing pointers, nil if that is
+	//the secret that is currently configured
+	OldHashKey []byte
+
+	//rewrite even if the working tree has uncommitted changes
+	Force bool
+
+	//push the new chunks and delete the old chunks from the remote that no
+	//ref references anymore, locally or on any git remote
+	DeleteOld bool
+}
+
+//RekeyStats describes what Rekey did
+type RekeyStats struct {
+	RewriteStats
+
+	//chunks that the original history referenced but the rewritten history
+	//doesn't, other refs or clones may still reference them
+	Unreferenced int
+
+	//new chunks that were pushed and old chunks that were deleted from the
+	//remote, only when deleting old chunks
+	Pushed  int
+	Deleted int
+}
+
+//String formats the stats as a human readable report
+func (s RekeyStats) String() string {
+	str := fmt.Sprintf("%s, %d old chunk(s) are no longer referenced by the rewritten refs", s.RewriteStats, s.Unreferenced)
+	if s.Pushed > 0 || s.Deleted > 0 {
+		str += fmt.Sprintf("\npushed %d new chunk(s) and deleted %d old chunk(s) from the remote", s.Pushed, s.Deleted)
+	}
+
+	return str
+}
+
+//Rekey re-splits every file that is stored as a pointer in the history of the
+//selected refs using the current configuration, such that its chunks are keyed
+//and encrypted anew, e.g after a hash secret leaked or to move to keyed hashing.
+//Chunks are fetched as needed and pointer blobs are replaced by rewriting
+//history, see RewriteHistory. Old chunks that the rewritten refs no longer
+//reference are written to 'w'. They are only deleted from the remote when the
+//options ask for it, and only after the new chunks are pushed: old chunks that
+//other refs, locally or on a git remote, still reference are kept
+func (repo *Repository) Rekey(store *bolt.DB, opts RekeyOpts, w io.Writer) (stats RekeyStats, err error) {
+	var deleter ChunkDeleter
+	var remotes []string
+	if opts.DeleteOld {
+		if repo.remote == nil {
+			return stats, fmt.Errorf("no remote configured to delete old chunks from")
+		}
+
+		var ok bool
+		deleter, ok = repo.remote.(ChunkDeleter)
+		if !ok {
+			return stats, fmt.Errorf("the configured remote doesn't support deleting chunks")
+		}
+
+		//refuse before rewriting if the refs of git remotes can't be scanned
+		remotes, err = repo.gitRemotes()
+		if err == nil {
+			_, _, err = repo.remoteRevs(remotes)
+		}
+
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	//existing pointers are combined with the old secret
+	src := repo
+	if opts.OldHashKey != nil {
+		src, err = NewRepository(repo.rootDir, repo.output)
+		if err != nil {
+			return stats, fmt.Errorf("failed to setup repository for reading with the old secret: %v", err)
+		}
+
+		src.hashKey = opts.OldHashKey
+		src.remote = repo.remote
+	}
+
+	old := map[K]struct{}{}
+	err = src.forEachReferencedChunk(opts.Refs, src.remote, func(ptr *Pointer, k K, depth int, length int64) error {
+		old[k] = struct{}{}
+		return nil
+	})
+
+	if err != nil {
+		return stats, err
+	}
+
+	stats.RewriteStats, err = repo.RewriteHistory(RewriteOpts{
+		Refs:  opts.Refs,
+		Force: opts.Force,
+		Blob: func(path string, size int64, r io.Reader, w io.Writer) (bool, error) {
+			return repo.resplitBlob(src, size, r, w)
+		},
+	})
+
+	if err == nil {
+		err = src.SaveChunkRecords(store)
+	}
+
+	if err == nil {
+		err = repo.SaveChunkRecords(store)
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	//the new chunks were just stored locally, nothing is fetched
+	fresh := map[K]struct{}{}
+	err = repo.forEachReferencedChunk(opts.Refs, repo.remote, func(ptr *Pointer, k K, depth int, length int64) error {
+		fresh[k] = struct{}{}
+		delete(old, k)
+		return nil
+	})
+
+	if err != nil {
+		return stats, err
+	}
+
+	for k := range old {
+		stats.Unreferenced++
+		fmt.Fprintf(w, "%x\n", k)
+	}
+
+	if !opts.DeleteOld || len(old) == 0 {
+		return stats, nil
+	}
+
+	stats.Pushed, stats.Deleted, err = repo.deleteRekeyed(store, deleter, remotes, fresh, old)
+	if err != nil {
+		return stats, fmt.Errorf("history was re-keyed but old chunks were not deleted: %v", err)
+	}
+
+	return stats, nil
+}
+
+//deleteRekeyed pushes the chunks 'fresh' that the remote doesn't store yet and
+//then deletes the chunks 'old' that it stores, except for those that are still
+//referenced by the refs or index of the repository or by the refs of any of the
+//git remotes 'remotes'. The reflog is not considered as it still references the
+//history from before the rewrite
+func (repo *Repository) deleteRekeyed(store *bolt.DB, deleter ChunkDeleter, remotes []string, fresh, old map[K]struct{}) (pushed, deleted int, err error) {
+	listed := map[K]struct{}{}
+	err = deleter.ListChunkInfo(func(ci ChunkInfo) error {
+		listed[ci.K] = struct{}{}
+		return nil
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list remote chunks: %v", err)
+	}
+
+	for k := range fresh {
+		if _, ok := listed[k]; ok {
+			continue
+		}
+
+		_, err = repo.pushChunk(store, k, DefaultRemoteName)
+		if err != nil {
+			return pushed, 0, err
+		}
+
+		pushed++
+	}
+
+	_, revs, err := repo.remoteRevs(remotes)
+	if err != nil {
+		return pushed, 0, err
+	}
+
+	live, err := repo.liveSet(append([]string{"--all", "--indexed-objects"}, revs...))
+	if err != nil {
+		return pushed, 0, err
+	}
+
+	for k := range old {
+		_, stored := listed[k]
+		if _, ok := live[k]; ok || !stored {
+			continue
+		}
+
+		err = repo.deleteRemoteChunk(store, deleter, k)
+		if err != nil {
+			return pushed, deleted, err
+		}
+
+		deleted++
+	}
+
+	return pushed, deleted, nil
+}
+
+//resplitBlob combines the pointer blob of 'size' bytes read from 'r' using
+//repository 'src' and splits the result again, the new pointer is written to
+//'w'. It returns false if the blob is not a pointer
+func (repo *Repository) resplitBlob(src *Repository, size int64, r io.Reader, w io.Writer) (rewritten bool, err error) {
+	if size == 0 || size%int64(LineWidth+1) != 0 {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+
+	if !IsPointer(data) {
+		return false, nil
+	}
+
+	err = src.Fetch(bytes.NewReader(data), ioutil.Discard)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch chunks: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.Combine(bytes.NewReader(data), pw))
+	}()
+
+	defer pr.Close()
+	err = repo.Split(pr, w)
+	if err != nil {
+		return false, fmt.Errorf("failed to split combined file: %v", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,251 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestRekey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{"bits.hash-secret": "leaked"})
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	chunks := newMemRemote()
+	repo1.SetRemote(chunks)
+
+	content := make([]byte, 3*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Push(store1, bytes.NewReader(pointer.Bytes()), "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"a.bin", "b.txt"} {
+		data := pointer.Bytes()
+		if name == "b.txt" {
+			data = []byte("not a pointer\n")
+		}
+
+		err = ioutil.WriteFile(filepath.Join(wd1, name), data, 0666)
+		if err == nil {
+			err = repo1.Git(ctx, nil, nil, "add", "-A")
+		}
+
+		if err == nil {
+			err = repo1.Git(ctx, nil, nil, "commit", "-m", "c"+string('0'+rune(i)))
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//local chunks are gone, re-keying fetches them
+	for k := range chunks.chunks {
+		p, _ := repo1.Path(k, false)
+		os.Remove(p)
+	}
+
+	store1.Close()
+	GitConfigure(t, ctx, repo1, map[string]string{"bits.hash-secret": "rotated"})
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store1, err = repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1.SetRemote(chunks)
+	oldKeys := map[bits.K][]byte{}
+	for k, data := range chunks.chunks {
+		oldKeys[k] = data
+	}
+
+	_, err = repo1.Rekey(store1, bits.RekeyOpts{Refs: []string{"--branches"}}, ioutil.Discard)
+	if err == nil {
+		t.Errorf("expected re-keying without the old secret to fail")
+	}
+
+	stats, err := repo1.Rekey(store1, bits.RekeyOpts{Refs: []string{"--branches"}, OldHashKey: []byte("leaked")}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats.BlobMap) != 1 || len(stats.CommitMap) != 2 || stats.Unreferenced != len(oldKeys) {
+		t.Errorf("expected one pointer blob in two commits to be rewritten and old chunks to be reported, got: %s", stats)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(stats.MapDir, "blob-map"))
+	if err != nil || !strings.Contains(string(data), " ") || len(strings.Split(strings.TrimSpace(string(data)), "\n")) != 2 {
+		t.Errorf("expected the blob map to be written, got: %s, %v", data, err)
+	}
+
+	//the checkout holds the new pointer, which combines with the new secret
+	rekeyed, err := ioutil.ReadFile(filepath.Join(wd1, "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(rekeyed, pointer.Bytes()) {
+		t.Fatalf("expected the pointer to be rewritten")
+	}
+
+	combined := bytes.NewBuffer(nil)
+	err = repo1.Combine(bytes.NewReader(rekeyed), combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Errorf("expected the rewritten pointer to combine into the original content")
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(rekeyed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range ptr.Keys {
+		if _, ok := oldKeys[k]; ok {
+			t.Errorf("expected the rewritten pointer to reference new chunks only, got: '%x'", k)
+		}
+	}
+
+	//other refs and clones may still reference the old chunks, they are
+	//left to garbage collection of the remote
+	for k := range oldKeys {
+		if _, ok := chunks.chunks[k]; !ok {
+			t.Errorf("expected old chunk '%x' to be kept on the remote", k)
+		}
+	}
+
+	log := bytes.NewBuffer(nil)
+	err = repo1.Git(ctx, nil, log, "log", "--format=%s", "--name-only")
+	if err != nil || !strings.Contains(log.String(), "b.txt") || !strings.Contains(log.String(), "c0") {
+		t.Errorf("expected history to be kept otherwise, got: %s, %v", log.String(), err)
+	}
+
+	err = repo1.Push(store1, bytes.NewReader(rekeyed), "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//re-keys with a new secret and deletes old chunks, it returns the keys of
+	//the chunks before and after
+	rekeyDeleteOld := func(oldSecret, newSecret string) (stats bits.RekeyStats, before, after []bits.K) {
+		before = readKeys(t, filepath.Join(wd1, "a.bin"))
+		store1.Close()
+		GitConfigure(t, ctx, repo1, map[string]string{"bits.hash-secret": newSecret})
+		repo1, err = bits.NewRepository(wd1, nil)
+		if err == nil {
+			store1, err = repo1.LocalStore()
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		repo1.SetRemote(chunks)
+		stats, err = repo1.Rekey(store1, bits.RekeyOpts{Refs: []string{"--branches"}, OldHashKey: []byte(oldSecret), DeleteOld: true}, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return stats, before, readKeys(t, filepath.Join(wd1, "a.bin"))
+	}
+
+	//no git remote references the old chunks, so they are deleted once the
+	//new chunks are pushed
+	stats, before, after := rekeyDeleteOld("rotated", "rotated2")
+	if stats.Deleted != len(before) || stats.Pushed != len(after) {
+		t.Errorf("expected new chunks to be pushed and old chunks to be deleted, got: %s", stats)
+	}
+
+	for _, k := range before {
+		if _, ok := chunks.chunks[k]; ok {
+			t.Errorf("expected old chunk '%x' to be deleted from the remote", k)
+		}
+	}
+
+	for _, k := range after {
+		if _, ok := chunks.chunks[k]; !ok {
+			t.Errorf("expected new chunk '%x' to be pushed", k)
+		}
+	}
+
+	for k := range oldKeys {
+		if _, ok := chunks.chunks[k]; !ok {
+			t.Errorf("expected chunk '%x' that wasn't re-keyed now to be kept", k)
+		}
+	}
+
+	//old chunks that refs on a git remote reference are kept
+	err = repo1.Git(ctx, nil, nil, "push", "--no-verify", "origin", "HEAD:master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, before, _ = rekeyDeleteOld("rotated2", "rotated3")
+	if stats.Unreferenced != len(before) || stats.Deleted != 0 {
+		t.Errorf("expected old chunks referenced by the git remote to be kept, got: %s", stats)
+	}
+
+	for _, k := range before {
+		if _, ok := chunks.chunks[k]; !ok {
+			t.Errorf("expected old chunk '%x' to be kept on the remote", k)
+		}
+	}
+
+	store1.Close()
+}
+
+//readKeys returns the keys of the pointer in file 'p'
+func readKeys(t *testing.T, p string) (keys []bits.K) {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	ptr, err := bits.ReadPointer(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ptr.Keys
+}
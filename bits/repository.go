@@ -6,9 +6,11 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -22,12 +24,8 @@ import (
 	"github.com/VividCortex/ewma"
 	"github.com/boltdb/bolt"
 	"github.com/dustin/go-humanize"
-	"github.com/restic/chunker"
 )
 
-//RemoteChunk indicates a certain chunk is know but stored remotely
-var RemoteChunk = []byte{}
-
 var (
 	ErrAlreadyPushed = fmt.Errorf("chunk is already pushed to the remote")
 )
@@ -36,13 +34,30 @@ var (
 	//ChunkBufferSize determines the size of the buffer that wil hold each chunk
 	ChunkBufferSize = 8 * 1024 * 1024 //8MiB
 
+	//DefaultRemoteName is the name of the remote chunk store that is configured
+	//through the 'bits.aws-*' keys, chunks that are pushed are recorded under it
+	DefaultRemoteName = "origin"
+
 	//RemoteBranchSuffix identifies the specialty branches used for persisting remote information
 	RemoteBranchSuffix = "bits-remote"
+
+	//LocalStoreTimeout is how long opening the local store waits for other
+	//processes that have it open, e.g while checking out many files
+	LocalStoreTimeout = 10 * time.Second
 )
 
+//headPool holds the buffers that Split reads the head of files into, they
+//are as large as the minimum file size which makes them costly to allocate
+var headPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
 var (
-	//IndexBucket holds remotely whether chunks are stored remotely
+	//IndexBucket held which chunks are stored remotely, up to schema version
+	//1 of the local store. It is migrated into chunk records
 	IndexBucket = []byte("index")
+
+	//AccessBucket held when each local chunk was last accessed, up to schema
+	//version 1 of the local store. It is migrated into chunk records
+	AccessBucket = []byte("access")
 )
 
 //Repository provides an abstraction on top of a Git repository for a
@@ -54,30 +69,47 @@ type Repository struct {
 	//Path to the Git database directory (.git)
 	gitDir string
 
+	//Path to the Git directory that is shared by all worktrees, it is
+	//equal to the git directory unless this is a linked worktree
+	commonDir string
+
 	//Path to the local chunk storage
 	chunkDir string
 
+	//Paths to read-only chunk directories that are consulted for chunks
+	//that are not stored locally, before fetching from the remote
+	alternates []string
+
 	//Path to the root of the root of the git projet
 	rootDir string
 
 	//stderr from executions will be written here
 	output io.Writer
 
-	//Header key allows us to recognize the start of a key listing
-	header []byte
-
-	//Footer Key allows us to recognize the end of a key listing
-	footer []byte
-
 	//remotes hold the remote chunk store we're using
 	remote Remote
 
+	//remote chunk stores that are addressed by name, they are setup from
+	//configuration as they are first used
+	remotes map[string]Remote
+
 	//bits specific configuration
 	conf *Conf
 
+	//whether the configured deduplication scope was compared with the
+	//committed scope, which is only done once
+	scopeChecked sync.Once
+
+	//secret that keys chunk hashes, empty if chunks are not keyed
+	hashKey []byte
+
 	//this channel receives any chunk Key that is hanled in an any operation
 	keyProgressCh chan KeyOp
 
+	//what was learned about chunks since chunk records were last saved
+	pendingMu sync.Mutex
+	pending   map[K]*chunkUpdate
+
 	//is called when a chunk was handled in any operation, can be called
 	//concurrently
 	KeyProgressFn func(KeyOp, float64)
@@ -87,7 +119,7 @@ type Repository struct {
 //provided directory. It will fail if the get executable is not in
 //the shells PATH or if the directory doesnt seem to be a Git repository
 func NewRepository(dir string, output io.Writer) (repo *Repository, err error) {
-	repo = &Repository{}
+	repo = &Repository{pending: map[K]*chunkUpdate{}, remotes: map[string]Remote{}}
 	repo.exe, err = exec.LookPath("git")
 	if err != nil {
 		return nil, fmt.Errorf("git executable couldn't be found in your PATH: %v, make sure git it installed", err)
@@ -103,45 +135,64 @@ func NewRepository(dir string, output io.Writer) (repo *Repository, err error) {
 	}
 
 	//we store the git directory seperately
-	buf = bytes.NewBuffer(nil)
-	err = repo.Git(nil, nil, buf, "rev-parse", "--git-dir")
-	repo.gitDir = filepath.Join(repo.rootDir, strings.TrimSpace(buf.String()))
+	repo.gitDir, err = repo.gitPath("--git-dir")
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get git directory, are you in a git repository?")
 	}
 
+	//linked worktrees have their own git directory, chunks and the index
+	//are stored in the directory they share with the main worktree
+	repo.commonDir, err = repo.gitPath("--git-common-dir")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get common git directory: %v", err)
+	}
+
 	//make sure command output is visible
 	repo.output = output
 	if repo.output == nil {
 		repo.output = os.Stderr
 	}
 
-	//for now, store chunks in the .git directory
-	repo.chunkDir = filepath.Join(repo.gitDir, "chunks")
+	//setup configuration
+	repo.conf = DefaultConf()
+	err = repo.conf.OverwriteFromGit(repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bits configuration from git: %v", err)
+	}
+
+	//chunks are stored in the .git directory unless configured otherwise,
+	//relative paths are resolved against the root of the repository
+	repo.chunkDir = filepath.Join(repo.commonDir, "chunks")
+	if repo.conf.ChunkDir != "" {
+		repo.chunkDir = repo.conf.ChunkDir
+		if !filepath.IsAbs(repo.chunkDir) {
+			repo.chunkDir = filepath.Join(repo.rootDir, repo.chunkDir)
+		}
+	}
+
 	err = os.MkdirAll(repo.chunkDir, 0777)
 	if err != nil {
 		return nil, fmt.Errorf("couldnt setup chunk directory at '%s': %v", repo.chunkDir, err)
 	}
 
-	//setup header and footers
-	repo.header = []byte("--- to use this file decode it with the 'git-bits' extension ---\n")
-	repo.footer = []byte("----------------------- end of chunks --------------------------\n")
-	if len(repo.header) != (hex.EncodedLen(KeySize)+1) || len(repo.footer) != (hex.EncodedLen(KeySize)+1) {
-		return nil, fmt.Errorf("repository header and footer size are not '%d': header: %d, footer: %d", hex.EncodedLen(KeySize)+1, len(repo.header), len(repo.footer))
+	for _, dir := range repo.conf.Alternates {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(repo.rootDir, dir)
+		}
+
+		repo.alternates = append(repo.alternates, dir)
 	}
 
-	//setup configuration
-	repo.conf = DefaultConf()
-	err = repo.conf.OverwriteFromGit(repo)
+	repo.hashKey, err = repo.conf.HashKey(repo.rootDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load bits configuration from git: %v", err)
+		return nil, fmt.Errorf("failed to load hash secret: %v", err)
 	}
 
 	//if a bucket is configured we will attempt to configured
 	if repo.conf.AWSS3BucketName != "" {
 		repo.remote, err = NewS3Remote(
 			repo,
-			"origin",
+			DefaultRemoteName,
 			repo.conf.AWSS3BucketName,
 			repo.conf.AWSAccessKeyID,
 			repo.conf.AWSSecretAccessKey,
@@ -199,6 +250,69 @@ func NewRepository(dir string, output io.Writer) (repo *Repository, err error) {
 	return repo, nil
 }
 
+//gitPath asks rev-parse for a path using option 'opt' (e.g --git-dir), relative
+//paths are resolved against the root of the repository
+func (repo *Repository) gitPath(opt string, args ...string) (p string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, append([]string{"rev-parse", opt}, args...)...)
+	if err != nil {
+		return "", err
+	}
+
+	p = strings.TrimSpace(buf.String())
+	if p == "" || p == opt {
+		return "", fmt.Errorf("git doesn't support `rev-parse %s`, please upgrade", opt)
+	}
+
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(repo.rootDir, p)
+	}
+
+	return p, nil
+}
+
+//SetRemote replaces the remote chunk store that is configured through git
+func (repo *Repository) SetRemote(remote Remote) {
+	repo.remote = remote
+}
+
+//SetNamedRemote replaces the remote chunk store with name 'name' that is
+//configured through git
+func (repo *Repository) SetNamedRemote(name string, remote Remote) {
+	repo.remotes[name] = remote
+}
+
+//NamedRemote returns the remote chunk store with name 'name' as configured
+//through the 'bits-remote.<name>' keys, the default remote chunk store can be
+//addressed as DefaultRemoteName unless a remote with that name is configured
+func (repo *Repository) NamedRemote(name string) (remote Remote, err error) {
+	if remote, ok := repo.remotes[name]; ok {
+		return remote, nil
+	}
+
+	rconf, ok := repo.conf.Remotes[name]
+	if !ok || rconf.AWSS3BucketName == "" {
+		if name == DefaultRemoteName && repo.remote != nil {
+			return repo.remote, nil
+		}
+
+		return nil, fmt.Errorf("no remote chunk store named '%s' is configured, set '%s%s.aws-s3-bucket-name'", name, RemoteConfPrefix, name)
+	}
+
+	accessKey, secretKey := rconf.AWSAccessKeyID, rconf.AWSSecretAccessKey
+	if accessKey == "" && secretKey == "" {
+		accessKey, secretKey = repo.conf.AWSAccessKeyID, repo.conf.AWSSecretAccessKey
+	}
+
+	remote, err = NewS3Remote(repo, name, rconf.AWSS3BucketName, accessKey, secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to setup chunk remote '%s': %v", name, err)
+	}
+
+	repo.remotes[name] = remote
+	return remote, nil
+}
+
 //Git runs the git executable with the working directory set to the repository director
 func (repo *Repository) Git(ctx context.Context, in io.Reader, out io.Writer, args ...string) (err error) {
 	if ctx == nil {
@@ -228,7 +342,7 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 
 	//configure filter
 	gconf := map[string]string{
-		"filter.bits.clean":    "git bits split",
+		"filter.bits.clean":    "git bits split %f",
 		"filter.bits.smudge":   "git bits fetch | git bits combine",
 		"filter.bits.required": "true",
 	}
@@ -247,17 +361,29 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 			gconf["bits.aws-secret-access-key"] = conf.AWSSecretAccessKey
 		}
 
-		if conf.DeduplicationScope != 0 {
-			gconf["bits.deduplication-scope"] = strconv.FormatUint(conf.DeduplicationScope, 10)
+		if conf.HashSecret != "" {
+			gconf["bits.hash-secret"] = conf.HashSecret
+		}
+
+		if conf.HashSecretFile != "" {
+			gconf["bits.hash-secret-file"] = conf.HashSecretFile
+		}
+
+		if conf.Compression != "" {
+			gconf["bits.compression"] = conf.Compression
 		}
 
 		repo.conf = conf
+		repo.hashKey, err = repo.conf.HashKey(repo.rootDir)
+		if err != nil {
+			return fmt.Errorf("failed to load hash secret: %v", err)
+		}
 
 		//@TODO init can complete remote configuration
 		//@TODO obvious code duplication with constructor
 		repo.remote, err = NewS3Remote(
 			repo,
-			"origin",
+			DefaultRemoteName,
 			repo.conf.AWSS3BucketName,
 			repo.conf.AWSAccessKeyID,
 			repo.conf.AWSSecretAccessKey,
@@ -276,8 +402,35 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 		}
 	}
 
-	//write hook if doesnt exist yet
-	hookp := filepath.Join(repo.gitDir, "hooks", "pre-push")
+	//a non-default scope is written to the shared configuration such that
+	//it can be committed, a locally configured scope would overwrite it
+	if conf != nil && conf.DeduplicationScope != 0 && conf.DeduplicationScope != DefaultConf().DeduplicationScope {
+		err = ValidateScope(conf.DeduplicationScope)
+		if err != nil {
+			return err
+		}
+
+		err = repo.Git(ctx, nil, nil, "config", "-f", SharedConfFile, "bits.deduplication-scope", strconv.FormatUint(conf.DeduplicationScope, 10))
+		if err != nil {
+			return fmt.Errorf("failed to write shared configuration: %v", err)
+		}
+
+		repo.Git(ctx, nil, nil, "config", "--local", "--unset", "bits.deduplication-scope")
+		fmt.Fprintf(repo.output, "deduplication scope is written to '%s', commit it to share the scope with everyone using this repository\n", SharedConfFile)
+	}
+
+	//write hook if doesnt exist yet, git resolves the hooks directory
+	//such that it is shared by all worktrees and honours core.hooksPath
+	hookp, err := repo.gitPath("--git-path", "hooks/pre-push")
+	if err != nil {
+		return fmt.Errorf("failed to locate hooks directory: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(hookp), 0777)
+	if err != nil {
+		return fmt.Errorf("couldnt setup hooks directory: %v", err)
+	}
+
 	f, err := os.OpenFile(hookp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0777)
 	if err != nil {
 		if os.IsExist(err) {
@@ -306,43 +459,17 @@ func (repo *Repository) Install(w io.Writer, conf *Conf) (err error) {
 }
 
 //ForEach is a convenient method for running logic for each chunk
-//key in stream 'r', it will skip the chunk header and footer
+//key in stream 'r', it will skip the chunk header, footer and attributes
 func (repo *Repository) ForEach(r io.Reader, fn func(K) error) error {
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-
-		//and in any case skip it
-		if bytes.Equal(s.Bytes(), repo.header[:len(repo.header)-1]) ||
-			bytes.Equal(s.Bytes(), repo.footer[:len(repo.footer)-1]) {
-			continue
-		}
-
-		//decode the actual keys
-		data := make([]byte, hex.DecodedLen(len(s.Bytes())))
-		_, err := hex.Decode(data, s.Bytes())
-		if err != nil {
-			return fmt.Errorf("failed to decode '%x' as hex: %v", s.Bytes(), err)
-		}
-
-		//check key length
-		k := K{}
-		if len(k) != len(data) {
-			return fmt.Errorf("decoded chunk key '%x' has an invalid length %d, expected %d", data, len(data), len(k))
-		}
-
-		//fill K and hand it over
-		copy(k[:], data[:KeySize])
-		err = fn(k)
-		if err != nil {
-			return fmt.Errorf("failed to handle key '%x': %v", k, err)
-		}
-	}
-
-	if err := s.Err(); err != nil {
-		return fmt.Errorf("failed to scan chunk keys: %v", err)
-	}
+	return repo.ForEachWithAttrs(r, nil, fn)
+}
 
-	return nil
+//ForEachWithAttrs works like ForEach but calls 'afn' for each pointer
+//attribute it encounters, attributes that describe the chunks are
+//written before the keys they apply to. If 'afn' is nil, attributes
+//are skipped. It fails for pointers with an unsupported format version
+func (repo *Repository) ForEachWithAttrs(r io.Reader, afn func(name, val string) error, fn func(K) error) error {
+	return forEachLine(r, nil, afn, fn)
 }
 
 //Push takes a list of chunk keys on reader 'r' and moves each chunk from
@@ -353,68 +480,79 @@ func (repo *Repository) Push(store *bolt.DB, r io.Reader, remoteName string) (er
 		return fmt.Errorf("unable to push, no remote configured")
 	}
 
-	//err handling
-	errs := []string{}
-	errCh := make(chan error)
-	defer close(errCh)
+	//which chunks the remote stores is rebuilt from the listing, such that
+	//chunks that were removed from it (e.g by garbage collection) are pushed
+	//again. The records are only updated once the listing completes
+	pr, pw := io.Pipe()
 	go func() {
-		for err := range errCh {
-			errs = append(errs, fmt.Sprintf("%v", err))
-		}
+		pw.CloseWithError(repo.remote.ListChunks(pw))
 	}()
 
-	//ask the remote to fetch all chunk keys
-	pr, pw := io.Pipe()
-	go func() {
-		err = repo.remote.ListChunks(pw)
-		defer pw.Close()
+	listed := map[K]struct{}{}
+	err = repo.ForEach(pr, func(k K) error {
+		listed[k] = struct{}{}
+		return nil
+	})
+
+	if err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("failed to list remote chunk keys: %v", err)
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		unlisted := []K{}
+		err := ForEachChunkRecord(tx, func(k K, rec *ChunkRecord) error {
+			if _, ok := listed[k]; !ok && rec.HasRemote(remoteName) {
+				unlisted = append(unlisted, k)
+			}
+
+			return nil
+		})
+
 		if err != nil {
-			errCh <- fmt.Errorf("failed to list remote chunk keys: %v", err)
+			return err
 		}
-	}()
 
-	//stream remote keys 500 at a time and write to local index concurrently
-	//allowing some to be oppertunisticly combined to increase performance
-	var wg sync.WaitGroup
-	repo.ForEach(pr, func(k K) error {
-		go func() {
-			err = store.Batch(func(tx *bolt.Tx) error {
-				wg.Add(1)
-				defer wg.Done()
-				b := tx.Bucket(IndexBucket)
-				err = b.Put(k[:], RemoteChunk)
-				if err != nil {
-					return fmt.Errorf("failed to put '%x': %v", k, err)
-				}
+		for _, k := range unlisted {
+			err = updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+				rec.SetRemote(remoteName, false)
+				return len(rec.Remotes) > 0 || repo.isLocal(k)
+			})
 
-				repo.keyProgressCh <- KeyOp{IndexOp, k, false, 0}
-				return nil
+			if err != nil {
+				return err
+			}
+		}
+
+		for k := range listed {
+			err = updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+				rec.SetRemote(remoteName, true)
+				return true
 			})
 
 			if err != nil {
-				errCh <- fmt.Errorf("failed to batch indexed remote keys: %v", err)
+				return fmt.Errorf("failed to put '%x': %v", k, err)
 			}
-		}()
+
+			repo.keyProgressCh <- KeyOp{IndexOp, k, false, 0}
+		}
 
 		return nil
 	})
 
-	//wait for all concurrent batch transactions to complete
-	wg.Wait()
-	if len(errs) > 0 {
-		return fmt.Errorf("there were errors while indexing: \n %s", strings.Join(errs, "\n\t"))
+	if err != nil {
+		return fmt.Errorf("failed to index remote chunk keys: %v", err)
 	}
 
 	//scan for chunk keys
 	err = repo.ForEach(r, func(k K) (ferr error) {
 		err = store.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket(IndexBucket)
-			c := b.Get(k[:])
-			if c == nil {
-				return nil //doesnt exist
+			rec, err := GetChunkRecord(tx, k)
+			if err != nil {
+				return err
 			}
 
-			if bytes.Equal(c, RemoteChunk) {
+			if rec != nil && rec.HasRemote(remoteName) {
 				return ErrAlreadyPushed
 			}
 
@@ -431,25 +569,9 @@ func (repo *Repository) Push(store *bolt.DB, r io.Reader, remoteName string) (er
 			return fmt.Errorf("failed to read index: %v", err)
 		}
 
-		//open local chunk file
-		p, _ := repo.Path(k, false)
-		f, err := os.OpenFile(p, os.O_RDONLY, 0666)
-		if err != nil {
-			return fmt.Errorf("failed to open chunk '%x' at '%s' for pushing: %v", k, p, err)
-		}
-
-		//get remote writer
-		defer f.Close()
-		wc, err := repo.remote.ChunkWriter(k)
-		if err != nil {
-			return fmt.Errorf("failed to get chunk writer: %v", err)
-		}
-
-		//start upload
-		defer wc.Close()
-		n, err := io.Copy(wc, f)
+		n, err := repo.pushChunk(store, k, remoteName)
 		if err != nil {
-			return fmt.Errorf("failed to copy file '%s' to remote writer after %d bytes: %v", f.Name(), n, err)
+			return err
 		}
 
 		//indicate we pushed the chunk
@@ -464,53 +586,227 @@ func (repo *Repository) Push(store *bolt.DB, r io.Reader, remoteName string) (er
 	return nil
 }
 
+//pushChunk uploads the local chunk with key 'k' to the remote chunk store and
+//records that remote 'remoteName' stores it, it returns the uploaded size
+func (repo *Repository) pushChunk(store *bolt.DB, k K, remoteName string) (n int64, err error) {
+	//open local chunk file, which may be stored in an alternate
+	p, ok := repo.lookup(k)
+	if !ok {
+		p, _ = repo.Path(k, false)
+	}
+
+	f, err := os.OpenFile(p, os.O_RDONLY, 0666)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open chunk '%x' at '%s' for pushing: %v", k, p, err)
+	}
+
+	//get remote writer
+	defer f.Close()
+	wc, err := repo.remote.ChunkWriter(k)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get chunk writer: %v", err)
+	}
+
+	//start upload
+	n, err = io.Copy(wc, f)
+	if err != nil {
+		wc.Close()
+		return 0, fmt.Errorf("failed to copy file '%s' to remote writer after %d bytes: %v", f.Name(), n, err)
+	}
+
+	//the upload only completes when the writer is closed
+	err = wc.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to complete upload of chunk '%x': %v", k, err)
+	}
+
+	//remember that the chunk is stored remotely
+	err = store.Update(func(tx *bolt.Tx) error {
+		return updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+			rec.SetRemote(remoteName, true)
+			if rec.CipherSize == 0 {
+				rec.CipherSize = n
+			}
+
+			return true
+		})
+	})
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to index pushed chunk '%x': %v", k, err)
+	}
+
+	return n, nil
+}
+
 //Fetch takes a list of chunk keys on reader 'r' and will try to fetch chunks
 //that are not yet stored locally. Chunks that are already stored locally should
-//result in a no-op, all keys (fetched or not) will be written to 'w'.
+//result in a no-op, all keys (fetched or not) will be written to 'w'. Pointer
+//headers and attributes are written as well such that 'w' can be combined. Keys
+//that refer to manifest nodes cause all nodes and chunks below them to be fetched
 func (repo *Repository) Fetch(r io.Reader, w io.Writer) (err error) {
+
+	//files that were not split (e.g because they are small) pass through
+	bufr := bufio.NewReader(r)
+	if hdr, _ := bufr.Peek(LineWidth + 1); !HoldsKeys(hdr) {
+		_, err = io.Copy(w, bufr)
+		if err != nil {
+			return fmt.Errorf("failed to copy unsplit file content: %v", err)
+		}
+
+		return nil
+	}
+
+	r = bufr
 	printk := func(k K) error {
 		_, err := fmt.Fprintf(w, "%x\n", k)
 		return err
 	}
 
-	return repo.ForEach(r, func(k K) error {
+	pointer := false
+	ptr := NewPointer()
+	printh := func(v int) error {
+		pointer = true
+		ptr = NewPointer()
+		_, err := w.Write(Header(v))
+		return err
+	}
 
-		//setup chunk path
-		p, err := repo.Path(k, true)
+	printa := func(name, val string) error {
+		err := ptr.SetAttr(name, val)
 		if err != nil {
-			return fmt.Errorf("failed to create chunk path for key '%x': %v", k, err)
+			return err
 		}
 
-		//attempt to open, if its already assume it was written concurrently
-		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		line, err := FormatAttr(name, val)
 		if err != nil {
-			if os.IsExist(err) {
-				repo.keyProgressCh <- KeyOp{FetchOp, k, true, 0}
-				return printk(k)
+			return err
+		}
+
+		_, err = w.Write(line)
+		return err
+	}
+
+	err = forEachLine(r, printh, printa, func(k K) error {
+		if ptr.Manifest == 0 {
+			err := repo.fetchChunk(k)
+			if err != nil {
+				return err
 			}
 
-			return fmt.Errorf("failed to open chunk file '%s' for writing: %v", p, err)
+			return printk(k)
 		}
 
-		if repo.remote == nil {
-			return fmt.Errorf("key '%x' isn't stored locally, but no remote is configured", k)
-		}
+		//keys refer to manifest nodes, fetch the whole tree below them
+		err := repo.walkManifest(ptr, k, ptr.Manifest, -1, func(k K, depth int, length int64) error {
+			return repo.fetchChunk(k)
+		})
 
-		rc, err := repo.remote.ChunkReader(k)
 		if err != nil {
-			return fmt.Errorf("failed to get chunk reader for key '%x': %v", k, err)
+			return err
 		}
 
-		defer rc.Close()
-		n, err := io.Copy(f, rc)
+		return printk(k)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if pointer {
+		_, err = w.Write(Footer)
+	}
+
+	return err
+}
+
+//fetchChunk fetches the chunk with key 'k' from the remote unless it is
+//already stored locally or in an alternate chunk directory
+func (repo *Repository) fetchChunk(k K) (err error) {
+	return repo.fetchChunkFrom(repo.remote, k)
+}
+
+//fetchChunkFrom is like fetchChunk but fetches from remote chunk store 'remote'
+func (repo *Repository) fetchChunkFrom(remote Remote, k K) (err error) {
+	if _, ok := repo.lookup(k); ok {
+		repo.touch(k)
+		repo.keyProgressCh <- KeyOp{FetchOp, k, true, 0}
+		return nil
+	}
+
+	if remote == nil {
+		return fmt.Errorf("key '%x' isn't stored locally, but no remote is configured", k)
+	}
+
+	//setup chunk path
+	p, err := repo.Path(k, true)
+	if err != nil {
+		return fmt.Errorf("failed to create chunk path for key '%x': %v", k, err)
+	}
+
+	rc, err := remote.ChunkReader(k)
+	if err != nil {
+		return fmt.Errorf("failed to get chunk reader for key '%x': %v", k, err)
+	}
+
+	defer rc.Close()
+	n, err := writeChunkFile(p, func(w io.Writer) (int64, error) {
+		return io.Copy(w, rc)
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to clone chunk '%x' from remote: %v", k, err)
+	}
+
+	//indicate we fetched a key
+	repo.update(k, func(u *chunkUpdate) {
+		u.accessed = time.Now()
+		u.cipherSize = n
+		u.fetched = remote == repo.remote
+	})
+
+	repo.keyProgressCh <- KeyOp{FetchOp, k, false, n}
+	return nil
+}
+
+//writeChunkFile writes a chunk file at path 'p' using 'fn'. Content is written
+//to a temporary file that is moved into place once complete, such that other
+//processes never read a partially written chunk and a failed write leaves
+//nothing behind. Concurrent writers of the same chunk write the same content
+func writeChunkFile(p string, fn func(w io.Writer) (int64, error)) (n int64, err error) {
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary chunk file: %v", err)
+	}
+
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("failed to clone chunk '%x' from remote: %v", err)
+			f.Close()
+			os.Remove(f.Name())
 		}
+	}()
 
-		//indicate we fetched a key
-		repo.keyProgressCh <- KeyOp{FetchOp, k, false, n}
-		return printk(k)
-	})
+	n, err = fn(f)
+	if err != nil {
+		return n, err
+	}
+
+	err = f.Chmod(0644)
+	if err != nil {
+		return n, fmt.Errorf("failed to set chunk file permissions: %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return n, fmt.Errorf("failed to close temporary chunk file: %v", err)
+	}
+
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		return n, fmt.Errorf("failed to move chunk file into place: %v", err)
+	}
+
+	return n, nil
 }
 
 //Path returns the local path to the chunk file based on the key, it can
@@ -528,26 +824,47 @@ func (repo *Repository) Path(k K, mkdir bool) (p string, err error) {
 	return filepath.Join(dir, fmt.Sprintf("%x", k[2:])), nil
 }
 
+//isLocal returns whether the chunk with key 'k' is stored locally, chunks in
+//alternate chunk directories don't count
+func (repo *Repository) isLocal(k K) bool {
+	p, _ := repo.Path(k, false)
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+//lookup returns the path of the chunk with key 'k' if it is stored locally
+//or in one of the alternate chunk directories, which are consulted in order
+func (repo *Repository) lookup(k K) (p string, ok bool) {
+	for _, dir := range append([]string{repo.chunkDir}, repo.alternates...) {
+		p = filepath.Join(dir, fmt.Sprintf("%x", k[:2]), fmt.Sprintf("%x", k[2:]))
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+
+	return "", false
+}
+
 //LocalStore will return the local chunk store, creating it in the
 //repositories chunk directory if it doesnt exist yet. It creates
 //the necessary buckets if they dont exist yet
 func (repo *Repository) LocalStore() (db *bolt.DB, err error) {
+	return repo.openLocalStore(LocalStoreTimeout)
+}
+
+//openLocalStore opens the local store, waiting at most 'timeout' for other
+//processes that have it open
+func (repo *Repository) openLocalStore(timeout time.Duration) (db *bolt.DB, err error) {
 	dbpath := filepath.Join(repo.chunkDir, "a.chunks")
-	db, err = bolt.Open(dbpath, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	db, err = bolt.Open(dbpath, 0666, &bolt.Options{Timeout: timeout})
 	if err != nil {
 		return nil, fmt.Errorf("failed to open chunks database '%s': %v", dbpath, err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(IndexBucket)
-		if err != nil {
-			return fmt.Errorf("failed to create bucket: %s", err)
-		}
-		return nil
-	})
-
+	err = db.Update(repo.migrateStore)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create bucket '%s': %v", string(IndexBucket), err)
+		db.Close()
+		return nil, fmt.Errorf("failed to setup chunks database '%s': %v", dbpath, err)
 	}
 
 	return db, nil
@@ -633,8 +950,8 @@ func (repo *Repository) Pull(ref string, w io.Writer) (err error) {
 					}
 
 					defer f.Close()
-					hdr := make([]byte, hex.EncodedLen(KeySize))
-					_, err = f.Read(hdr)
+					hdr := make([]byte, LineWidth+1)
+					_, err = io.ReadFull(f, hdr)
 					if err != nil {
 						//if we cant even read a complete header, its not gonna contain chunks
 						return nil
@@ -645,7 +962,7 @@ func (repo *Repository) Pull(ref string, w io.Writer) (err error) {
 						return fmt.Errorf("failed to seek files: %v", err)
 					}
 
-					if !bytes.Equal(hdr, repo.header[:len(repo.header)-1]) {
+					if !IsPointer(hdr) {
 						return nil
 					}
 
@@ -709,7 +1026,7 @@ func (repo *Repository) Pull(ref string, w io.Writer) (err error) {
 			}()
 
 			if err != nil {
-				errCh <- fmt.Errorf("failed to check file '%s' for header content: %v", err)
+				errCh <- fmt.Errorf("failed to check file '%s' for header content: %v", s.Text(), err)
 			}
 		}
 	}()
@@ -759,150 +1076,104 @@ func (repo *Repository) ScanEach(r io.Reader, w io.Writer) (err error) {
 //look for blobs larger then 32 bytes that are also in the clean log. These
 //blobs should contain keys that are written to writer 'w'
 func (repo *Repository) Scan(left, right string, w io.Writer) (err error) {
+	revs := []string{right}
+	if left != "" {
+		revs = append(revs, "^"+left)
+	}
 
-	// rev-list --objects <right> ^<left> | f1 | cat-file --batch-check | f2 | cat-file --batch | f3
-	ctx := context.Background()
-	r1, w1 := io.Pipe()
-	r2, w2 := io.Pipe()
-	r3, w3 := io.Pipe()
-	r4, w4 := io.Pipe()
-	r5, w5 := io.Pipe()
-
-	errs := []string{}
-	errCh := make(chan error)
-	defer close(errCh)
-	go func() {
-		for err := range errCh {
-			errs = append(errs, fmt.Sprintf("%v", err))
-		}
-	}()
-
-	go func() {
-		defer w1.Close()
-		args := []string{"rev-list", "--objects", right}
-		if left != "" {
-			args = append(args, "^"+left)
-		}
+	return repo.ScanRevs(revs, w)
+}
 
-		err = repo.Git(ctx, nil, w1, args...)
+//ScanRevs is like Scan but traverses the git objects that are selected by
+//rev-list arguments 'revs', e.g "--all"
+func (repo *Repository) ScanRevs(revs []string, w io.Writer) (err error) {
+	scanned := map[K]struct{}{}
+	err = repo.forEachPointerBlob(revs, func(obj, path string, data []byte) error {
+		ptr, err := ReadPointer(bytes.NewReader(data))
 		if err != nil {
-			errCh <- err
-		}
-	}()
-
-	go func() {
-		defer w2.Close()
-		s := bufio.NewScanner(r1)
-		for s.Scan() {
-			fields := bytes.Fields(s.Bytes())
-			if len(fields) < 1 {
-				continue
-			}
-
-			fmt.Fprintf(w2, "%s\n", fields[0])
+			return fmt.Errorf("failed to read pointer '%s' at '%s': %v", obj, path, err)
 		}
 
-		if err = s.Err(); err != nil {
-			errCh <- err
-		}
-	}()
+		//output each key on a new line, but only if we didn't output it before.
+		//Keys of manifest nodes are followed by the keys below them, nodes are
+		//fetched if they are not available
+		for _, k := range ptr.Keys {
+			err = repo.walkManifest(ptr, k, ptr.Manifest, -1, func(k K, depth int, length int64) error {
+				if _, ok := scanned[k]; ok {
+					//nodes that were scanned before are shared with another
+					//version of the file, everything below them is scanned too
+					if depth > 0 {
+						return errSkipNode
+					}
 
-	go func() {
-		defer w3.Close()
-		err = repo.Git(ctx, r2, w3, "cat-file", "--batch-check")
-		if err != nil {
-			errCh <- err
-		}
-	}()
+					return nil
+				}
 
-	go func() {
-		defer w4.Close()
-		s := bufio.NewScanner(r3)
-		for s.Scan() {
-			fields := bytes.Fields(s.Bytes())
+				scanned[k] = struct{}{}
+				fmt.Fprintf(w, "%x\n", k)
+				if depth > 0 && !repo.haveChunk(k) {
+					return repo.fetchChunk(k)
+				}
 
-			//dont consider non-blobs
-			if len(fields) < 3 || !bytes.Equal(fields[1], []byte("blob")) {
-				continue
-			}
+				return nil
+			})
 
-			//parse object size for filtering by blob size
-			objSize, err := strconv.ParseInt(string(fields[2]), 10, 64)
 			if err != nil {
-				errCh <- err
-				continue
+				return fmt.Errorf("failed to scan manifest '%x': %v", k, err)
 			}
-
-			//all key files have a size that is the exact multiple of
-			//33 bytes: 32 bytes hex encoded hashes with a newline character
-			if objSize%int64(hex.EncodedLen(KeySize)+1) != 0 {
-				continue
-			}
-
-			fmt.Fprintf(w4, "%s\n", string(fields[0]))
 		}
 
-		if err = s.Err(); err != nil {
-			errCh <- err
-		}
-	}()
+		return nil
+	})
 
-	go func() {
-		defer w5.Close()
-		err = repo.Git(ctx, r4, w5, "cat-file", "--batch")
-		if err != nil {
-			errCh <- err
-		}
-	}()
+	if err != nil {
+		return fmt.Errorf("failed to scan key blobs: %v", err)
+	}
 
-	scanned := map[string]struct{}{}
-	recording := false
-	s := bufio.NewScanner(r5)
-	for s.Scan() {
-		if bytes.Equal(s.Bytes(), repo.header[:len(repo.header)-1]) {
-			recording = true
-			continue
-		}
+	return nil
+}
 
-		if bytes.Equal(s.Bytes(), repo.footer[:len(repo.footer)-1]) {
-			recording = false
-			continue
-		}
+//Split turns a plain bytes from 'r' into encrypted, deduplicated and persisted chunks
+//and outputs a pointer with the keys of those chunks on writer 'w'. Chunks are written to
+//a local chunk space, pushing these to a remote store happens at a later time (pre-push hook)
+func (repo *Repository) Split(r io.Reader, w io.Writer) (err error) {
+	if repo.conf.DeduplicationScope == 0 {
+		return fmt.Errorf("no deduplication scope configured, please run init")
+	}
 
-		//if we found keys, output each key on a new line
-		//but only if we didn't output it before
-		if recording {
-			if _, ok := scanned[s.Text()]; !ok {
-				fmt.Fprintf(w, "%s\n", s.Text())
-				scanned[s.Text()] = struct{}{}
-			}
-		}
+	chunking := repo.conf.Chunking()
+	err = chunking.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid chunking configured: %v", err)
 	}
 
-	if err = s.Err(); err != nil {
-		return fmt.Errorf("failed to scan key blobs: %v", err)
+	//read the head of the file to check if it is already split or small enough
+	//to be stored as is, it is stitched back in front of the rest of the file
+	headSize := LineWidth + 1
+	if int(repo.conf.MinSize) > headSize {
+		headSize = int(repo.conf.MinSize)
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("there were scanning errors: \n %s", strings.Join(errs, "\n\t"))
+	headp := headPool.Get().(*[]byte)
+	defer headPool.Put(headp)
+	if cap(*headp) < headSize {
+		*headp = make([]byte, headSize)
 	}
 
-	return nil
-}
+	head := (*headp)[:headSize]
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read file content: %v", err)
+	}
 
-//Split turns a plain bytes from 'r' into encrypted, deduplicated and persisted chunks
-//while outputting keys for those chunks on writer 'w'. Chunks are written to a local chunk
-//space, pushing these to a remote store happens at a later time (pre-push hook)
-func (repo *Repository) Split(r io.Reader, w io.Writer) (err error) {
-	if repo.conf.DeduplicationScope == 0 {
-		return fmt.Errorf("no deduplication scope configured, please run init", err)
+	head = head[:n]
+	bufr := io.MultiReader(bytes.NewReader(head), r)
+	hdr := head
+	if len(hdr) > LineWidth+1 {
+		hdr = hdr[:LineWidth+1]
 	}
 
-	//create a buffer that allows us to peek if this is a file that
-	//is already spit, if so: simply copy over the bytes, nothing to split
-	bufr := bufio.NewReader(r)
-	hdr, _ := bufr.Peek(hex.EncodedLen(KeySize) + 1)
-	if bytes.Equal(hdr, repo.header) {
+	if IsPointer(hdr) {
 		_, err := io.Copy(w, bufr)
 		if err != nil {
 			return fmt.Errorf("failed to copy already chunked file content: %v", err)
@@ -911,84 +1182,229 @@ func (repo *Repository) Split(r io.Reader, w io.Writer) (err error) {
 		return nil
 	}
 
-	//it is a feel that needs splitting, start
-	//writing header and footer
-	w.Write(repo.header)
-	defer w.Write(repo.footer)
+	//files below the minimum size are stored as is, unless they start like
+	//a list of keys as combining would misinterpret them
+	if uint64(len(head)) < repo.conf.MinSize && !HoldsKeys(hdr) {
+		_, err := io.Copy(w, bufr)
+		if err != nil {
+			return fmt.Errorf("failed to copy small file content: %v", err)
+		}
+
+		return nil
+	}
+
+	//setup how chunk keys are derived
+	h := repo.Hash()
+	newHash, err := repo.Hasher(h)
+	if err != nil {
+		return fmt.Errorf("failed to setup chunk hashing: %v", err)
+	}
+
+	//if compression is configured, chunks are framed
+	var comp *Compression
+	if repo.conf.Compression != "" {
+		comp, err = CompressionByName(repo.conf.Compression)
+		if err != nil {
+			return fmt.Errorf("failed to setup chunk compression: %v", err)
+		}
+	}
+
+	//it is a file that needs splitting, the pointer records how
+	ptr := NewPointer()
+	ptr.Hash = h
+	ptr.Chunking = &chunking
+	ptr.Size = 0
+	ptr.Lengths = []int64{}
+	if comp != nil {
+		ptr.ChunkFormat = FramedChunkFormat
+	}
+
+	//write actual chunks while hashing the whole file, keyed like the chunks
+	//such that the checksum doesn't confirm guesses of the content
+	filehash := newHash()
+	chunkr, err := chunking.New(io.TeeReader(bufr, filehash))
+	if err != nil {
+		return fmt.Errorf("failed to setup chunker: %v", err)
+	}
 
-	//write actual chunks
-	chunkr := chunker.New(bufr, chunker.Pol(repo.conf.DeduplicationScope))
 	buf := make([]byte, ChunkBufferSize)
 	for {
-		chunk, err := chunkr.Next(buf)
+		data, err := chunkr.Next(buf)
 		if err == io.EOF {
 			break
 		}
 
 		if err != nil {
-			return fmt.Errorf("Failed to write chunk (%d bytes) to buffer (size %d bytes): %v", chunk.Length, ChunkBufferSize, err)
+			return fmt.Errorf("Failed to write chunk (%d bytes) to buffer (size %d bytes): %v", len(data), ChunkBufferSize, err)
 		}
 
-		//@TODO use hmac(SHA256) with the deduplication scope as a key
-		k := sha256.Sum256(chunk.Data)
-		printk := func(k K) error {
-			_, err = fmt.Fprintf(w, "%x\n", k)
-			if err != nil {
-				return fmt.Errorf("failed to write key to output: %v", err)
-			}
+		k, err := repo.storeChunk(data, newHash, comp)
+		if err != nil {
+			return fmt.Errorf("Failed to split chunk '%x': %v", k, err)
+		}
 
-			return nil
+		ptr.Keys = append(ptr.Keys, k)
+		ptr.Lengths = append(ptr.Lengths, int64(len(data)))
+		ptr.Size += int64(len(data))
+	}
+
+	//large files refer to a tree of manifest nodes instead of listing
+	//all chunks, this keeps their pointers small and of constant size
+	if repo.conf.ManifestThreshold > 0 && uint64(ptr.Size) >= repo.conf.ManifestThreshold && len(ptr.Keys) > 1 {
+		root, depth, err := buildManifest(ptr.Keys, ptr.Lengths, func(data []byte) (K, error) {
+			return repo.storeChunk(data, newHash, comp)
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to build manifest: %v", err)
 		}
 
-		err = func() error {
+		ptr.Keys = []K{root}
+		ptr.Lengths = []int64{ptr.Size}
+		ptr.Manifest = depth
+	}
 
-			//formulate path
-			p, err := repo.Path(k, true)
-			if err != nil {
-				return fmt.Errorf("failed to create chunk dir for '%x': %v", k, err)
-			}
+	//write the pointer to the output
+	if h == HMACSHA256Hash {
+		ptr.HMACSHA256 = filehash.Sum(nil)
+	} else {
+		ptr.SHA256 = filehash.Sum(nil)
+	}
 
-			//attempt to open, create if nont existing
-			f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
-			if err != nil {
+	_, err = ptr.WriteTo(w)
+	if err != nil {
+		return fmt.Errorf("failed to write pointer to output: %v", err)
+	}
 
-				//if its already written, all good; output key
-				if os.IsExist(err) {
-					repo.keyProgressCh <- KeyOp{StageOp, k, true, 0}
-					return printk(k)
-				}
+	return nil
+}
 
-				return fmt.Errorf("Failed to open chunk file '%s' for writing: %v", p, err)
-			}
+//storeChunk encrypts chunk content 'data' and writes it to the local chunk
+//store, unless it is already stored. Its key is derived using 'newHash', if
+//'comp' is not nil the chunk is framed and compressed.
+func (repo *Repository) storeChunk(data []byte, newHash func() hash.Hash, comp *Compression) (k K, err error) {
+	//framed chunks are keyed over the frame, such that frames that hold the
+	//same content with another compression never share a key (and keystream)
+	plain := data
+	h := newHash()
+	if comp != nil {
+		plain, err = comp.Frame(data)
+		if err != nil {
+			return k, fmt.Errorf("failed to frame chunk: %v", err)
+		}
 
-			//aes encryption with
-			block, err := aes.NewCipher(k[:])
-			if err != nil {
-				return fmt.Errorf("failed to create cipher for key '%x': %v", k, err)
-			}
+		h.Write(FramedChunkPrefix)
+	}
 
-			//create encrypt writer
-			//@TODO use GCM cipher mode
-			//@TODO	If the key is unique for each ciphertext, then it's ok to use a zero IV.
-			defer f.Close()
-			var iv [aes.BlockSize]byte
-			stream := cipher.NewOFB(block, iv[:])
-			encryptw := &cipher.StreamWriter{S: stream, W: f}
+	h.Write(plain)
+	copy(k[:], h.Sum(nil))
 
-			//encrypt and write to file
-			n, err := encryptw.Write(chunk.Data)
-			if err != nil {
-				return fmt.Errorf("Failed to write chunk '%x' (wrote %d bytes): %v", k, n, err)
+	//if its already written, all good
+	if _, ok := repo.lookup(k); ok {
+		repo.update(k, func(u *chunkUpdate) {
+			u.accessed = time.Now()
+			u.plainSize = int64(len(data))
+		})
+
+		repo.keyProgressCh <- KeyOp{StageOp, k, true, 0}
+		return k, nil
+	}
+
+	//formulate path
+	p, err := repo.Path(k, true)
+	if err != nil {
+		return k, fmt.Errorf("failed to create chunk dir for '%x': %v", k, err)
+	}
+
+	//aes encryption with
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return k, fmt.Errorf("failed to create cipher for key '%x': %v", k, err)
+	}
+
+	//encrypt and write to file
+	n, err := writeChunkFile(p, func(w io.Writer) (int64, error) {
+
+		//create encrypt writer
+		//@TODO use GCM cipher mode
+		//@TODO	If the key is unique for each ciphertext, then it's ok to use a zero IV.
+		var iv [aes.BlockSize]byte
+		stream := cipher.NewOFB(block, iv[:])
+		encryptw := &cipher.StreamWriter{S: stream, W: w}
+		n, err := encryptw.Write(plain)
+		return int64(n), err
+	})
+
+	if err != nil {
+		return k, fmt.Errorf("Failed to write chunk '%x' (wrote %d bytes): %v", k, n, err)
+	}
+
+	//report staging
+	repo.update(k, func(u *chunkUpdate) {
+		u.accessed = time.Now()
+		u.staged = u.accessed
+		u.plainSize = int64(len(data))
+		u.cipherSize = n
+	})
+
+	repo.keyProgressCh <- KeyOp{StageOp, k, false, n}
+	return k, nil
+}
+
+//CheckChunking compares the chunking recorded in the pointer that HEAD holds
+//for 'path' with the configured chunking. If they differ, a warning is written
+//to the output as the file will no longer deduplicate against earlier versions,
+//this usually means clients are configured differently. Pointers that don't
+//record their chunking are compared with the default chunking of the committed
+//deduplication scope. Once per repository it also warns if the configured scope
+//differs from the committed one, which doesn't require reading any pointer
+func (repo *Repository) CheckChunking(path string) (err error) {
+	configured := repo.conf.Chunking()
+	scope := repo.conf.DeduplicationScope
+	if shared := repo.conf.SharedDeduplicationScope; shared != 0 {
+		scope = shared
+		repo.scopeChecked.Do(func() {
+			if shared != configured.Pol {
+				fmt.Fprintf(repo.output, "warning: this client is configured with deduplication scope '%x' but '%s' sets '%x', files will not deduplicate against those of other clients\n", configured.Pol, SharedConfFile, shared)
 			}
+		})
+	}
 
-			//report staging and output key
-			repo.keyProgressCh <- KeyOp{StageOp, k, false, int64(n)}
-			return printk(k)
-		}()
+	//a single process that reports missing objects quietly
+	blob := bytes.NewBuffer(nil)
+	err = repo.Git(nil, strings.NewReader("HEAD:"+filepath.ToSlash(path)+"\n"), blob, "cat-file", "--batch")
+	if err != nil {
+		return fmt.Errorf("failed to read committed blob of '%s': %v", path, err)
+	}
 
-		if err != nil {
-			return fmt.Errorf("Failed to split chunk '%x': %v", k, err)
-		}
+	hdr, _ := blob.ReadString('\n')
+	fields := strings.Fields(hdr)
+	if len(fields) != 3 || fields[1] != "blob" {
+		return nil //not committed (yet) or not a file, nothing to compare with
+	}
+
+	size, err := strconv.Atoi(fields[2])
+	if err != nil || size > blob.Len() {
+		return fmt.Errorf("unexpected object header '%s'", strings.TrimSpace(hdr))
+	}
+
+	data := blob.Bytes()[:size]
+	if !IsPointer(data) {
+		return nil //not a pointer
+	}
+
+	ptr, err := ReadPointer(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to read committed pointer of '%s': %v", path, err)
+	}
+
+	committed := DefaultChunking(scope)
+	if ptr.Chunking != nil {
+		committed = *ptr.Chunking
+	}
+
+	if committed != configured {
+		fmt.Fprintf(repo.output, "warning: '%s' was split using chunking '%s' but this client is configured with '%s', it will not deduplicate against its previous versions\n", path, committed, configured)
 	}
 
 	return nil
@@ -996,43 +1412,171 @@ func (repo *Repository) Split(r io.Reader, w io.Writer) (err error) {
 
 //Combine turns a newline seperated list of chunk keys from 'r' by reading the the
 //projects local store. Chunks are then decrypted and combined in the original
-//file and written to writer 'w'
+//file and written to writer 'w'. The content of each chunk is verified against
+//its key using the hash recorded in the pointer attributes, if the pointer
+//records the size and checksum of the original file these are verified as well.
+//Verification happens while streaming, as such 'w' might have received content
+//that is later found to be invalid.
 func (repo *Repository) Combine(r io.Reader, w io.Writer) (err error) {
-	err = repo.ForEach(r, func(k K) error {
 
-		//open chunk file
-		p, _ := repo.Path(k, false)
-		f, err := os.OpenFile(p, os.O_RDONLY, 0666)
+	//files that were not split (e.g because they are small) pass through
+	bufr := bufio.NewReader(r)
+	if hdr, _ := bufr.Peek(LineWidth + 1); !HoldsKeys(hdr) {
+		_, err = io.Copy(w, bufr)
 		if err != nil {
-			return fmt.Errorf("failed to open chunk '%x' locally at '%s': %v", k, p, err)
+			return fmt.Errorf("failed to copy unsplit file content: %v", err)
 		}
 
-		//setup aes cipher
-		block, err := aes.NewCipher(k[:])
-		if err != nil {
-			return fmt.Errorf("failed to create cipher: %v", err)
-		}
+		return nil
+	}
 
-		//setup the read stream
-		//@TODO use GCM cipher mode
-		//@TODO	If the key is unique for each ciphertext, then it's ok to use a zero IV.
-		var iv [aes.BlockSize]byte
-		stream := cipher.NewOFB(block, iv[:])
-		decryptr := &cipher.StreamReader{S: stream, R: f}
+	//which checksum the pointer records is only known once its attributes
+	//after the keys are read, so the file is hashed both ways if it can be
+	r = bufr
+	ptr := NewPointer()
+	filehashes := map[Hash]hash.Hash{SHA256Hash: sha256.New()}
+	if len(repo.hashKey) > 0 {
+		filehashes[HMACSHA256Hash] = hmac.New(sha256.New, repo.hashKey)
+	}
 
-		//copy chunk bytes to output
-		defer f.Close()
-		n, err := io.Copy(w, decryptr)
-		if err != nil {
-			return fmt.Errorf("failed to copy chunk '%x' content after %d bytes: %v", k, n, err)
+	filehash := io.MultiWriter(filehashes[SHA256Hash])
+	if fh, ok := filehashes[HMACSHA256Hash]; ok {
+		filehash = io.MultiWriter(filehashes[SHA256Hash], fh)
+	}
+
+	size := int64(0)
+	nkeys := 0
+	err = repo.ForEachWithAttrs(r, ptr.SetAttr, func(k K) error {
+		nkeys++
+		if ptr.Manifest == 0 {
+			n, err := repo.copyChunk(io.MultiWriter(w, filehash), ptr, k)
+			size += n
+			return err
 		}
 
-		return nil
+		//keys refer to manifest nodes, combine the chunks below them
+		return repo.walkManifest(ptr, k, ptr.Manifest, -1, func(k K, depth int, length int64) error {
+			if depth > 0 {
+				return nil
+			}
+
+			n, err := repo.copyChunk(io.MultiWriter(w, filehash), ptr, k)
+			size += n
+			if err == nil && n != length {
+				return fmt.Errorf("chunk '%x' has %d bytes while its manifest records %d bytes", k, n, length)
+			}
+
+			return err
+		})
 	})
 
 	if err != nil {
 		return fmt.Errorf("failed to loop over keys: %v", err)
 	}
 
+	if ptr.Lengths != nil && len(ptr.Lengths) != nkeys {
+		return fmt.Errorf("pointer records %d chunk lengths for %d keys, it may be truncated or corrupt", len(ptr.Lengths), nkeys)
+	}
+
+	if ptr.Size >= 0 && ptr.Size != size {
+		return fmt.Errorf("combined file has %d bytes while its pointer records %d bytes, the pointer may be truncated or corrupt", size, ptr.Size)
+	}
+
+	h, sum := ptr.Checksum()
+	if sum == nil {
+		return nil
+	}
+
+	fh, ok := filehashes[h]
+	if !ok {
+		return fmt.Errorf("pointer records a %s of the combined file but no hash secret is configured, set 'bits.hash-secret' or 'bits.hash-secret-file'", h)
+	}
+
+	if !bytes.Equal(sum, fh.Sum(nil)) {
+		return fmt.Errorf("combined file doesn't match the %s recorded in its pointer, its chunks may be listed in the wrong order", h)
+	}
+
 	return nil
 }
+
+//copyChunk decrypts the locally stored chunk with key 'k' and writes its content
+//to 'w', chunks are decoded as described by pointer 'ptr'. The content is verified
+//against the key, in which case 'w' has already received the corrupt content.
+func (repo *Repository) copyChunk(w io.Writer, ptr *Pointer, k K) (n int64, err error) {
+	newHash, err := repo.Hasher(ptr.Hash)
+	if err != nil {
+		return 0, fmt.Errorf("failed to setup chunk hashing: %v", err)
+	}
+
+	//open chunk file, which may be stored in an alternate
+	p, ok := repo.lookup(k)
+	if !ok {
+		p, _ = repo.Path(k, false)
+	}
+
+	f, err := os.OpenFile(p, os.O_RDONLY, 0666)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open chunk '%x' locally at '%s': %v", k, p, err)
+	}
+
+	defer f.Close()
+	n, err = decodeChunk(w, f, newHash, ptr.ChunkFormat, k)
+	if err != nil {
+		return n, err
+	}
+
+	repo.update(k, func(u *chunkUpdate) {
+		u.accessed = time.Now()
+		u.plainSize = n
+	})
+
+	return n, nil
+}
+
+//decodeChunk decrypts the encrypted chunk with key 'k' read from 'r' and writes
+//its content to 'w', the content is laid out in 'format' and verified against
+//the key using 'newHash' as it is copied
+func decodeChunk(w io.Writer, r io.Reader, newHash func() hash.Hash, format string, k K) (n int64, err error) {
+
+	//setup aes cipher
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return 0, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	//setup the read stream
+	//@TODO use GCM cipher mode
+	//@TODO	If the key is unique for each ciphertext, then it's ok to use a zero IV.
+	var iv [aes.BlockSize]byte
+	stream := cipher.NewOFB(block, iv[:])
+	decryptr := &cipher.StreamReader{S: stream, R: r}
+
+	//framed chunks are keyed over the frame with a prefix and decompressed
+	hash := newHash()
+	if format == FramedChunkFormat {
+		hash.Write(FramedChunkPrefix)
+		framer := io.TeeReader(decryptr, hash)
+		rc, err := Unframe(framer)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unframe chunk '%x': %v", k, err)
+		}
+
+		defer rc.Close()
+		n, err = io.Copy(w, rc)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, framer)
+		}
+	} else {
+		n, err = io.Copy(io.MultiWriter(w, hash), decryptr)
+	}
+
+	if err != nil {
+		return n, fmt.Errorf("failed to copy chunk '%x' content after %d bytes: %v", k, n, err)
+	}
+
+	if !bytes.Equal(hash.Sum(nil), k[:]) {
+		return n, fmt.Errorf("chunk '%x' is corrupt or was keyed with another secret, its content doesn't match its key", k)
+	}
+
+	return n, nil
+}
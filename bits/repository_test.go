@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/nerdalize/git-bits/bits"
+	"github.com/restic/chunker"
 )
 
 func GitInitRemote(t *testing.T) (dir string) {
@@ -133,8 +134,8 @@ func TestNewRepository(t *testing.T) {
 
 //test basic file splitting and combining
 func TestSplitCombineScan(t *testing.T) {
-	ctx := context.Background()
-	ctx, _ = context.WithTimeout(ctx, time.Second*10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
 
 	BuildBinaryInPath(t, ctx) //@TODO this is terrible for unit testing
 
@@ -241,8 +242,8 @@ func TestSplitCombineScan(t *testing.T) {
 
 //tests pushing and fetching objects from a git remote
 func TestPushFetch(t *testing.T) {
-	ctx := context.Background()
-	ctx, _ = context.WithTimeout(ctx, time.Second*60)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
 
 	remote1 := GitInitRemote(t)
 	wd1, repo1 := GitCloneWorkspace(remote1, t)
@@ -393,6 +394,924 @@ func TestPushFetch(t *testing.T) {
 	}
 
 	if strings.Contains(buf.String(), " with space.bin") {
-		t.Error("after initi git status shouldnt report files being modified, got: \n %s", buf.String())
+		t.Errorf("after initi git status shouldnt report files being modified, got: \n %s", buf.String())
+	}
+}
+
+//tests that keyed hashing is recorded in the pointer and verified on combine
+func TestKeyedSplitCombine(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.hash-secret": "my-team-secret",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, repo2 := GitCloneWorkspace(remote1, t)
+
+	content := make([]byte, 2*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyed := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), keyed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(keyed.String(), "hash hmac-sha256") {
+		t.Errorf("expected keyed pointer to record its hash, got: %s", keyed.String())
+	}
+
+	//the unkeyed checksum of the file would confirm guesses of its content
+	if strings.Contains(keyed.String(), "\nsha256 ") || !strings.Contains(keyed.String(), "\nhmac-sha256 ") {
+		t.Errorf("expected keyed pointer to record a keyed checksum only, got: %s", keyed.String())
+	}
+
+	if keyed.Len()%(hex.EncodedLen(bits.KeySize)+1) != 0 {
+		t.Errorf("expected keyed pointer size to be a multiple of the line size, got: %d", keyed.Len())
+	}
+
+	plain := bytes.NewBuffer(nil)
+	err = repo2.Split(bytes.NewReader(content), plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(plain.String(), "hash sha256") {
+		t.Errorf("expected plain pointer to record its hash, got: %s", plain.String())
+	}
+
+	for _, line := range strings.Split(plain.String(), "\n")[1:] {
+		if line != "" && strings.Contains(keyed.String(), line+"\n") && !strings.Contains(line, " ") {
+			t.Errorf("expected keyed and plain pointers to have no keys in common, both have: %s", line)
+		}
+	}
+
+	combined := bytes.NewBuffer(nil)
+	err = repo1.Combine(bytes.NewReader(keyed.Bytes()), combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Errorf("expected combined content to equal the original")
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(keyed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr.HMACSHA256[0] ^= 0xff
+	tampered := bytes.NewBuffer(nil)
+	_, err = ptr.WriteTo(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Combine(tampered, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "hmac-sha256") {
+		t.Errorf("expected combining with a mismatching checksum to fail, got: %v", err)
+	}
+
+	err = repo2.Combine(bytes.NewReader(keyed.Bytes()), ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "no hash secret") {
+		t.Errorf("expected combining a keyed pointer without secret to fail, got: %v", err)
+	}
+}
+
+//tests that compressible chunks are stored compressed and combined transparently
+func TestCompressedSplitCombine(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.compression": "deflate",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noise := make([]byte, 1024*1024)
+	_, err = rand.Read(noise)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := append(bytes.Repeat([]byte("id,name,value\n1,foo,0.5\n"), 200*1024), noise...)
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(pointer.String(), "chunk-format framed") {
+		t.Errorf("expected pointer to record framed chunks, got: %s", pointer.String())
+	}
+
+	stored := int64(0)
+	err = filepath.Walk(filepath.Join(wd1, ".git", "chunks"), func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && fi.Name() != "a.chunks" {
+			stored += fi.Size()
+		}
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored >= int64(len(content)/2) {
+		t.Errorf("expected chunks to be stored compressed, stored %d bytes for %d bytes of content", stored, len(content))
+	}
+
+	combined := bytes.NewBuffer(nil)
+	err = repo1.Combine(bytes.NewReader(pointer.Bytes()), combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Errorf("expected combined content to equal the original")
+	}
+
+	//another compression frames the same content differently, which must
+	//never be encrypted with the same key
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.compression": "gzip",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzipped := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), gzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deflated := map[bits.K]struct{}{}
+	err = repo1.ForEach(bytes.NewReader(pointer.Bytes()), func(k bits.K) error {
+		deflated[k] = struct{}{}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := 0
+	err = repo1.ForEach(bytes.NewReader(gzipped.Bytes()), func(k bits.K) error {
+		if _, ok := deflated[k]; ok {
+			shared++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//only the incompressible noise is framed the same
+	if shared >= len(deflated) {
+		t.Errorf("expected compressed chunks to be keyed over their frame, %d of %d keys are shared", shared, len(deflated))
+	}
+
+	combined.Reset()
+	err = repo1.Combine(bytes.NewReader(gzipped.Bytes()), combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Errorf("expected content combined from gzip frames to equal the original")
+	}
+}
+
+//tests that a generated scope is shared through the committed configuration
+func TestSharedScope(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+
+	pol, err := chunker.RandomPolynomial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := bits.DefaultConf()
+	conf.DeduplicationScope = uint64(pol)
+	err = repo1.Install(os.Stderr, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", bits.SharedConfFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "commit", "-m", "share scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "push", "--no-verify", "origin", "HEAD:master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd2, repo2 := GitCloneWorkspace(remote1, t)
+	shared := &bits.Conf{}
+	err = shared.OverwriteFromShared(repo2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shared.DeduplicationScope != uint64(pol) {
+		t.Errorf("expected clone to share scope %d, got: %d", pol, shared.DeduplicationScope)
+	}
+
+	//a commit must not be able to redirect chunks or choose the secret file
+	for k, v := range map[string]string{
+		"bits.aws-s3-bucket-name":                "attacker",
+		"bits.hash-secret-file":                  "/etc/passwd",
+		"bits-remote.origin.aws-s3-bucket-name":  "attacker",
+		"bits-remote.archive.aws-s3-bucket-name": "attacker",
+	} {
+		err = repo2.Git(ctx, nil, nil, "config", "-f", bits.SharedConfFile, k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shared = &bits.Conf{}
+	err = shared.OverwriteFromShared(repo2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shared.AWSS3BucketName != "" || shared.HashSecretFile != "" || len(shared.Remotes) != 0 {
+		t.Errorf("expected buckets and secret files to be ignored in the shared configuration, got: %+v", shared)
+	}
+
+	if shared.DeduplicationScope != uint64(pol) {
+		t.Errorf("expected other shared options to still be read")
+	}
+
+	GitConfigure(t, ctx, repo2, map[string]string{
+		"bits.deduplication-scope": "12",
+	})
+
+	_, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Errorf("expected repository with shared scope to be valid, got: %v", err)
+	}
+
+	repo2, err = bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatalf("expected repository with a reducible scope to still open, got: %v", err)
+	}
+
+	content := make([]byte, 2*1024*1024)
+	err = repo2.Split(bytes.NewReader(content), ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "irreducible") {
+		t.Errorf("expected a reducible scope to be rejected when splitting, got: %v", err)
+	}
+}
+
+func TestCombineVerifiesChecksum(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunker":        "fixed",
+		"bits.chunk-min-size": "512KiB",
+		"bits.chunk-avg-size": "512KiB",
+		"bits.chunk-max-size": "512KiB",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ptr.Keys) < 2 {
+		t.Fatalf("expected content to split into multiple chunks, got: %d", len(ptr.Keys))
+	}
+
+	//reordering chunks keeps every chunk intact but changes the file
+	ptr.Keys[0], ptr.Keys[1] = ptr.Keys[1], ptr.Keys[0]
+	ptr.Lengths[0], ptr.Lengths[1] = ptr.Lengths[1], ptr.Lengths[0]
+	tampered := bytes.NewBuffer(nil)
+	_, err = ptr.WriteTo(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Combine(tampered, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "sha256") {
+		t.Errorf("expected combining reordered chunks to fail on the checksum, got: %v", err)
+	}
+
+	err = repo1.VerifyPointer(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Errorf("expected original pointer to verify, got: %v", err)
+	}
+}
+
+func TestOpenRandomAccess(t *testing.T) {
+	remote1 := GitInitRemote(t)
+	wd1, _ := GitCloneWorkspace(remote1, t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunker":        "fastcdc",
+		"bits.chunk-min-size": "16KiB",
+		"bits.chunk-avg-size": "64KiB",
+		"bits.chunk-max-size": "256KiB",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 2*1024*1024+13)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err := repo1.Open(pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rd.Size() != int64(len(content)) {
+		t.Errorf("expected size %d, got: %d", len(content), rd.Size())
+	}
+
+	for _, c := range []struct{ off, n int64 }{{0, 10}, {100000, 300000}, {int64(len(content)) - 5, 5}, {1, int64(len(content)) - 1}} {
+		buf := make([]byte, c.n)
+		_, err = rd.ReadAt(buf, c.off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf, content[c.off:c.off+c.n]) {
+			t.Errorf("expected range [%d, %d) to equal the original content", c.off, c.off+c.n)
+		}
+	}
+
+	n, err := rd.ReadAt(make([]byte, 10), int64(len(content))-3)
+	if n != 3 || err != io.EOF {
+		t.Errorf("expected short read at the end to return 3 and EOF, got: %d, %v", n, err)
+	}
+
+	_, err = rd.Seek(-7, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tail, err := ioutil.ReadAll(rd)
+	if err != nil || !bytes.Equal(tail, content[len(content)-7:]) {
+		t.Errorf("expected to read the last 7 bytes after seeking, got: %x (%v)", tail, err)
+	}
+}
+
+func TestManifestSplitCombineScan(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunker":            "fixed",
+		"bits.chunk-min-size":     "4KiB",
+		"bits.chunk-avg-size":     "4KiB",
+		"bits.chunk-max-size":     "4KiB",
+		"bits.manifest-threshold": "1MiB",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 4*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countChunks := func() (n int) {
+		filepath.Walk(filepath.Join(wd1, ".git", "chunks"), func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() && fi.Name() != "a.chunks" {
+				n++
+			}
+
+			return err
+		})
+
+		return n
+	}
+
+	pointer1 := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(pointer1.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ptr.Manifest < 1 || len(ptr.Keys) != 1 || pointer1.Len() > 12*(bits.LineWidth+1) {
+		t.Errorf("expected a small pointer that refers to a manifest, got: %s", pointer1.String())
+	}
+
+	combined := bytes.NewBuffer(nil)
+	err = repo1.Combine(bytes.NewReader(pointer1.Bytes()), combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Errorf("expected combined content to equal the original")
+	}
+
+	//an edit only rewrites the affected chunk and the nodes above it
+	before := countChunks()
+	content[2*1024*1024] ^= 0xff
+	pointer2 := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if added := countChunks() - before; added > 1+ptr.Manifest {
+		t.Errorf("expected an edit to add at most %d chunks, added: %d", 1+ptr.Manifest, added)
+	}
+
+	rd, err := repo1.Open(bytes.NewReader(pointer2.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 10)
+	_, err = rd.ReadAt(buf, 2*1024*1024-5)
+	if err != nil || !bytes.Equal(buf, content[2*1024*1024-5:2*1024*1024+5]) {
+		t.Errorf("expected random access through the manifest to read the edited content, got: %x (%v)", buf, err)
+	}
+
+	//scanning history lists all nodes and chunks below the manifest
+	err = ioutil.WriteFile(filepath.Join(wd1, "big.bin"), pointer2.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanbuf := bytes.NewBuffer(nil)
+	err = repo1.Scan("", "HEAD", scanbuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nkeys := bytes.Count(scanbuf.Bytes(), []byte("\n")); nkeys <= len(content)/(4*1024) {
+		t.Errorf("expected scan to list all %d chunks and the manifest nodes, got: %d keys", len(content)/(4*1024), nkeys)
+	}
+}
+
+func TestMinSizePassThrough(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.min-size": "1KiB",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyed := []byte(fmt.Sprintf("%x\nlooks like a list of keys\n", bits.K{0x01}))
+	for _, c := range []struct {
+		content []byte
+		split   bool
+	}{
+		{[]byte{}, false},
+		{[]byte("hello world\n"), false},
+		{keyed, true},
+		{bytes.Repeat([]byte("a"), 1024), true},
+	} {
+		split := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(c.content), split)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bits.IsPointer(split.Bytes()) != c.split {
+			t.Errorf("expected content of %d bytes to be split: %v, got: %q", len(c.content), c.split, split.String())
+		}
+
+		fetched := bytes.NewBuffer(nil)
+		err = repo1.Fetch(bytes.NewReader(split.Bytes()), fetched)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		combined := bytes.NewBuffer(nil)
+		err = repo1.Combine(fetched, combined)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(combined.Bytes(), c.content) {
+			t.Errorf("expected content of %d bytes to round trip, got: %q", len(c.content), combined.String())
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	pointers := map[string]*bytes.Buffer{}
+	for _, name := range []string{"committed.bin", "staged.bin", "garbage.bin"} {
+		content := make([]byte, 1024*1024)
+		_, err = rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pointers[name] = bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), pointers[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"committed.bin", "staged.bin"} {
+		err = ioutil.WriteFile(filepath.Join(wd1, name), pointers[name].Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo1.Git(ctx, nil, nil, "add", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name == "committed.bin" {
+			err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	keys := func(name string) (ks []bits.K) {
+		ptr, err := bits.ReadPointer(bytes.NewReader(pointers[name].Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ptr.Keys
+	}
+
+	stats, err := repo1.GC(store1, bits.GCOpts{DryRun: true}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Removed != len(keys("garbage.bin")) || stats.RemovedBytes == 0 {
+		t.Errorf("expected a dry run to report the garbage chunks, got: %s", stats)
+	}
+
+	stats, err = repo1.GC(store1, bits.GCOpts{Expire: time.Hour}, ioutil.Discard)
+	if err != nil || stats.Removed != 0 {
+		t.Errorf("expected recently staged chunks to be kept, got: %s (%v)", stats, err)
+	}
+
+	//temporary files of interrupted writes are removed once they are stale
+	p, _ := repo1.Path(keys("committed.bin")[0], false)
+	stale, fresh := filepath.Join(filepath.Dir(p), ".tmp-stale"), filepath.Join(filepath.Dir(p), ".tmp-fresh")
+	for _, tmp := range []string{stale, fresh} {
+		err = ioutil.WriteFile(tmp, []byte("partial"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-2 * bits.GCTempExpire)
+	err = os.Chtimes(stale, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo1.GC(store1, bits.GCOpts{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected stale temporary chunk file to be removed, got: %v", err)
+	}
+
+	if _, err = os.Stat(fresh); err != nil {
+		t.Errorf("expected recent temporary chunk file to be kept, got: %v", err)
+	}
+
+	for name, expected := range map[string]bool{"committed.bin": true, "staged.bin": true, "garbage.bin": false} {
+		for _, k := range keys(name) {
+			p, _ := repo1.Path(k, false)
+			if _, err := os.Stat(p); (err == nil) != expected {
+				t.Errorf("expected chunk '%x' of '%s' to be kept: %v", k, name, expected)
+			}
+		}
+	}
+
+	//manifest nodes that are not stored locally are not fetched, the unpushed
+	//chunks below them can't be told apart from garbage and are kept
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.manifest-threshold": "1MiB",
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointers["manifest.bin"] = bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointers["manifest.bin"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "manifest.bin"), pointers["manifest.bin"].Bytes(), 0666)
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "add", "manifest.bin")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countLocal := func() (n int) {
+		err := repo1.ForEachLocalChunk(func(k bits.K, fi os.FileInfo) error {
+			n++
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	root, _ := repo1.Path(keys("manifest.bin")[0], false)
+	err = os.Remove(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := countLocal()
+	stats, err = repo1.GC(store1, bits.GCOpts{}, ioutil.Discard)
+	if err != nil || stats.Removed != 0 || countLocal() != before {
+		t.Errorf("expected chunks below a manifest node that isn't stored locally to be kept, got: %s (%v)", stats, err)
+	}
+}
+
+func TestChunkDirAndAlternates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	shared, err := ioutil.TempDir("", "test_chunks_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunk-dir": shared,
+	})
+
+	repo1, err = bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 2*1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//concurrent writers of the same chunks must not see partial files
+	pointers := make([]*bytes.Buffer, 4)
+	errs := make(chan error, len(pointers))
+	for i := range pointers {
+		pointers[i] = bytes.NewBuffer(nil)
+		go func(w io.Writer) {
+			errs <- repo1.Split(bytes.NewReader(content), w)
+		}(pointers[i])
+	}
+
+	for range pointers {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(pointers[0].Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range ptr.Keys {
+		_, err = os.Stat(filepath.Join(shared, fmt.Sprintf("%x", k[:2]), fmt.Sprintf("%x", k[2:])))
+		if err != nil {
+			t.Errorf("expected chunk '%x' to be stored in the configured chunk dir: %v", k, err)
+		}
+	}
+
+	//another clone without a remote reads the chunks from the alternate
+	wd2, repo2 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo2, map[string]string{
+		"bits.alternate": shared,
+	})
+
+	repo2, err = bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := bytes.NewBuffer(nil)
+	err = repo2.Fetch(bytes.NewReader(pointers[0].Bytes()), fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	combined := bytes.NewBuffer(nil)
+	err = repo2.Combine(fetched, combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Errorf("expected content to be combined from the alternate chunk dir")
+	}
+
+	n := 0
+	err = repo2.ForEachLocalChunk(func(k bits.K, fi os.FileInfo) error {
+		n++
+		return nil
+	})
+
+	if err != nil || n != 0 {
+		t.Errorf("expected no chunks to be copied from the alternate, got %d (%v)", n, err)
+	}
+
+	//other clones may reference the chunks, unpushed chunks are never collected
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	stats, err := repo1.GC(store1, bits.GCOpts{}, ioutil.Discard)
+	if err != nil || stats.Removed != 0 {
+		t.Errorf("expected unpushed chunks in a configured chunk dir to be kept, got: %s (%v)", stats, err)
+	}
+}
+
+func TestWorktreeSharesChunks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	err := repo1.Git(ctx, nil, nil, "commit", "--allow-empty", "-m", "c0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 1024*1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd2 := filepath.Join(wd1+"_worktrees", "wt")
+	err = repo1.Git(ctx, nil, nil, "worktree", "add", wd2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo2, err := bits.NewRepository(wd2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//without a remote, chunks can only come from the main worktree
+	combined := bytes.NewBuffer(nil)
+	err = repo2.Combine(bytes.NewReader(pointer.Bytes()), combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(combined.Bytes(), content) {
+		t.Errorf("expected a worktree to combine chunks that were split in the main worktree")
+	}
+
+	_, err = os.Stat(filepath.Join(wd1, ".git", "worktrees", "wt", "chunks"))
+	if err == nil {
+		t.Errorf("expected the worktree not to have its own chunk directory")
 	}
 }
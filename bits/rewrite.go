@@ -0,0 +1,536 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//RewriteMapDir is the directory in the (common) git directory that holds the
+//mappings of old to new objects written by the last history rewrite
+var RewriteMapDir = "bits-rewrite"
+
+//RewriteOpts configures RewriteHistory
+type RewriteOpts struct {
+
+	//fast-export arguments that select the refs to rewrite, e.g "--branches"
+	Refs []string
+
+	//returns whether the blob at 'path' should be passed to Blob, it is
+	//called before the blob is read
+	Match func(path string) bool
+
+	//is called with the content of every blob that Match selects, of which
+	//there are 'size' bytes. New content is written to 'w', it returns false
+	//if the blob is kept as is. It is called once for each blob and path
+	Blob func(path string, size int64, r io.Reader, w io.Writer) (rewritten bool, err error)
+
+	//when set it is called with the root .gitattributes of every commit, or
+	//nil if the commit has none. It returns the new content, the file is
+	//removed if that is empty
+	Attributes func(data []byte) ([]byte, error)
+
+	//rewrite even if the working tree has uncommitted changes, they are lost
+	//as the working tree is reset to the rewritten HEAD
+	Force bool
+}
+
+//RewriteStats describes a history rewrite
+type RewriteStats struct {
+	Commits int
+
+	//old to new object ids of the blobs and commits that were rewritten
+	BlobMap   map[string]string
+	CommitMap map[string]string
+
+	//where the maps were written
+	MapDir string
+}
+
+//String formats the stats as a human readable report
+func (s RewriteStats) String() string {
+	return fmt.Sprintf("rewrote %d blob(s) in %d commit(s), object maps were written to '%s'", len(s.BlobMap), s.Commits, s.MapDir)
+}
+
+//RewriteHistory rewrites the history of the selected refs in the style of 'git
+//filter-repo': commits are exported, the blobs in them are rewritten and the
+//result is imported again, after which the refs point to the new commits and
+//the working tree is reset to the rewritten HEAD. The mappings of old to new
+//blobs and commits are written to RewriteMapDir. Remote-tracking refs and the
+//stash are never rewritten, selecting them is an error
+func (repo *Repository) RewriteHistory(opts RewriteOpts) (stats RewriteStats, err error) {
+	if !opts.Force {
+		buf := bytes.NewBuffer(nil)
+		err = repo.Git(nil, nil, buf, "status", "--porcelain", "--untracked-files=no")
+		if err != nil {
+			return stats, fmt.Errorf("failed to check working tree: %v", err)
+		}
+
+		if buf.Len() > 0 {
+			return stats, fmt.Errorf("working tree has uncommitted changes, commit or stash them first")
+		}
+	}
+
+	//refs of others are not ours to rewrite, fetching would only restore them
+	names := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, names, append([]string{"rev-parse", "--symbolic-full-name"}, opts.Refs...)...)
+	if err != nil {
+		return stats, fmt.Errorf("failed to resolve refs to rewrite: %v", err)
+	}
+
+	for _, name := range strings.Fields(names.String()) {
+		name = strings.TrimPrefix(name, "^")
+		if strings.HasPrefix(name, "refs/remotes/") || name == "refs/stash" {
+			return stats, fmt.Errorf("refusing to rewrite '%s', select the refs to rewrite with e.g '--branches --tags'", name)
+		}
+	}
+
+	stats.MapDir = filepath.Join(repo.commonDir, RewriteMapDir)
+	err = os.MkdirAll(stats.MapDir, 0777)
+	if err != nil {
+		return stats, fmt.Errorf("failed to create directory for object maps: %v", err)
+	}
+
+	marksPath := filepath.Join(stats.MapDir, "marks")
+	rw := &rewriter{repo: repo, opts: opts, stats: &stats, blobs: map[string]string{}, marks: map[string]string{}}
+	rw.stats.BlobMap = map[string]string{}
+	rw.stats.CommitMap = map[string]string{}
+
+	rw.cat, err = repo.startCatFile()
+	if err != nil {
+		return stats, err
+	}
+
+	defer rw.cat.Close()
+
+	//setup the export, import and the rewriting in between
+	args := []string{"fast-export", "--no-data", "--show-original-ids", "--reencode=no", "--signed-tags=strip", "--tag-of-filtered-object=rewrite"}
+	if opts.Attributes != nil {
+		args = append(args, "--full-tree")
+	}
+
+	export := exec.Command(repo.exe, append(args, opts.Refs...)...)
+	export.Dir = repo.rootDir
+	export.Stderr = repo.output
+	exportr, err := export.StdoutPipe()
+	if err != nil {
+		return stats, fmt.Errorf("failed to setup export: %v", err)
+	}
+
+	imp := exec.Command(repo.exe, "fast-import", "--force", "--quiet", "--export-marks="+marksPath)
+	imp.Dir = repo.rootDir
+	imp.Stderr = repo.output
+	importw, err := imp.StdinPipe()
+	if err != nil {
+		return stats, fmt.Errorf("failed to setup import: %v", err)
+	}
+
+	err = export.Start()
+	if err != nil {
+		return stats, fmt.Errorf("failed to start export: %v", err)
+	}
+
+	err = imp.Start()
+	if err != nil {
+		export.Process.Kill()
+		export.Wait()
+		return stats, fmt.Errorf("failed to start import: %v", err)
+	}
+
+	bufw := bufio.NewWriter(importw)
+	err = rw.rewrite(bufio.NewReader(exportr), bufw)
+	if err == nil {
+		err = bufw.Flush()
+	}
+
+	//an import that is cut short doesn't update any refs
+	if err != nil {
+		export.Process.Kill()
+		imp.Process.Kill()
+		export.Wait()
+		imp.Wait()
+		return stats, fmt.Errorf("failed to rewrite history: %v", err)
+	}
+
+	importw.Close()
+	err = export.Wait()
+	if err != nil {
+		imp.Process.Kill()
+		imp.Wait()
+		return stats, fmt.Errorf("failed to export history: %v", err)
+	}
+
+	err = imp.Wait()
+	if err != nil {
+		return stats, fmt.Errorf("failed to import rewritten history: %v", err)
+	}
+
+	//map original commits to the new commits through their marks
+	data, err := ioutil.ReadFile(marksPath)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read marks of imported commits: %v", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		if old, ok := rw.marks[fields[0]]; ok && old != fields[1] {
+			stats.CommitMap[old] = fields[1]
+		}
+	}
+
+	os.Remove(marksPath)
+	for name, m := range map[string]map[string]string{"blob-map": stats.BlobMap, "commit-map": stats.CommitMap} {
+		err = writeObjectMap(filepath.Join(stats.MapDir, name), m)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	//the index and working tree still hold the old HEAD
+	if stats.Commits > 0 {
+		err = repo.Git(nil, nil, nil, "reset", "--hard", "--quiet")
+		if err != nil {
+			return stats, fmt.Errorf("failed to reset working tree to the rewritten HEAD: %v", err)
+		}
+	}
+
+	return stats, nil
+}
+
+//writeObjectMap writes object map 'm' to 'p' as lines of old and new ids
+func writeObjectMap(p string, m map[string]string) (err error) {
+	olds := []string{}
+	for old := range m {
+		olds = append(olds, old)
+	}
+
+	sort.Strings(olds)
+	buf := bytes.NewBufferString("old new\n")
+	for _, old := range olds {
+		fmt.Fprintf(buf, "%s %s\n", old, m[old])
+	}
+
+	err = ioutil.WriteFile(p, buf.Bytes(), 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write object map '%s': %v", p, err)
+	}
+
+	return nil
+}
+
+//rewriter rewrites a fast-export stream
+type rewriter struct {
+	repo  *Repository
+	opts  RewriteOpts
+	stats *RewriteStats
+	cat   *catFile
+
+	//rewritten blob ids by original blob id and path
+	blobs map[string]string
+
+	//original commit ids by mark
+	marks map[string]string
+}
+
+//rewrite copies the fast-export stream from 'r' to 'w' while rewriting the
+//blobs referenced by file modifications
+func (rw *rewriter) rewrite(r *bufio.Reader, w *bufio.Writer) (err error) {
+	inCommit := false
+	hasAttrs := false
+	mark := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read export: %v", err)
+		}
+
+		switch {
+		case strings.HasPrefix(line, "data "):
+
+			//messages are copied as is, they may hold anything
+			n, err := strconv.ParseInt(strings.TrimSpace(line[5:]), 10, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected data command '%s'", strings.TrimSpace(line))
+			}
+
+			w.WriteString(line)
+			_, err = io.CopyN(w, r, n)
+			if err != nil {
+				return fmt.Errorf("failed to copy data: %v", err)
+			}
+
+			continue
+		case strings.HasPrefix(line, "commit "):
+			inCommit, hasAttrs, mark = true, false, ""
+			rw.stats.Commits++
+		case inCommit && strings.HasPrefix(line, "mark "):
+			mark = strings.TrimSpace(line[5:])
+		case inCommit && strings.HasPrefix(line, "original-oid "):
+			if mark != "" {
+				rw.marks[mark] = strings.TrimSpace(line[13:])
+			}
+		case inCommit && strings.HasPrefix(line, "M "):
+			line, err = rw.rewriteModify(line, &hasAttrs)
+			if err != nil {
+				return err
+			}
+		case inCommit && line == "\n":
+
+			//the end of a commit, add attributes it doesn't have yet
+			inCommit = false
+			if rw.opts.Attributes != nil && !hasAttrs {
+				id, err := rw.rewriteAttributes("")
+				if err != nil {
+					return err
+				}
+
+				if id != "" {
+					fmt.Fprintf(w, "M 100644 %s .gitattributes\n", id)
+				}
+			}
+		}
+
+		_, err = w.WriteString(line)
+		if err != nil {
+			return fmt.Errorf("failed to write import: %v", err)
+		}
+	}
+}
+
+//rewriteModify rewrites the blob of file modification 'line', e.g:
+//'M 100644 <id> <path>'. It returns the modification as it should be imported,
+//which is empty if the file is removed
+func (rw *rewriter) rewriteModify(line string, hasAttrs *bool) (string, error) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+	if len(fields) != 4 {
+		return "", fmt.Errorf("unexpected file modification '%s'", strings.TrimSpace(line))
+	}
+
+	//only regular files, not symlinks or submodules
+	mode, id, quoted := fields[1], fields[2], fields[3]
+	if mode != "100644" && mode != "100755" && mode != "644" && mode != "755" {
+		return line, nil
+	}
+
+	path := quoted
+	if strings.HasPrefix(quoted, `"`) {
+		var err error
+		path, err = strconv.Unquote(quoted)
+		if err != nil {
+			return "", fmt.Errorf("unexpected quoted path %s: %v", quoted, err)
+		}
+	}
+
+	newID := id
+	var err error
+	if path == ".gitattributes" && rw.opts.Attributes != nil {
+		*hasAttrs = true
+		newID, err = rw.rewriteAttributes(id)
+		if err != nil {
+			return "", err
+		}
+
+		if newID == "" {
+			return "", nil
+		}
+	} else if rw.opts.Match == nil || rw.opts.Match(path) {
+		newID, err = rw.rewriteBlob(id, path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("M %s %s %s\n", mode, newID, quoted), nil
+}
+
+//rewriteBlob passes blob 'id' at 'path' to the Blob function and returns the
+//id of the blob that replaces it
+func (rw *rewriter) rewriteBlob(id, path string) (newID string, err error) {
+	memo := id + "\x00" + path
+	if newID, ok := rw.blobs[memo]; ok {
+		return newID, nil
+	}
+
+	f, err := ioutil.TempFile(rw.stats.MapDir, ".tmp-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+	rewritten := false
+	err = rw.cat.Read(id, func(size int64, r io.Reader) (err error) {
+		rewritten, err = rw.opts.Blob(path, size, r, f)
+		return err
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("failed to rewrite blob '%s' at '%s': %v", id, path, err)
+	}
+
+	newID = id
+	if rewritten {
+		newID, err = rw.repo.writeBlob(f.Name())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if newID != id {
+		rw.stats.BlobMap[id] = newID
+	}
+
+	rw.blobs[memo] = newID
+	return newID, nil
+}
+
+//rewriteAttributes passes the attributes in blob 'id' (or none if it's empty) to
+//the Attributes function and returns the id of the blob that replaces it, or an
+//empty id if the attributes file is removed
+func (rw *rewriter) rewriteAttributes(id string) (newID string, err error) {
+	memo := id + "\x00.gitattributes"
+	if newID, ok := rw.blobs[memo]; ok {
+		return newID, nil
+	}
+
+	var data []byte
+	if id != "" {
+		err = rw.cat.Read(id, func(size int64, r io.Reader) (err error) {
+			data, err = ioutil.ReadAll(r)
+			return err
+		})
+
+		if err != nil {
+			return "", fmt.Errorf("failed to read attributes '%s': %v", id, err)
+		}
+	}
+
+	newData, err := rw.opts.Attributes(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to rewrite attributes: %v", err)
+	}
+
+	newID = id
+	if len(newData) == 0 {
+		newID = ""
+	} else if !bytes.Equal(data, newData) {
+		buf := bytes.NewBuffer(nil)
+		err = rw.repo.Git(nil, bytes.NewReader(newData), buf, "hash-object", "-w", "--no-filters", "--stdin")
+		if err != nil {
+			return "", fmt.Errorf("failed to write attributes: %v", err)
+		}
+
+		newID = strings.TrimSpace(buf.String())
+	}
+
+	if id != "" && newID != id {
+		rw.stats.BlobMap[id] = newID
+	}
+
+	rw.blobs[memo] = newID
+	return newID, nil
+}
+
+//writeBlob writes the file at 'p' to the object database without applying
+//any filters and returns the id of the blob
+func (repo *Repository) writeBlob(p string) (id string, err error) {
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, "hash-object", "-w", "--no-filters", p)
+	if err != nil {
+		return "", fmt.Errorf("failed to write blob: %v", err)
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+//catFile reads objects through a single 'git cat-file --batch' process
+type catFile struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+//startCatFile starts a process that reads objects
+func (repo *Repository) startCatFile() (cat *catFile, err error) {
+	cat = &catFile{cmd: exec.Command(repo.exe, "cat-file", "--batch")}
+	cat.cmd.Dir = repo.rootDir
+	cat.cmd.Stderr = repo.output
+	cat.in, err = cat.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup object reading: %v", err)
+	}
+
+	out, err := cat.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup object reading: %v", err)
+	}
+
+	cat.out = bufio.NewReader(out)
+	err = cat.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start object reading: %v", err)
+	}
+
+	return cat, nil
+}
+
+//Read passes the size and content of object 'id' to 'fn', content that 'fn'
+//doesn't read is skipped
+func (cat *catFile) Read(id string, fn func(size int64, r io.Reader) error) (err error) {
+	_, err = fmt.Fprintf(cat.in, "%s\n", id)
+	if err != nil {
+		return fmt.Errorf("failed to request object: %v", err)
+	}
+
+	hdr, err := cat.out.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read object header: %v", err)
+	}
+
+	fields := strings.Fields(hdr)
+	if len(fields) != 3 {
+		return fmt.Errorf("failed to read object '%s': %s", id, strings.TrimSpace(hdr))
+	}
+
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected object header '%s'", strings.TrimSpace(hdr))
+	}
+
+	lr := &io.LimitedReader{R: cat.out, N: size}
+	ferr := fn(size, lr)
+
+	//skip what wasn't read and the newline that follows the content
+	_, err = io.Copy(ioutil.Discard, lr)
+	if err == nil {
+		_, err = cat.out.Discard(1)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to skip object content: %v", err)
+	}
+
+	return ferr
+}
+
+//Close stops the process
+func (cat *catFile) Close() error {
+	cat.in.Close()
+	return cat.cmd.Wait()
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/rlmcpherson/s3gof3r"
 )
@@ -37,6 +38,14 @@ func (s3 *S3Remote) Name() string {
 
 //ListChunks will write all chunks in the bucket to writer w
 func (s *S3Remote) ListChunks(w io.Writer) (err error) {
+	return s.ListChunkInfo(func(ci ChunkInfo) error {
+		_, err := fmt.Fprintf(w, "%x\n", ci.K)
+		return err
+	})
+}
+
+//ListChunkInfo calls 'fn' for every chunk in the bucket
+func (s *S3Remote) ListChunkInfo(fn func(ChunkInfo) error) (err error) {
 
 	// <?xml version="1.0" encoding="UTF-8"?>
 	// <ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
@@ -60,7 +69,9 @@ func (s *S3Remote) ListChunks(w io.Writer) (err error) {
 		IsTruncated           bool     `xml:"IsTruncated"`
 		NextContinuationToken string   `xml:"NextContinuationToken"`
 		Contents              []struct {
-			Key string `xml:"Key"`
+			Key          string    `xml:"Key"`
+			LastModified time.Time `xml:"LastModified"`
+			Size         int64     `xml:"Size"`
 		} `xml:"Contents"`
 	}{}
 
@@ -89,15 +100,21 @@ func (s *S3Remote) ListChunks(w io.Writer) (err error) {
 		dec := xml.NewDecoder(resp.Body)
 		err = dec.Decode(&v)
 		if err != nil {
-			return fmt.Errorf("failed to decode s3 xml: %v")
+			return fmt.Errorf("failed to decode s3 xml: %v", err)
 		}
 
 		for _, obj := range v.Contents {
-			if len(obj.Key) != hex.EncodedLen(KeySize) {
+			ci := ChunkInfo{Size: obj.Size, LastModified: obj.LastModified}
+			data, err := hex.DecodeString(obj.Key)
+			if err != nil || len(data) != KeySize {
 				continue
 			}
 
-			fmt.Fprintf(w, "%s\n", obj.Key)
+			copy(ci.K[:], data)
+			err = fn(ci)
+			if err != nil {
+				return err
+			}
 		}
 
 		v.Contents = nil
@@ -123,3 +140,8 @@ func (s *S3Remote) ChunkReader(k K) (rc io.ReadCloser, err error) {
 func (s *S3Remote) ChunkWriter(k K) (wc io.WriteCloser, err error) {
 	return s.bucket.PutWriter(fmt.Sprintf("%x", k), nil, nil)
 }
+
+//DeleteChunk removes the chunk with the given key from the bucket
+func (s *S3Remote) DeleteChunk(k K) (err error) {
+	return s.bucket.Delete(fmt.Sprintf("%x", k))
+}
@@ -0,0 +1,317 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/dustin/go-humanize"
+)
+
+//StatsOpts configures what Stats reports on
+type StatsOpts struct {
+
+	//rev-list arguments that select the history to report on, e.g "HEAD"
+	Revs []string
+
+	//also report how much the remote chunk store holds, this lists every
+	//chunk it stores
+	Remote bool
+
+	//number of files in the lists of largest and most shared files
+	Top int
+}
+
+//StatsFile describes a file in a stats report
+type StatsFile struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	Chunks       int    `json:"chunks"`
+	SharedChunks int    `json:"shared_chunks"`
+	SharedBytes  int64  `json:"shared_bytes"`
+}
+
+//StatsBucket counts the chunks with a size in the range [Min, Max)
+type StatsBucket struct {
+	Min    int64 `json:"min"`
+	Max    int64 `json:"max"`
+	Chunks int   `json:"chunks"`
+	Bytes  int64 `json:"bytes"`
+}
+
+//StorageStats describes how much a chunk store holds
+type StorageStats struct {
+	Chunks int   `json:"chunks"`
+	Bytes  int64 `json:"bytes"`
+}
+
+//Stats reports how much content is stored and how well it deduplicates
+type Stats struct {
+
+	//every distinct version of every file that is stored as a pointer
+	Files        int   `json:"files"`
+	LogicalBytes int64 `json:"logical_bytes"`
+
+	//the distinct chunks those files consist of, chunks of which the size
+	//is not recorded anywhere are counted but their bytes are not
+	Chunks      int     `json:"chunks"`
+	UniqueBytes int64   `json:"unique_bytes"`
+	DedupRatio  float64 `json:"dedup_ratio"`
+
+	Histogram  []StatsBucket `json:"histogram"`
+	Largest    []StatsFile   `json:"largest"`
+	MostShared []StatsFile   `json:"most_shared"`
+
+	Local  StorageStats  `json:"local"`
+	Remote *StorageStats `json:"remote,omitempty"`
+}
+
+//Stats scans the pointers in the selected history and reports logical file
+//bytes against the bytes of the unique chunks they consist of. Manifest nodes
+//that are not available locally are fetched
+func (repo *Repository) Stats(store *bolt.DB, opts StatsOpts) (stats *Stats, err error) {
+	if opts.Remote && repo.remote == nil {
+		return nil, fmt.Errorf("no remote configured")
+	}
+
+	stats = &Stats{Histogram: []StatsBucket{}}
+	lengths := map[K]int64{}
+	paths := map[K]map[string]struct{}{}
+	files := map[string]*StatsFile{}
+	err = repo.forEachPointerBlob(opts.Revs, func(obj, path string, data []byte) error {
+		ptr, err := ReadPointer(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to read pointer '%s' at '%s', see fsck: %v", obj, path, err)
+		}
+
+		f, ok := files[path]
+		if !ok {
+			f = &StatsFile{Path: path}
+			files[path] = f
+		}
+
+		size := int64(0)
+		add := func(k K, length int64) {
+			if _, ok := lengths[k]; !ok || lengths[k] < 0 {
+				lengths[k] = length
+			}
+
+			if paths[k] == nil {
+				paths[k] = map[string]struct{}{}
+			}
+
+			paths[k][path] = struct{}{}
+
+			if length >= 0 {
+				size += length
+			}
+		}
+
+		for i, k := range ptr.Keys {
+			length := int64(-1)
+			if ptr.Lengths != nil {
+				length = ptr.Lengths[i]
+			}
+
+			if ptr.Manifest == 0 {
+				add(k, length)
+				continue
+			}
+
+			err = repo.walkManifest(ptr, k, ptr.Manifest, length, func(k K, depth int, length int64) error {
+				if depth > 0 {
+					if !repo.haveChunk(k) {
+						return repo.fetchChunk(k)
+					}
+
+					return nil
+				}
+
+				add(k, length)
+				return nil
+			})
+
+			if err != nil {
+				return fmt.Errorf("failed to read manifest of pointer '%s' at '%s': %v", obj, path, err)
+			}
+		}
+
+		if ptr.Size >= 0 {
+			size = ptr.Size
+		}
+
+		stats.Files++
+		stats.LogicalBytes += size
+		if size > f.Size {
+			f.Size = size
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	//chunks of legacy pointers don't have their length recorded
+	err = store.View(func(tx *bolt.Tx) error {
+		for k, length := range lengths {
+			if length >= 0 {
+				continue
+			}
+
+			rec, err := GetChunkRecord(tx, k)
+			if err != nil {
+				return err
+			}
+
+			if rec != nil && rec.PlainSize > 0 {
+				lengths[k] = rec.PlainSize
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk records: %v", err)
+	}
+
+	for k, length := range lengths {
+		stats.Chunks++
+		if length < 0 {
+			continue
+		}
+
+		stats.UniqueBytes += length
+		stats.Histogram = addToHistogram(stats.Histogram, length)
+		for path := range paths[k] {
+			files[path].Chunks++
+			if len(paths[k]) > 1 {
+				files[path].SharedChunks++
+				files[path].SharedBytes += length
+			}
+		}
+	}
+
+	if stats.UniqueBytes > 0 {
+		stats.DedupRatio = float64(stats.LogicalBytes) / float64(stats.UniqueBytes)
+	}
+
+	all := []StatsFile{}
+	for _, f := range files {
+		all = append(all, *f)
+	}
+
+	stats.Largest = topFiles(all, opts.Top, func(f StatsFile) int64 { return f.Size })
+	stats.MostShared = topFiles(all, opts.Top, func(f StatsFile) int64 { return f.SharedBytes })
+
+	err = repo.ForEachLocalChunk(func(k K, fi os.FileInfo) error {
+		stats.Local.Chunks++
+		stats.Local.Bytes += fi.Size()
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Remote {
+		lister, ok := repo.remote.(ChunkInfoLister)
+		if !ok {
+			return nil, fmt.Errorf("the configured remote can't describe the chunks it stores")
+		}
+
+		stats.Remote = &StorageStats{}
+		err = lister.ListChunkInfo(func(ci ChunkInfo) error {
+			stats.Remote.Chunks++
+			stats.Remote.Bytes += ci.Size
+			return nil
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to list remote chunks: %v", err)
+		}
+	}
+
+	return stats, nil
+}
+
+//addToHistogram counts a chunk of 'size' bytes in the power of two bucket
+//that holds it, buckets are created as needed and kept in order
+func addToHistogram(hist []StatsBucket, size int64) []StatsBucket {
+	min := int64(0)
+	max := int64(1)
+	for max <= size {
+		min = max
+		max *= 2
+	}
+
+	i := sort.Search(len(hist), func(i int) bool { return hist[i].Min >= min })
+	if i == len(hist) || hist[i].Min != min {
+		hist = append(hist, StatsBucket{})
+		copy(hist[i+1:], hist[i:])
+		hist[i] = StatsBucket{Min: min, Max: max}
+	}
+
+	hist[i].Chunks++
+	hist[i].Bytes += size
+	return hist
+}
+
+//topFiles returns at most 'n' files with the highest non-zero value of 'fn'
+func topFiles(files []StatsFile, n int, fn func(f StatsFile) int64) (top []StatsFile) {
+	sort.Slice(files, func(i, j int) bool {
+		if fn(files[i]) == fn(files[j]) {
+			return files[i].Path < files[j].Path
+		}
+
+		return fn(files[i]) > fn(files[j])
+	})
+
+	top = []StatsFile{}
+	for _, f := range files {
+		if len(top) >= n || fn(f) == 0 {
+			break
+		}
+
+		top = append(top, f)
+	}
+
+	return top
+}
+
+//WriteText writes the stats as a human readable report to 'w'
+func (stats *Stats) WriteText(w io.Writer) {
+	b := func(n int64) string { return humanize.IBytes(uint64(n)) }
+	fmt.Fprintf(w, "files:        %d versions, %s\n", stats.Files, b(stats.LogicalBytes))
+	fmt.Fprintf(w, "chunks:       %d unique, %s\n", stats.Chunks, b(stats.UniqueBytes))
+	saved := stats.LogicalBytes - stats.UniqueBytes
+	if saved < 0 {
+		saved = 0
+	}
+
+	fmt.Fprintf(w, "dedup ratio:  %.2fx (saves %s)\n", stats.DedupRatio, b(saved))
+	fmt.Fprintf(w, "local store:  %d chunks, %s\n", stats.Local.Chunks, b(stats.Local.Bytes))
+	if stats.Remote != nil {
+		fmt.Fprintf(w, "remote store: %d chunks, %s\n", stats.Remote.Chunks, b(stats.Remote.Bytes))
+	}
+
+	fmt.Fprintf(w, "\nchunk sizes:\n")
+	for _, bucket := range stats.Histogram {
+		fmt.Fprintf(w, "  %10s - %-10s %8d chunks %10s\n", b(bucket.Min), b(bucket.Max), bucket.Chunks, b(bucket.Bytes))
+	}
+
+	fmt.Fprintf(w, "\nlargest files:\n")
+	for _, f := range stats.Largest {
+		fmt.Fprintf(w, "  %10s  %s\n", b(f.Size), f.Path)
+	}
+
+	fmt.Fprintf(w, "\nfiles that share the most chunks:\n")
+	for _, f := range stats.MostShared {
+		fmt.Fprintf(w, "  %10s  %d of %d chunks  %s\n", b(f.SharedBytes), f.SharedChunks, f.Chunks, f.Path)
+	}
+}
@@ -0,0 +1,107 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestStats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"bits.chunker":        "fixed",
+		"bits.chunk-min-size": "512KiB",
+		"bits.chunk-avg-size": "512KiB",
+		"bits.chunk-max-size": "512KiB",
+	})
+
+	repo1, err := bits.NewRepository(wd1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		_, err := rand.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return data
+	}
+
+	//the second file appends to the first and shares all of its chunks
+	a := random(2 * 512 * 1024)
+	files := map[string][]byte{
+		"a.bin": a,
+		"b.bin": append(append([]byte{}, a...), random(512*1024)...),
+		"c.bin": random(512 * 1024),
+	}
+
+	for name, content := range files {
+		pointer := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), pointer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(wd1, name), pointer.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := repo1.Stats(store1, bits.StatsOpts{Revs: []string{"HEAD"}, Top: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Files != 3 || stats.LogicalBytes != 6*512*1024 {
+		t.Errorf("expected 3 files of 3MiB in total, got: %d files of %d bytes", stats.Files, stats.LogicalBytes)
+	}
+
+	if stats.Chunks != 4 || stats.UniqueBytes != 4*512*1024 || stats.DedupRatio != 1.5 {
+		t.Errorf("expected 4 unique chunks and a dedup ratio of 1.5, got: %+v", stats)
+	}
+
+	if len(stats.Histogram) != 1 || stats.Histogram[0].Chunks != 4 || stats.Histogram[0].Min != 512*1024 {
+		t.Errorf("expected all chunks in a single histogram bucket, got: %+v", stats.Histogram)
+	}
+
+	if len(stats.Largest) != 2 || stats.Largest[0].Path != "b.bin" || stats.Largest[1].Path != "a.bin" {
+		t.Errorf("expected the two largest files to be listed, got: %+v", stats.Largest)
+	}
+
+	if len(stats.MostShared) != 2 || stats.MostShared[0].SharedChunks != 2 || stats.MostShared[0].Path != "a.bin" {
+		t.Errorf("expected only the files that share chunks to be listed, got: %+v", stats.MostShared)
+	}
+
+	if stats.Local.Chunks < stats.Chunks || stats.Remote != nil {
+		t.Errorf("expected local storage totals only, got: %+v", stats)
+	}
+}
@@ -0,0 +1,337 @@
+package bits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//StatusMaterialized is the working tree state of files that hold their
+	//original content
+	StatusMaterialized = "materialized"
+
+	//StatusPointer is the working tree state of files that hold a pointer,
+	//e.g because their chunks couldn't be fetched when they were checked out
+	StatusPointer = "pointer"
+
+	//StatusDeleted is the working tree state of files that don't exist
+	StatusDeleted = "deleted"
+
+	//StatusLocal describes files of which every chunk is stored locally
+	StatusLocal = "local"
+
+	//StatusPartial describes files of which some chunks are stored locally
+	//and the others remotely
+	StatusPartial = "partial"
+
+	//StatusRemote describes files of which every chunk is stored remotely only
+	StatusRemote = "remote"
+
+	//StatusMissing describes files of which some chunks are stored nowhere,
+	//which is only known when the remote is consulted
+	StatusMissing = "missing"
+
+	//StatusUnverified describes files of which some chunks are not stored
+	//locally and not known to be stored remotely, e.g in a fresh clone
+	StatusUnverified = "unverified"
+
+	//StatusUnsplit describes files that are stored in git as is, e.g because
+	//they are smaller than the minimum size
+	StatusUnsplit = "unsplit"
+)
+
+//FileStatus describes a file in the index that uses the bits filter
+type FileStatus struct {
+	Path string `json:"path"`
+
+	//state of the working tree file and whether it differs from the index
+	Worktree string `json:"worktree"`
+	Modified bool   `json:"modified"`
+
+	//state of the chunks of the staged pointer
+	State string `json:"state"`
+
+	//size of the original file, -1 if the pointer doesn't record it
+	Size int64 `json:"size"`
+
+	//number of chunks of the staged pointer, and how many of them are
+	//stored locally, remotely only, nowhere, neither locally nor known to be
+	//stored remotely and not pushed to the default remote. Chunks below
+	//manifest nodes that are not stored locally are not counted
+	Chunks     int `json:"chunks"`
+	Local      int `json:"local"`
+	Remote     int `json:"remote"`
+	Missing    int `json:"missing"`
+	Unverified int `json:"unverified"`
+	Unpushed   int `json:"unpushed"`
+}
+
+//StatusOpts configures Status
+type StatusOpts struct {
+
+	//pathspecs that limit the files that are described, all files if empty
+	Paths []string
+
+	//list the chunks that the remote stores, such that chunks that are not
+	//stored locally are known to be stored remotely or missing
+	Remote bool
+}
+
+//String formats the status as a tab separated line
+func (s FileStatus) String() string {
+	modified := "-"
+	if s.Modified {
+		modified = "modified"
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s", s.Worktree, modified, s.State, s.Chunks, s.Local, s.Remote, s.Missing, s.Unpushed, s.Path)
+}
+
+//Status describes every file in the index that uses the bits filter, or only
+//those matched by the pathspecs in the options. It combines what git knows about
+//the files with the chunks that are stored locally and the chunk records in the
+//local store, nothing is fetched. Chunks that are neither are unverified unless
+//the remote is listed
+func (repo *Repository) Status(store *bolt.DB, opts StatusOpts) (status []FileStatus, err error) {
+	var listed map[K]struct{}
+	if opts.Remote {
+		if repo.remote == nil {
+			return nil, fmt.Errorf("no remote configured")
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err = repo.remote.ListChunks(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list remote chunks: %v", err)
+		}
+
+		listed = map[K]struct{}{}
+		err = repo.ForEach(buf, func(k K) error {
+			listed[k] = struct{}{}
+			return nil
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remote chunk list: %v", err)
+		}
+	}
+
+	paths := opts.Paths
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, buf, append([]string{"ls-files", "-s", "-z", "--"}, paths...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	//regular files only, conflicted files are listed once
+	blobs := map[string]string{}
+	order := []string{}
+	for _, entry := range strings.Split(buf.String(), "\x00") {
+		tab := strings.Index(entry, "\t")
+		if tab < 0 {
+			continue
+		}
+
+		fields := strings.Fields(entry[:tab])
+		path := entry[tab+1:]
+		if len(fields) != 3 || (fields[0] != "100644" && fields[0] != "100755") {
+			continue
+		}
+
+		if _, ok := blobs[path]; !ok {
+			order = append(order, path)
+		}
+
+		blobs[path] = fields[1]
+	}
+
+	tracked, err := repo.filteredPaths(order)
+	if err != nil {
+		return nil, err
+	}
+
+	buf.Reset()
+	err = repo.Git(nil, nil, buf, append([]string{"ls-files", "-m", "-z", "--"}, paths...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list modified files: %v", err)
+	}
+
+	modified := map[string]struct{}{}
+	for _, path := range strings.Split(buf.String(), "\x00") {
+		modified[path] = struct{}{}
+	}
+
+	cat, err := repo.startCatFile()
+	if err != nil {
+		return nil, err
+	}
+
+	defer cat.Close()
+	status = []FileStatus{}
+	for _, path := range order {
+		if _, ok := tracked[path]; !ok {
+			continue
+		}
+
+		s := FileStatus{Path: path, Size: -1}
+		_, s.Modified = modified[path]
+		s.Worktree, err = repo.worktreeState(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var ptr *Pointer
+		err = cat.Read(blobs[path], func(size int64, r io.Reader) error {
+			if size == 0 || size%int64(LineWidth+1) != 0 {
+				return nil
+			}
+
+			data, err := ioutil.ReadAll(r)
+			if err != nil || !IsPointer(data) {
+				return err
+			}
+
+			ptr, err = ReadPointer(bytes.NewReader(data))
+			return err
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read staged blob of '%s': %v", path, err)
+		}
+
+		s.State = StatusUnsplit
+		if ptr != nil {
+			err = repo.chunkStatus(store, ptr, listed, &s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check chunks of '%s': %v", path, err)
+			}
+		}
+
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+//filteredPaths returns which of 'paths' use the bits filter
+func (repo *Repository) filteredPaths(paths []string) (filtered map[string]struct{}, err error) {
+	filtered = map[string]struct{}{}
+	if len(paths) == 0 {
+		return filtered, nil
+	}
+
+	in := bytes.NewBufferString(strings.Join(paths, "\x00") + "\x00")
+	out := bytes.NewBuffer(nil)
+	err = repo.Git(nil, in, out, "check-attr", "-z", "--stdin", "filter")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check attributes: %v", err)
+	}
+
+	//output is a sequence of: <path> NUL <attribute> NUL <value> NUL
+	fields := strings.Split(out.String(), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == "bits" {
+			filtered[fields[i]] = struct{}{}
+		}
+	}
+
+	return filtered, nil
+}
+
+//worktreeState returns whether the working tree file at 'path' holds its
+//original content, a pointer or doesn't exist
+func (repo *Repository) worktreeState(path string) (state string, err error) {
+	f, err := os.Open(filepath.Join(repo.rootDir, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return StatusDeleted, nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s': %v", path, err)
+	}
+
+	defer f.Close()
+	hdr := make([]byte, LineWidth+1)
+	n, err := io.ReadFull(f, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to read '%s': %v", path, err)
+	}
+
+	if HoldsKeys(hdr[:n]) {
+		return StatusPointer, nil
+	}
+
+	return StatusMaterialized, nil
+}
+
+//chunkStatus counts where the chunks of pointer 'ptr' are stored, manifest
+//nodes that are stored locally are walked but nothing is fetched. If 'listed'
+//holds the chunks the remote stores, it decides which chunks are missing
+func (repo *Repository) chunkStatus(store *bolt.DB, ptr *Pointer, listed map[K]struct{}, s *FileStatus) (err error) {
+	s.Size = ptr.Size
+	err = store.View(func(tx *bolt.Tx) error {
+		for _, k := range ptr.Keys {
+			err := repo.walkManifest(ptr, k, ptr.Manifest, -1, func(k K, depth int, length int64) error {
+				rec, err := GetChunkRecord(tx, k)
+				if err != nil {
+					return err
+				}
+
+				s.Chunks++
+				pushed := rec != nil && rec.HasRemote(DefaultRemoteName)
+				if !pushed {
+					s.Unpushed++
+				}
+
+				if repo.haveChunk(k) {
+					s.Local++
+					return nil
+				}
+
+				_, stored := listed[k]
+				switch {
+				case listed != nil && stored, listed == nil && pushed:
+					s.Remote++
+				case listed != nil:
+					s.Missing++
+				default:
+					s.Unverified++
+				}
+
+				return errSkipNode
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case s.Missing > 0:
+		s.State = StatusMissing
+	case s.Unverified > 0:
+		s.State = StatusUnverified
+	case s.Local == s.Chunks:
+		s.State = StatusLocal
+	case s.Local == 0:
+		s.State = StatusRemote
+	default:
+		s.State = StatusPartial
+	}
+
+	return nil
+}
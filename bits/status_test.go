@@ -0,0 +1,152 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	chunks := newMemRemote()
+	repo1.SetRemote(chunks)
+
+	write := func(name string, data []byte) {
+		err := ioutil.WriteFile(filepath.Join(wd1, name), data, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	split := func() (pointer []byte, ptr *bits.Pointer) {
+		content := make([]byte, 1024*1024)
+		_, err := rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err = repo1.Split(bytes.NewReader(content), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ptr, err = bits.ReadPointer(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.Bytes(), ptr
+	}
+
+	forget := func(ptr *bits.Pointer) {
+		for _, k := range ptr.Keys {
+			p, _ := repo1.Path(k, false)
+			os.Remove(p)
+		}
+	}
+
+	write(".gitattributes", []byte("*.bin filter=bits\n"))
+	write("other.txt", []byte("not tracked by bits\n"))
+	local, _ := split()
+	write("local.bin", local)
+	write("unsplit.bin", []byte("small\n"))
+
+	remote, remotePtr := split()
+	write("remote.bin", remote)
+	err = repo1.Push(store1, bytes.NewReader(remote), "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forget(remotePtr)
+	missing, missingPtr := split()
+	write("missing.bin", missing)
+	forget(missingPtr)
+
+	err = repo1.SaveChunkRecords(store1)
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "add", "-A")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("local.bin", []byte("modified\n"))
+	os.Remove(filepath.Join(wd1, "missing.bin"))
+
+	status, err := repo1.Status(store1, bits.StatusOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bits.FileStatus{
+		"local.bin":   {Worktree: bits.StatusMaterialized, Modified: true, State: bits.StatusLocal},
+		"missing.bin": {Worktree: bits.StatusDeleted, Modified: true, State: bits.StatusUnverified},
+		"remote.bin":  {Worktree: bits.StatusPointer, State: bits.StatusRemote},
+		"unsplit.bin": {Worktree: bits.StatusMaterialized, State: bits.StatusUnsplit},
+	}
+
+	if len(status) != len(expected) {
+		t.Errorf("expected only files that use the bits filter, got: %v", status)
+	}
+
+	for _, s := range status {
+		e := expected[s.Path]
+		if s.Worktree != e.Worktree || s.Modified != e.Modified || s.State != e.State {
+			t.Errorf("expected status of '%s' to be %v, got: %v", s.Path, e, s)
+		}
+
+		switch s.Path {
+		case "local.bin":
+			if s.Chunks < 1 || s.Local != s.Chunks || s.Unpushed != s.Chunks || s.Size != 1024*1024 {
+				t.Errorf("expected every chunk of '%s' to be local and unpushed, got: %v", s.Path, s)
+			}
+		case "remote.bin":
+			if s.Remote != s.Chunks || s.Unpushed != 0 {
+				t.Errorf("expected every chunk of '%s' to be remote only, got: %v", s.Path, s)
+			}
+		}
+	}
+
+	status, err = repo1.Status(store1, bits.StatusOpts{Paths: []string{"remote.bin"}})
+	if err != nil || len(status) != 1 {
+		t.Errorf("expected status to be limited to the given paths, got: %v, %v", status, err)
+	}
+
+	status, err = repo1.Status(store1, bits.StatusOpts{Paths: []string{"missing.bin", "remote.bin"}, Remote: true})
+	if err != nil || len(status) != 2 {
+		t.Fatalf("expected status of two files, got: %v, %v", status, err)
+	}
+
+	for _, s := range status {
+		switch s.Path {
+		case "missing.bin":
+			if s.State != bits.StatusMissing || s.Missing != s.Chunks || s.Unverified != 0 {
+				t.Errorf("expected chunks that the remote doesn't list to be missing, got: %v", s)
+			}
+		case "remote.bin":
+			if s.State != bits.StatusRemote || s.Remote != s.Chunks {
+				t.Errorf("expected chunks that the remote lists to be remote, got: %v", s)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package bits
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	//ChunkBucket holds a ChunkRecord for every chunk that is known to the
+	//local store, whether it is stored locally, remotely or both
+	ChunkBucket = []byte("chunks")
+
+	//MetaBucket holds information about the local store itself
+	MetaBucket = []byte("meta")
+
+	//SchemaVersionKey is the key in the meta bucket that holds the version
+	//of the layout of the local store
+	SchemaVersionKey = []byte("schema-version")
+)
+
+//StoreSchemaVersion is the layout of the local store that is written by this
+//version, stores with an older layout are migrated when they are opened:
+// 1: an 'index' bucket with the chunks stored remotely and an 'access' bucket
+//    with the time each chunk was last accessed
+// 2: a ChunkRecord for each chunk in the chunk bucket
+var StoreSchemaVersion = 2
+
+//ChunkRecord holds what is known about a single chunk
+type ChunkRecord struct {
+
+	//size of the chunk content, zero if it is not known
+	PlainSize int64 `json:"plain_size"`
+
+	//size of the encrypted chunk as it is stored, zero if it is not known
+	CipherSize int64 `json:"cipher_size"`
+
+	//when the chunk was staged by this repository, zero if it was fetched
+	Staged time.Time `json:"staged"`
+
+	//when the chunk was last accessed locally
+	Accessed time.Time `json:"accessed"`
+
+	//names of the remotes that are known to store the chunk
+	Remotes []string `json:"remotes"`
+
+	//number of distinct pointers and manifest nodes in the history that gc
+	//considers live that reference the chunk, as counted by the last gc. It
+	//is only ever set by gc, zero means unreferenced or not yet counted
+	Refs int `json:"refs"`
+}
+
+//HasRemote returns whether the chunk is known to be stored by remote 'name'
+func (rec *ChunkRecord) HasRemote(name string) bool {
+	for _, r := range rec.Remotes {
+		if r == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+//SetRemote records whether the chunk is stored by remote 'name'
+func (rec *ChunkRecord) SetRemote(name string, stored bool) {
+	remotes := []string{}
+	for _, r := range rec.Remotes {
+		if r != name {
+			remotes = append(remotes, r)
+		}
+	}
+
+	if stored {
+		remotes = append(remotes, name)
+	}
+
+	rec.Remotes = remotes
+}
+
+//GetChunkRecord returns the record of chunk 'k', it returns nil if there is
+//no record of the chunk
+func GetChunkRecord(tx *bolt.Tx, k K) (rec *ChunkRecord, err error) {
+	data := tx.Bucket(ChunkBucket).Get(k[:])
+	if data == nil {
+		return nil, nil
+	}
+
+	rec = &ChunkRecord{}
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode record of chunk '%x': %v", k, err)
+	}
+
+	return rec, nil
+}
+
+//PutChunkRecord writes the record of chunk 'k'
+func PutChunkRecord(tx *bolt.Tx, k K, rec *ChunkRecord) (err error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode record of chunk '%x': %v", k, err)
+	}
+
+	return tx.Bucket(ChunkBucket).Put(k[:], data)
+}
+
+//ForEachChunkRecord calls 'fn' for the record of every chunk in the local
+//store, 'fn' must not modify the store
+func ForEachChunkRecord(tx *bolt.Tx, fn func(k K, rec *ChunkRecord) error) (err error) {
+	return tx.Bucket(ChunkBucket).ForEach(func(key, data []byte) error {
+		k := K{}
+		if len(key) != KeySize {
+			return nil //not a chunk
+		}
+
+		copy(k[:], key)
+		rec := &ChunkRecord{}
+		err := json.Unmarshal(data, rec)
+		if err != nil {
+			return fmt.Errorf("failed to decode record of chunk '%x': %v", k, err)
+		}
+
+		return fn(k, rec)
+	})
+}
+
+//updateChunkRecord passes the record of chunk 'k' to 'fn', or an empty record
+//if there is none. The record is written afterwards if 'fn' returns true, and
+//removed otherwise
+func updateChunkRecord(tx *bolt.Tx, k K, fn func(rec *ChunkRecord) bool) (err error) {
+	rec, err := GetChunkRecord(tx, k)
+	if err != nil {
+		return err
+	}
+
+	if rec == nil {
+		rec = &ChunkRecord{}
+	}
+
+	if !fn(rec) {
+		return tx.Bucket(ChunkBucket).Delete(k[:])
+	}
+
+	return PutChunkRecord(tx, k, rec)
+}
+
+//forgetLocalChunk updates the record of chunk 'k' after it was removed from
+//local storage, it is only kept if a remote still stores the chunk
+func forgetLocalChunk(tx *bolt.Tx, k K) error {
+	return updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+		rec.Accessed = time.Time{}
+		return len(rec.Remotes) > 0
+	})
+}
+
+//chunkUpdate holds what was learned about a chunk since the records in the
+//local store were last written
+type chunkUpdate struct {
+	accessed   time.Time
+	staged     time.Time
+	plainSize  int64
+	cipherSize int64
+
+	//whether the chunk was fetched from the default remote, which means
+	//that it stores the chunk
+	fetched bool
+}
+
+//update applies 'fn' to the pending update of chunk 'k'
+func (repo *Repository) update(k K, fn func(u *chunkUpdate)) {
+	repo.pendingMu.Lock()
+	defer repo.pendingMu.Unlock()
+	u, ok := repo.pending[k]
+	if !ok {
+		u = &chunkUpdate{}
+		repo.pending[k] = u
+	}
+
+	fn(u)
+}
+
+//touch remembers that local chunk 'k' was accessed just now
+func (repo *Repository) touch(k K) {
+	repo.update(k, func(u *chunkUpdate) { u.accessed = time.Now() })
+}
+
+//SaveChunkRecords writes what this repository learned about chunks, e.g
+//when they were accessed, to the records in the local store
+func (repo *Repository) SaveChunkRecords(store *bolt.DB) (err error) {
+	repo.pendingMu.Lock()
+	defer repo.pendingMu.Unlock()
+	if len(repo.pending) == 0 {
+		return nil
+	}
+
+	err = store.Update(func(tx *bolt.Tx) error {
+		for k, u := range repo.pending {
+			err := updateChunkRecord(tx, k, func(rec *ChunkRecord) bool {
+				if u.accessed.After(rec.Accessed) {
+					rec.Accessed = u.accessed
+				}
+
+				if rec.Staged.IsZero() {
+					rec.Staged = u.staged
+				}
+
+				if u.plainSize > 0 {
+					rec.PlainSize = u.plainSize
+				}
+
+				if u.cipherSize > 0 {
+					rec.CipherSize = u.cipherSize
+				}
+
+				if u.fetched {
+					rec.SetRemote(DefaultRemoteName, true)
+				}
+
+				return true
+			})
+
+			if err != nil {
+				return fmt.Errorf("failed to update record of chunk '%x': %v", k, err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to save chunk records: %v", err)
+	}
+
+	repo.pending = map[K]*chunkUpdate{}
+	return nil
+}
+
+//RecordTimeout is how long recording chunks waits for other processes that
+//have the local store open, it is short as filters record chunks for every
+//file that is staged or checked out
+var RecordTimeout = 200 * time.Millisecond
+
+//RecordChunks is like SaveChunkRecords but opens the local store itself,
+//it does nothing if there is nothing to record
+func (repo *Repository) RecordChunks() (err error) {
+	repo.pendingMu.Lock()
+	n := len(repo.pending)
+	repo.pendingMu.Unlock()
+	if n == 0 {
+		return nil
+	}
+
+	store, err := repo.openLocalStore(RecordTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer store.Close()
+	return repo.SaveChunkRecords(store)
+}
+
+//migrateStore brings the layout of the local store up to date
+func (repo *Repository) migrateStore(tx *bolt.Tx) (err error) {
+	meta, err := tx.CreateBucketIfNotExists(MetaBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket '%s': %v", MetaBucket, err)
+	}
+
+	version := 1
+	if data := meta.Get(SchemaVersionKey); data != nil {
+		version, err = strconv.Atoi(string(data))
+		if err != nil {
+			return fmt.Errorf("unexpected schema version '%s'", data)
+		}
+	}
+
+	if version > StoreSchemaVersion {
+		return fmt.Errorf("local store has schema version %d while this version of git-bits supports up to %d, please upgrade", version, StoreSchemaVersion)
+	}
+
+	_, err = tx.CreateBucketIfNotExists(ChunkBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create bucket '%s': %v", ChunkBucket, err)
+	}
+
+	if version < 2 {
+		err = repo.migrateStoreV2(tx)
+		if err != nil {
+			return fmt.Errorf("failed to migrate to schema version 2: %v", err)
+		}
+	}
+
+	return meta.Put(SchemaVersionKey, []byte(strconv.Itoa(StoreSchemaVersion)))
+}
+
+//migrateStoreV2 turns the index and access buckets into chunk records, local
+//chunks are recorded with the size of their file
+func (repo *Repository) migrateStoreV2(tx *bolt.Tx) (err error) {
+	recs := map[K]*ChunkRecord{}
+	get := func(key []byte) *ChunkRecord {
+		k := K{}
+		copy(k[:], key)
+		if _, ok := recs[k]; !ok {
+			recs[k] = &ChunkRecord{}
+		}
+
+		return recs[k]
+	}
+
+	//the index only ever held chunks of the default remote
+	if b := tx.Bucket(IndexBucket); b != nil {
+		err = b.ForEach(func(key, v []byte) error {
+			if len(key) == KeySize {
+				get(key).SetRemote(DefaultRemoteName, true)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if b := tx.Bucket(AccessBucket); b != nil {
+		err = b.ForEach(func(key, v []byte) error {
+			if len(key) == KeySize && len(v) == 8 {
+				get(key).Accessed = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = repo.ForEachLocalChunk(func(k K, fi os.FileInfo) error {
+		get(k[:]).CipherSize = fi.Size()
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for k, rec := range recs {
+		err = PutChunkRecord(tx, k, rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range [][]byte{IndexBucket, AccessBucket} {
+		if tx.Bucket(name) != nil {
+			err = tx.DeleteBucket(name)
+			if err != nil {
+				return fmt.Errorf("failed to remove bucket '%s': %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestChunkRecords(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+
+	//a store with the first schema version only holds an index and access times
+	accessed := time.Now().Add(-time.Hour)
+	remoteOnly := bits.K{0x01}
+	db, err := bolt.Open(filepath.Join(wd1, ".git", "chunks", "a.chunks"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		index, err := tx.CreateBucket(bits.IndexBucket)
+		if err != nil {
+			return err
+		}
+
+		access, err := tx.CreateBucket(bits.AccessBucket)
+		if err != nil {
+			return err
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(accessed.UnixNano()))
+		err = access.Put(remoteOnly[:], v)
+		if err != nil {
+			return err
+		}
+
+		return index.Put(remoteOnly[:], []byte{})
+	})
+
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 1024)
+	_, err = rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pointer := bytes.NewBuffer(nil)
+	err = repo1.Split(bytes.NewReader(content), pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr, err := bits.ReadPointer(bytes.NewReader(pointer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store1, err := repo1.LocalStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store1.Close()
+	records := func() (recs map[bits.K]bits.ChunkRecord) {
+		recs = map[bits.K]bits.ChunkRecord{}
+		err := store1.View(func(tx *bolt.Tx) error {
+			if tx.Bucket(bits.IndexBucket) != nil || tx.Bucket(bits.AccessBucket) != nil {
+				t.Errorf("expected buckets of the first schema version to be removed")
+			}
+
+			if v := string(tx.Bucket(bits.MetaBucket).Get(bits.SchemaVersionKey)); v != "2" {
+				t.Errorf("expected schema version 2, got: '%s'", v)
+			}
+
+			return bits.ForEachChunkRecord(tx, func(k bits.K, rec *bits.ChunkRecord) error {
+				recs[k] = *rec
+				return nil
+			})
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return recs
+	}
+
+	recs := records()
+	if rec := recs[remoteOnly]; !rec.HasRemote("origin") || !rec.Accessed.Equal(accessed) {
+		t.Errorf("expected the index and access time to be migrated, got: %+v", rec)
+	}
+
+	p, _ := repo1.Path(ptr.Keys[0], false)
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := recs[ptr.Keys[0]]; rec.CipherSize != fi.Size() || rec.PlainSize != 0 {
+		t.Errorf("expected a local chunk to be migrated with the size of its file, got: %+v", rec)
+	}
+
+	//what was learned while splitting is saved
+	err = repo1.SaveChunkRecords(store1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := records()[ptr.Keys[0]]
+	if rec.PlainSize != int64(len(content)) || rec.Staged.IsZero() || rec.Accessed.IsZero() || rec.Refs != 0 || len(rec.Remotes) != 0 {
+		t.Errorf("expected the split chunk to be recorded, got: %+v", rec)
+	}
+
+	chunks := newMemRemote()
+	repo1.SetRemote(chunks)
+	err = repo1.Push(store1, bytes.NewReader(pointer.Bytes()), "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs = records()
+	if rec = recs[ptr.Keys[0]]; !rec.HasRemote("origin") {
+		t.Errorf("expected the pushed chunk to be recorded as stored remotely")
+	}
+
+	if _, ok := recs[remoteOnly]; ok {
+		t.Errorf("expected the record of a chunk that is no longer stored anywhere to be removed")
+	}
+
+	//garbage collection recounts references
+	err = ioutil.WriteFile(filepath.Join(wd1, "a.bin"), pointer.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(wd1, "b.bin"), pointer.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err == nil {
+		err = repo1.Git(ctx, nil, nil, "commit", "-m", "c0")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo1.GC(store1, bits.GCOpts{}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := records()[ptr.Keys[0]]; rec.Refs != 1 {
+		t.Errorf("expected a pointer blob that is committed twice to count once, got: %+v", rec)
+	}
+}
@@ -0,0 +1,274 @@
+package bits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//AttributesFile is the file in the root of the working tree that is edited
+//to mark which files use the bits filter
+var AttributesFile = ".gitattributes"
+
+//TrackAttribute is the attribute that makes files use the bits filter
+var TrackAttribute = "filter=bits"
+
+//CommonBinaryPatterns are patterns of file types that are usually large and
+//don't diff well, install offers to track them
+var CommonBinaryPatterns = []string{
+	"*.bin", "*.dat", "*.iso", "*.img",
+	"*.zip", "*.gz", "*.tgz", "*.bz2", "*.xz", "*.7z", "*.tar",
+	"*.psd", "*.tif", "*.tiff", "*.exr",
+	"*.mp3", "*.wav", "*.flac", "*.mp4", "*.mov", "*.avi", "*.mkv",
+	"*.h5", "*.hdf5", "*.npy", "*.npz", "*.parquet", "*.pt", "*.onnx",
+}
+
+//attrLine splits a line of a gitattributes file into its pattern and
+//attributes, the pattern is empty for blank lines and comments
+func attrLine(line string) (pattern string, attrs []string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return "", nil
+	}
+
+	return fields[0], fields[1:]
+}
+
+//isFilterAttr returns whether 'attr' sets, unsets or unspecifies the filter
+func isFilterAttr(attr string) bool {
+	return strings.TrimLeft(attr, "-!") == "filter" || strings.HasPrefix(attr, "filter=")
+}
+
+//TrackedPatterns returns the patterns that gitattributes content 'data' marks
+//with the bits filter, in the order they appear
+func TrackedPatterns(data []byte) (patterns []string) {
+	patterns = []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		pattern, attrs := attrLine(line)
+		for _, attr := range attrs {
+			if attr == TrackAttribute {
+				patterns = append(patterns, pattern)
+				break
+			}
+		}
+	}
+
+	return patterns
+}
+
+//TrackPatterns returns gitattributes content 'data' such that each of the
+//patterns is marked with the bits filter and the patterns that weren't marked
+//yet. A line for the exact pattern gets its filter replaced, otherwise a line
+//is appended. Patterns that are already marked are left as is
+func TrackPatterns(data []byte, patterns []string) (out []byte, added []string) {
+	lines := strings.Split(string(data), "\n")
+	if len(data) == 0 {
+		lines = []string{}
+	} else if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	added = []string{}
+	tracked := map[string]struct{}{}
+	for _, p := range TrackedPatterns(data) {
+		tracked[p] = struct{}{}
+	}
+
+	for _, p := range patterns {
+		if _, ok := tracked[p]; ok {
+			continue
+		}
+
+		tracked[p] = struct{}{}
+		added = append(added, p)
+
+		//the last line for the pattern takes precedence, so that is changed
+		replaced := false
+		for i := len(lines) - 1; i >= 0; i-- {
+			pattern, attrs := attrLine(lines[i])
+			if pattern != p {
+				continue
+			}
+
+			fields := []string{pattern}
+			for _, attr := range attrs {
+				if !isFilterAttr(attr) {
+					fields = append(fields, attr)
+				}
+			}
+
+			lines[i] = strings.Join(append(fields, TrackAttribute), " ")
+			replaced = true
+			break
+		}
+
+		if !replaced {
+			lines = append(lines, p+" "+TrackAttribute)
+		}
+	}
+
+	if len(lines) == 0 {
+		return []byte{}, added
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), added
+}
+
+//UntrackPatterns returns gitattributes content 'data' without the bits filter
+//for each of the patterns and the patterns it was removed from. Other attributes
+//on the same line are kept, lines without any attributes left are removed
+func UntrackPatterns(data []byte, patterns []string) (out []byte, removed []string) {
+	untrack := map[string]struct{}{}
+	for _, p := range patterns {
+		untrack[p] = struct{}{}
+	}
+
+	removed = []string{}
+	seen := map[string]struct{}{}
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		pattern, attrs := attrLine(line)
+		if _, ok := untrack[pattern]; !ok {
+			lines = append(lines, line)
+			continue
+		}
+
+		fields := []string{pattern}
+		for _, attr := range attrs {
+			if attr != TrackAttribute {
+				fields = append(fields, attr)
+			}
+		}
+
+		if len(fields) == len(attrs)+1 {
+			lines = append(lines, line)
+			continue
+		}
+
+		if _, ok := seen[pattern]; !ok {
+			seen[pattern] = struct{}{}
+			removed = append(removed, pattern)
+		}
+
+		if len(fields) > 1 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n")), removed
+}
+
+//readAttributes returns the content of the attributes file in the root of the
+//working tree, which is empty if it doesn't exist
+func (repo *Repository) readAttributes() (data []byte, err error) {
+	data, err = ioutil.ReadFile(filepath.Join(repo.rootDir, AttributesFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read '%s': %v", AttributesFile, err)
+	}
+
+	return data, nil
+}
+
+//writeAttributes replaces the content of the attributes file in the root of
+//the working tree
+func (repo *Repository) writeAttributes(data []byte) (err error) {
+	err = ioutil.WriteFile(filepath.Join(repo.rootDir, AttributesFile), data, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write '%s': %v", AttributesFile, err)
+	}
+
+	return nil
+}
+
+//Tracked returns the patterns that the attributes file in the root of the
+//working tree marks with the bits filter
+func (repo *Repository) Tracked() (patterns []string, err error) {
+	data, err := repo.readAttributes()
+	if err != nil {
+		return nil, err
+	}
+
+	return TrackedPatterns(data), nil
+}
+
+//Track marks each of the patterns with the bits filter in the attributes file
+//in the root of the working tree, see TrackPatterns. It returns the patterns
+//that weren't marked yet, the file is only written if any were added
+func (repo *Repository) Track(patterns []string) (added []string, err error) {
+	data, err := repo.readAttributes()
+	if err != nil {
+		return nil, err
+	}
+
+	data, added = TrackPatterns(data, patterns)
+	if len(added) == 0 {
+		return added, nil
+	}
+
+	return added, repo.writeAttributes(data)
+}
+
+//Untrack removes the bits filter from each of the patterns in the attributes
+//file in the root of the working tree, see UntrackPatterns. It returns the
+//patterns that were marked, the file is only written if any were removed
+func (repo *Repository) Untrack(patterns []string) (removed []string, err error) {
+	data, err := repo.readAttributes()
+	if err != nil {
+		return nil, err
+	}
+
+	data, removed = UntrackPatterns(data, patterns)
+	if len(removed) == 0 {
+		return removed, nil
+	}
+
+	return removed, repo.writeAttributes(data)
+}
+
+//Restage stages the attributes file and adds the files in the index that
+//match any of the patterns again, such that the current attributes apply to
+//them: tracked files are split and untracked files are stored as is. Files
+//that hold a pointer in the working tree are staged as such once untracked,
+//so they should be checked out with the bits filter first
+func (repo *Repository) Restage(patterns []string) (err error) {
+	ctx := context.Background()
+	err = repo.Git(ctx, nil, nil, "add", "--", AttributesFile)
+	if err != nil {
+		return fmt.Errorf("failed to stage '%s': %v", AttributesFile, err)
+	}
+
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	//like attributes, patterns without a slash match in any directory
+	pathspecs := []string{}
+	for _, p := range patterns {
+		if !strings.Contains(p, "/") {
+			pathspecs = append(pathspecs, ":(glob)**/"+p)
+		} else {
+			pathspecs = append(pathspecs, ":(glob)"+strings.TrimPrefix(p, "/"))
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = repo.Git(ctx, nil, buf, append([]string{"ls-files", "-z", "--"}, pathspecs...)...)
+	if err != nil {
+		return fmt.Errorf("failed to list files to re-stage: %v", err)
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	err = repo.Git(ctx, nil, nil, append([]string{"add", "--renormalize", "--"}, pathspecs...)...)
+	if err != nil {
+		return fmt.Errorf("failed to re-stage files: %v", err)
+	}
+
+	return nil
+}
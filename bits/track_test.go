@@ -0,0 +1,132 @@
+package bits_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nerdalize/git-bits/bits"
+)
+
+func TestTrackPatterns(t *testing.T) {
+	attrs := []byte("# large files\n*.psd -text\n*.iso filter=lfs diff=lfs\n*.bin filter=bits\n")
+
+	out, added := bits.TrackPatterns(attrs, []string{"*.bin", "*.psd", "*.iso", "*.zip", "*.zip"})
+	if !reflect.DeepEqual(added, []string{"*.psd", "*.iso", "*.zip"}) {
+		t.Fatalf("unexpected patterns added: %v", added)
+	}
+
+	expected := "# large files\n*.psd -text filter=bits\n*.iso diff=lfs filter=bits\n*.bin filter=bits\n*.zip filter=bits\n"
+	if string(out) != expected {
+		t.Fatalf("unexpected attributes after tracking, got: \n%s", out)
+	}
+
+	again, added := bits.TrackPatterns(out, []string{"*.bin", "*.zip"})
+	if len(added) != 0 || !bytes.Equal(again, out) {
+		t.Fatalf("tracking twice should be a no-op, added: %v", added)
+	}
+
+	if tracked := bits.TrackedPatterns(out); !reflect.DeepEqual(tracked, []string{"*.psd", "*.iso", "*.bin", "*.zip"}) {
+		t.Fatalf("unexpected tracked patterns: %v", tracked)
+	}
+
+	out, removed := bits.UntrackPatterns(out, []string{"*.psd", "*.bin", "*.dat"})
+	if !reflect.DeepEqual(removed, []string{"*.psd", "*.bin"}) {
+		t.Fatalf("unexpected patterns removed: %v", removed)
+	}
+
+	expected = "# large files\n*.psd -text\n*.iso diff=lfs filter=bits\n*.zip filter=bits\n"
+	if string(out) != expected {
+		t.Fatalf("unexpected attributes after untracking, got: \n%s", out)
+	}
+
+	if out, added = bits.TrackPatterns(nil, []string{"*.bin"}); string(out) != "*.bin filter=bits\n" {
+		t.Fatalf("unexpected attributes when tracking without a file, got: \n%s", out)
+	}
+}
+
+func TestTrackRestage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	remote1 := GitInitRemote(t)
+	wd1, repo1 := GitCloneWorkspace(remote1, t)
+
+	//a clean filter that is easy to recognize
+	GitConfigure(t, ctx, repo1, map[string]string{
+		"filter.bits.clean":    "tr a-z A-Z",
+		"filter.bits.smudge":   "cat",
+		"filter.bits.required": "true",
+	})
+
+	err := os.MkdirAll(filepath.Join(wd1, "sub"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.bin", "sub/b.bin", "c.txt"} {
+		err = ioutil.WriteFile(filepath.Join(wd1, name), []byte("content\n"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = repo1.Git(ctx, nil, nil, "add", "-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := func(path string) string {
+		buf := bytes.NewBuffer(nil)
+		err := repo1.Git(ctx, nil, buf, "cat-file", "blob", ":"+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.String()
+	}
+
+	added, err := repo1.Track([]string{"*.bin"})
+	if err != nil || !reflect.DeepEqual(added, []string{"*.bin"}) {
+		t.Fatalf("unexpected track result: %v, %v", added, err)
+	}
+
+	err = repo1.Restage(added)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{"a.bin": "CONTENT\n", "sub/b.bin": "CONTENT\n", "c.txt": "content\n"} {
+		if s := staged(path); s != expected {
+			t.Errorf("expected '%s' to be staged as %q after tracking, got: %q", path, expected, s)
+		}
+	}
+
+	if s := staged(bits.AttributesFile); s != "*.bin filter=bits\n" {
+		t.Errorf("expected attributes file to be staged, got: %q", s)
+	}
+
+	patterns, err := repo1.Tracked()
+	if err != nil || !reflect.DeepEqual(patterns, []string{"*.bin"}) {
+		t.Fatalf("unexpected tracked patterns: %v, %v", patterns, err)
+	}
+
+	removed, err := repo1.Untrack([]string{"*.bin"})
+	if err != nil || !reflect.DeepEqual(removed, []string{"*.bin"}) {
+		t.Fatalf("unexpected untrack result: %v, %v", removed, err)
+	}
+
+	err = repo1.Restage(removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := staged("sub/b.bin"); s != "content\n" {
+		t.Errorf("expected file to be staged as is after untracking, got: %q", s)
+	}
+}
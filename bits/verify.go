@@ -0,0 +1,214 @@
+package bits
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//VerifyPointer combines the pointer on 'r' without writing its content anywhere,
+//chunks that are not stored locally are fetched. It fails if any chunk or the file
+//as a whole doesn't match the checksums recorded in the pointer
+func (repo *Repository) VerifyPointer(r io.Reader) (err error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(repo.Fetch(r, pw))
+	}()
+
+	defer pr.Close()
+	return repo.Combine(pr, ioutil.Discard)
+}
+
+//VerifyFile verifies the file at 'path' in the working tree against the pointer
+//that is staged for it. If the file itself holds a pointer, that pointer is
+//verified instead
+func (repo *Repository) VerifyFile(path string) (err error) {
+	rel, err := filepath.Rel(repo.rootDir, path)
+	if err != nil {
+		return fmt.Errorf("failed to determine path relative to the repository: %v", err)
+	}
+
+	staged := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, staged, "rev-parse", "-q", "--verify", ":"+filepath.ToSlash(rel))
+	if err != nil {
+		return fmt.Errorf("'%s' is not staged", rel)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %v", path, err)
+	}
+
+	defer f.Close()
+	hdr := make([]byte, LineWidth+1)
+	n, _ := io.ReadFull(f, hdr)
+	if IsPointer(hdr[:n]) {
+		return repo.VerifyPointer(io.MultiReader(bytes.NewReader(hdr[:n]), f))
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to seek '%s': %v", path, err)
+	}
+
+	blob := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, blob, "cat-file", "blob", ":"+filepath.ToSlash(rel))
+	if err != nil {
+		return fmt.Errorf("failed to read staged blob for '%s': %v", rel, err)
+	}
+
+	if !IsPointer(blob.Bytes()) {
+		return fmt.Errorf("'%s' is not stored using git-bits", rel)
+	}
+
+	ptr, err := ReadPointer(bytes.NewReader(blob.Bytes()))
+	if err != nil {
+		return fmt.Errorf("failed to read staged pointer: %v", err)
+	}
+
+	//pointers of older versions don't record a checksum, in that case
+	//the chunks are combined and compared to the file instead
+	checksum, sum := ptr.Checksum()
+	if sum == nil {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(repo.Combine(bytes.NewReader(blob.Bytes()), pw))
+		}()
+
+		defer pr.Close()
+		eq, err := readersEqual(pr, f)
+		if err != nil {
+			return fmt.Errorf("failed to compare content: %v", err)
+		}
+
+		if !eq {
+			return fmt.Errorf("content of '%s' differs from its combined chunks", rel)
+		}
+
+		return nil
+	}
+
+	newHash, err := repo.Hasher(checksum)
+	if err != nil {
+		return fmt.Errorf("failed to setup file hashing: %v", err)
+	}
+
+	h := newHash()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("failed to hash '%s': %v", path, err)
+	}
+
+	if size != ptr.Size {
+		return fmt.Errorf("'%s' has %d bytes while its pointer records %d bytes", rel, size, ptr.Size)
+	}
+
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("'%s' doesn't match the %s recorded in its pointer", rel, checksum)
+	}
+
+	return nil
+}
+
+//VerifyRef verifies every pointer in the tree of commit 'ref', or the single
+//pointer if 'ref' names a blob. Each pointer is reported on 'w', it fails if
+//any of the pointers didn't verify
+func (repo *Repository) VerifyRef(ref string, w io.Writer) (err error) {
+	typ := bytes.NewBuffer(nil)
+	err = repo.Git(nil, nil, typ, "cat-file", "-t", ref)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a path or a git object", ref)
+	}
+
+	blobs := map[string]string{}
+	if strings.TrimSpace(typ.String()) == "blob" {
+		blobs[ref] = ref
+	} else {
+		tree := bytes.NewBuffer(nil)
+		err = repo.Git(nil, nil, tree, "ls-tree", "-r", "-l", ref)
+		if err != nil {
+			return fmt.Errorf("failed to list tree of '%s': %v", ref, err)
+		}
+
+		s := bufio.NewScanner(tree)
+		for s.Scan() {
+
+			//line : <mode> SP <type> SP <object> SP <size> TAB <file>
+			tfields := bytes.SplitN(s.Bytes(), []byte("\t"), 2)
+			fields := bytes.Fields(tfields[0])
+			if len(fields) < 4 || len(tfields) != 2 || !bytes.Equal(fields[1], []byte("blob")) {
+				continue
+			}
+
+			objSize, err := strconv.ParseInt(string(fields[3]), 10, 64)
+			if err != nil || objSize%int64(LineWidth+1) != 0 {
+				continue
+			}
+
+			blobs[string(tfields[1])] = string(fields[2])
+		}
+	}
+
+	failed := 0
+	for name, obj := range blobs {
+		blob := bytes.NewBuffer(nil)
+		err = repo.Git(nil, nil, blob, "cat-file", "blob", obj)
+		if err != nil {
+			return fmt.Errorf("failed to read blob '%s': %v", obj, err)
+		}
+
+		if !IsPointer(blob.Bytes()) {
+			continue
+		}
+
+		err = repo.VerifyPointer(blob)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %v\n", name, err)
+			continue
+		}
+
+		fmt.Fprintf(w, "ok   %s\n", name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed verification", failed)
+	}
+
+	return nil
+}
+
+//readersEqual returns whether readers 'a' and 'b' provide the same bytes
+func readersEqual(a, b io.Reader) (eq bool, err error) {
+	bufa := make([]byte, 32*1024)
+	bufb := make([]byte, 32*1024)
+	for {
+		na, erra := io.ReadFull(a, bufa)
+		nb, errb := io.ReadFull(b, bufb)
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+
+		if erra == io.EOF || erra == io.ErrUnexpectedEOF {
+			if errb == io.EOF || errb == io.ErrUnexpectedEOF {
+				return true, nil
+			}
+
+			return false, nil
+		}
+
+		if erra != nil {
+			return false, erra
+		}
+
+		if errb != nil && errb != io.EOF && errb != io.ErrUnexpectedEOF {
+			return false, errb
+		}
+	}
+}
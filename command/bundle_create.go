@@ -0,0 +1,106 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type BundleCreate struct {
+	ui cli.Ui
+}
+
+func NewBundleCreate() (cmd cli.Command, err error) {
+	return &BundleCreate{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *BundleCreate) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Packs every chunk referenced by the pointers in the given revisions or
+  range (e.g. 'master' or 'v1.0..master') into a single archive that starts
+  with an index of the chunks, use '-' to write the archive to standard
+  output. Chunks that are not stored locally are fetched from the remote.
+  Together with 'git bundle create' this moves a complete repository
+  without access to the remote chunk store, see 'git bits bundle unbundle'.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *BundleCreate) Synopsis() string {
+	return "pack the chunks of a range into a file"
+}
+
+// Usage returns a usage description
+func (cmd *BundleCreate) Usage() string {
+	return "git bits bundle create <file> <rev>..."
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *BundleCreate) Run(args []string) int {
+	if len(args) < 2 {
+		cmd.ui.Error(fmt.Sprintf("expected a file and at least one revision, usage: %s", cmd.Usage()))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	w := io.WriteCloser(os.Stdout)
+	if args[0] != "-" {
+		w, err = os.Create(args[0])
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to create bundle: %v", err))
+			return 3
+		}
+	}
+
+	index, err := repo.CreateBundle(w, args[1:])
+	if err == nil {
+		err = w.Close()
+	}
+
+	if err != nil {
+		if args[0] != "-" {
+			os.Remove(args[0])
+		}
+
+		cmd.ui.Error(fmt.Sprintf("failed to create bundle: %v", err))
+		return 4
+	}
+
+	err = repo.RecordChunks()
+	if err != nil {
+		cmd.ui.Warn(fmt.Sprintf("failed to record chunks: %v", err))
+	}
+
+	cmd.ui.Info(fmt.Sprintf("bundled %d chunks", len(index.Chunks)))
+	return 0
+}
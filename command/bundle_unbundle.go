@@ -0,0 +1,100 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type BundleUnbundle struct {
+	ui cli.Ui
+}
+
+func NewBundleUnbundle() (cmd cli.Command, err error) {
+	return &BundleUnbundle{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *BundleUnbundle) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: %s
+
+  Reads an archive written by 'git bits bundle create', use '-' to read it
+  from standard input. Every chunk is verified against its key and chunks
+  that are not yet stored locally are added to the local chunk store. It
+  fails if any chunk doesn't verify or if the archive is incomplete, chunks
+  that were verified before that are kept.
+`, cmd.Synopsis(), cmd.Usage())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *BundleUnbundle) Synopsis() string {
+	return "verify and load the chunks in a file"
+}
+
+// Usage returns a usage description
+func (cmd *BundleUnbundle) Usage() string {
+	return "git bits bundle unbundle <file>"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *BundleUnbundle) Run(args []string) int {
+	if len(args) != 1 {
+		cmd.ui.Error(fmt.Sprintf("expected a single file, usage: %s", cmd.Usage()))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	r := io.ReadCloser(os.Stdin)
+	if args[0] != "-" {
+		r, err = os.Open(args[0])
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to open bundle: %v", err))
+			return 3
+		}
+	}
+
+	defer r.Close()
+	stats, err := repo.Unbundle(r)
+
+	//chunks that were verified are kept, record them either way
+	rerr := repo.RecordChunks()
+	if rerr != nil {
+		cmd.ui.Warn(fmt.Sprintf("failed to record chunks: %v", rerr))
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to unbundle: %v", err))
+		return 4
+	}
+
+	cmd.ui.Info(stats.String())
+	return 0
+}
@@ -0,0 +1,132 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var CatOpts struct {
+	// Offset in the file at which to start writing content
+	Offset int64 `short:"o" long:"offset" description:"byte offset in the file at which to start"`
+
+	// Number of bytes to write, negative means until the end of the file
+	Length int64 `short:"l" long:"length" default:"-1" description:"number of bytes to write, by default until the end of the file"`
+}
+
+type Cat struct {
+	ui cli.Ui
+}
+
+func NewCat() (cmd cli.Command, err error) {
+	return &Cat{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Cat) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &CatOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  The pointer is read from the given git object (e.g HEAD:video.mp4) or
+  from standard input. Only the chunks that cover the requested range
+  are fetched and decrypted.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Cat) Synopsis() string {
+	return "write a byte range of a file to standard output"
+}
+
+// Usage returns a usage description
+func (cmd *Cat) Usage() string {
+	return "git bits cat [--offset N] [--length N] [<object>]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Cat) Run(args []string) int {
+	args, err := flags.ParseArgs(&CatOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	if CatOpts.Offset < 0 {
+		cmd.ui.Error(fmt.Sprintf("offset must not be negative, got: %d", CatOpts.Offset))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	var pointer io.Reader = os.Stdin
+	if len(args) > 0 {
+		buf := bytes.NewBuffer(nil)
+		err = repo.Git(nil, nil, buf, "cat-file", "blob", args[0])
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to read pointer from '%s': %v", args[0], err))
+			return 3
+		}
+
+		pointer = buf
+	}
+
+	rd, err := repo.Open(pointer)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open file: %v", err))
+		return 4
+	}
+
+	var r io.Reader = io.NewSectionReader(rd, CatOpts.Offset, rd.Size()-CatOpts.Offset)
+	if CatOpts.Length >= 0 {
+		r = io.LimitReader(r, CatOpts.Length)
+	}
+
+	_, err = io.Copy(os.Stdout, r)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to write content: %v", err))
+		return 5
+	}
+
+	err = repo.RecordChunks()
+	if err != nil {
+		cmd.ui.Warn(fmt.Sprintf("failed to record chunks: %v", err))
+	}
+
+	return 0
+}
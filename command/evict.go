@@ -0,0 +1,131 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var EvictOpts struct {
+	// Only report what would be evicted
+	DryRun bool `short:"n" long:"dry-run" description:"only report chunks that would be evicted"`
+
+	// Size to evict to instead of the configured local cache size
+	Size string `short:"s" long:"size" description:"evict until local chunks take up no more than this size, e.g 20GiB (default=bits.local-cache-size)"`
+
+	// Print the keys of evicted chunks
+	Verbose bool `short:"v" long:"verbose" description:"print the key of each evicted chunk"`
+}
+
+type Evict struct {
+	ui cli.Ui
+}
+
+func NewEvict() (cmd cli.Command, err error) {
+	return &Evict{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Evict) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &EvictOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  The least recently used chunks are evicted first. Only chunks that are
+  known to be pushed and are not needed by the current checkout (HEAD and
+  the index) are evicted, they are fetched again when needed. Eviction
+  also happens after each pull and push when bits.local-cache-size is set.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Evict) Synopsis() string {
+	return "evict pushed chunks to limit the local cache size"
+}
+
+// Usage returns a usage description
+func (cmd *Evict) Usage() string {
+	return "git bits evict [--size SIZE]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Evict) Run(args []string) int {
+	_, err := flags.ParseArgs(&EvictOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	opts := bits.EvictOpts{DryRun: EvictOpts.DryRun}
+	if EvictOpts.Size != "" {
+		opts.Size, err = humanize.ParseBytes(EvictOpts.Size)
+		if err != nil || opts.Size == 0 {
+			cmd.ui.Error(fmt.Sprintf("invalid size '%s', expected a number of bytes (e.g 20GiB)", EvictOpts.Size))
+			return 1
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 3
+	}
+
+	defer store.Close()
+	w := ioutil.Discard
+	if EvictOpts.Verbose || EvictOpts.DryRun {
+		w = os.Stdout
+	}
+
+	stats, err := repo.Evict(store, opts, w)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to evict: %v", err))
+		return 4
+	}
+
+	if EvictOpts.DryRun {
+		cmd.ui.Info(fmt.Sprintf("dry run, %s", stats))
+		return 0
+	}
+
+	cmd.ui.Info(stats.String())
+	return 0
+}
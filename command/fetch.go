@@ -59,5 +59,10 @@ func (cmd *Fetch) Run(args []string) int {
 		return 3
 	}
 
+	err = repo.RecordChunks()
+	if err != nil {
+		cmd.ui.Warn(fmt.Sprintf("failed to record chunks: %v", err))
+	}
+
 	return 0
 }
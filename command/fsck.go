@@ -0,0 +1,137 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var FsckOpts struct {
+	// Also check the remote chunk store
+	Remote bool `short:"r" long:"remote" description:"consider chunks stored remotely and report remote chunks that are not referenced"`
+
+	// Decrypt and verify every referenced chunk
+	Verify bool `long:"verify" description:"decrypt and verify every referenced chunk, downloading chunks that are only stored remotely"`
+
+	// Output problems as json
+	JSON bool `long:"json" description:"output each problem as a json object on its own line"`
+}
+
+type Fsck struct {
+	ui cli.Ui
+}
+
+func NewFsck() (cmd cli.Command, err error) {
+	return &Fsck{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Fsck) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &FsckOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Checks the pointers in the given revisions (by default all refs, the
+  reflog and the index). Each problem is written to standard output as a
+  tab separated line: kind, key, object, path and detail. Kinds are
+  'malformed', 'missing', 'unverified', 'corrupt', 'dangling-local' and
+  'dangling-remote'. Chunks that are not stored locally are 'unverified'
+  unless --remote or --verify is given. It exits with status 4 if any
+  problem other than a dangling or unverified chunk is found.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Fsck) Synopsis() string {
+	return "check that referenced chunks are stored and intact"
+}
+
+// Usage returns a usage description
+func (cmd *Fsck) Usage() string {
+	return "git bits fsck [<rev>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Fsck) Run(args []string) int {
+	args, err := flags.ParseArgs(&FsckOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	if len(args) < 1 {
+		args = []string{"--all", "--reflog", "--indexed-objects"}
+	}
+
+	counts := map[string]int{}
+	fatal := false
+	enc := json.NewEncoder(os.Stdout)
+	err = repo.Fsck(bits.FsckOpts{
+		Revs:   args,
+		Remote: FsckOpts.Remote,
+		Verify: FsckOpts.Verify,
+	}, func(p bits.FsckProblem) error {
+		counts[p.Kind]++
+		fatal = fatal || p.Fatal()
+		if FsckOpts.JSON {
+			return enc.Encode(p)
+		}
+
+		_, err := fmt.Fprintln(os.Stdout, p)
+		return err
+	})
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to check chunks: %v", err))
+		return 3
+	}
+
+	for _, kind := range []string{bits.FsckMalformed, bits.FsckMissing, bits.FsckCorrupt, bits.FsckUnverified, bits.FsckDanglingLocal, bits.FsckDanglingRemote} {
+		if counts[kind] > 0 {
+			cmd.ui.Info(fmt.Sprintf("%s: %d", kind, counts[kind]))
+		}
+	}
+
+	if fatal {
+		return 4
+	}
+
+	return 0
+}
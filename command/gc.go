@@ -0,0 +1,168 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var GCOpts struct {
+	// Only report what would be removed
+	DryRun bool `short:"n" long:"dry-run" description:"only report chunks that would be removed"`
+
+	// Only remove chunks that are known to be stored remotely
+	PushedOnly bool `short:"p" long:"pushed-only" description:"only remove chunks that are known to be pushed to the remote, always the case with a configured bits.chunk-dir"`
+
+	// Keep chunks that were modified recently
+	Expire time.Duration `long:"expire" description:"keep unreferenced chunks that were modified more recently than this (default=1h)"`
+
+	// Collect garbage in the remote chunk store instead of locally
+	Remote bool `short:"r" long:"remote" description:"remove chunks from the remote chunk store that no ref of the git remote(s) references"`
+
+	// Git remotes whose refs determine which remote chunks are referenced
+	GitRemotes []string `long:"git-remote" description:"git remote whose refs reference remote chunks, can be repeated (default=origin)"`
+
+	// Confirm that the remote chunk store isn't shared
+	ExclusiveBucket bool `long:"exclusive-bucket" description:"confirm that the remote chunk store holds the chunks of this repository only, required to remove remote chunks"`
+
+	// Keep remote chunks that were uploaded recently
+	GracePeriod time.Duration `long:"grace-period" description:"keep unreferenced remote chunks that were uploaded more recently than this (default=168h)"`
+
+	// Print the keys of removed chunks
+	Verbose bool `short:"v" long:"verbose" description:"print the key of each removed chunk"`
+}
+
+type GC struct {
+	ui cli.Ui
+}
+
+func NewGC() (cmd cli.Command, err error) {
+	return &GC{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *GC) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &GCOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Chunks are referenced when a pointer that lists them is reachable from
+  any ref, the reflog (including the stash) or the index.
+
+  With --remote, chunks are removed from the remote chunk store instead.
+  These are referenced when reachable from the branches and tags that the
+  git remote(s) list, which must be fetched first. Chunks uploaded within
+  the grace period are kept as a concurrent push uploads chunks before it
+  updates refs, refs pushed while collecting are fetched and the chunks
+  they reference are uploaded again.
+
+  Chunks of other repositories look unreferenced, so the remote chunk store
+  must hold the chunks of this repository only: e.g repositories that share
+  the default deduplication scope can share a bucket, but then it must not be
+  collected. Confirm this with --exclusive-bucket, a dry run doesn't need it.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *GC) Synopsis() string {
+	return "remove local chunks that are no longer referenced"
+}
+
+// Usage returns a usage description
+func (cmd *GC) Usage() string {
+	return "git bits gc"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *GC) Run(args []string) int {
+	GCOpts.Expire = bits.GCExpire
+	GCOpts.GracePeriod = bits.GCGracePeriod
+	_, err := flags.ParseArgs(&GCOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 3
+	}
+
+	defer store.Close()
+	w := ioutil.Discard
+	if GCOpts.Verbose || GCOpts.DryRun {
+		w = os.Stdout
+	}
+
+	var stats bits.GCStats
+	if GCOpts.Remote {
+		if len(GCOpts.GitRemotes) < 1 {
+			GCOpts.GitRemotes = []string{"origin"}
+		}
+
+		stats, err = repo.RemoteGC(store, bits.RemoteGCOpts{
+			DryRun:      GCOpts.DryRun,
+			Remotes:     GCOpts.GitRemotes,
+			GracePeriod: GCOpts.GracePeriod,
+			Exclusive:   GCOpts.ExclusiveBucket,
+		}, w)
+	} else {
+		stats, err = repo.GC(store, bits.GCOpts{
+			DryRun:     GCOpts.DryRun,
+			PushedOnly: GCOpts.PushedOnly,
+			Expire:     GCOpts.Expire,
+		}, w)
+	}
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to collect garbage: %v", err))
+		return 4
+	}
+
+	if GCOpts.DryRun {
+		cmd.ui.Info(fmt.Sprintf("dry run, %s", stats))
+		return 0
+	}
+
+	cmd.ui.Info(stats.String())
+	return 0
+}
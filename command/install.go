@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/mitchellh/cli"
 	"github.com/nerdalize/git-bits/bits"
+	"github.com/restic/chunker"
 )
 
 var InstallOpts struct {
@@ -16,6 +19,9 @@ var InstallOpts struct {
 
 	// Chunk remote will be configured for configuration under this remote
 	Remote string `short:"r" long:"remote" default:"origin" required:"true" description:"git remote that will be configured for chunk storage (default=origin)"`
+
+	// Deduplication scope (chunking polynomial) that will be shared through the committed configuration
+	Scope string `short:"s" long:"scope" description:"deduplication scope to use for this repository, an irreducible polynomial of degree 53 (e.g 0x3DA3358B4DC173)"`
 }
 
 type Install struct {
@@ -103,11 +109,89 @@ func (cmd *Install) Run(args []string) int {
 		return 128
 	}
 
+	conf.DeduplicationScope, err = cmd.scope(repo)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup deduplication scope: %v", err))
+		return 128
+	}
+
 	err = repo.Install(os.Stdout, conf)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to fetch: %v", err))
 		return 4
 	}
 
+	err = cmd.track(repo)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to track common binary files: %v", err))
+		return 4
+	}
+
 	return 0
 }
+
+// track offers the user to track common binary file types if nothing is
+// tracked yet, already staged files are not staged again
+func (cmd *Install) track(repo *bits.Repository) (err error) {
+	patterns, err := repo.Tracked()
+	if err != nil || len(patterns) > 0 {
+		return err
+	}
+
+	answer, err := cmd.ui.Ask(fmt.Sprintf("Would you like to track common binary file types (%s) using '%s'? Other files can be tracked later using 'git bits track <pattern>'. [y/N]\n", strings.Join(bits.CommonBinaryPatterns, " "), bits.AttributesFile))
+	if err != nil {
+		return fmt.Errorf("failed to get input: %v", err)
+	}
+
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return nil
+	}
+
+	_, err = repo.Track(bits.CommonBinaryPatterns)
+	if err != nil {
+		return err
+	}
+
+	cmd.ui.Info(fmt.Sprintf("common binary file types are tracked in '%s', commit it and use 'git bits track --restage <pattern>' to split files that were already committed", bits.AttributesFile))
+	return nil
+}
+
+// scope determines the deduplication scope for the repository: a scope provided
+// as an option is validated, a scope that is already shared through the committed
+// configuration is kept and otherwise the user is offered a random scope
+func (cmd *Install) scope(repo *bits.Repository) (scope uint64, err error) {
+	if InstallOpts.Scope != "" {
+		scope, err = strconv.ParseUint(InstallOpts.Scope, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected format for scope '%s', expected a (0x prefixed) number", InstallOpts.Scope)
+		}
+
+		return scope, bits.ValidateScope(scope)
+	}
+
+	shared := &bits.Conf{}
+	err = shared.OverwriteFromShared(repo)
+	if err != nil {
+		return 0, err
+	}
+
+	if shared.DeduplicationScope != 0 {
+		return shared.DeduplicationScope, nil
+	}
+
+	answer, err := cmd.ui.Ask(fmt.Sprintf("Would you like to generate a random deduplication scope for this repository? Chunk boundaries are then not predictable by other git-bits users, everyone using the repository will need the committed '%s' file. [Y/n]\n", bits.SharedConfFile))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get input: %v", err)
+	}
+
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "" && answer != "y" && answer != "yes" {
+		return bits.DefaultConf().DeduplicationScope, nil
+	}
+
+	pol, err := chunker.RandomPolynomial()
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random polynomial: %v", err)
+	}
+
+	return uint64(pol), nil
+}
@@ -0,0 +1,115 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var MigrateExportOpts struct {
+	// Rewrite with uncommitted changes
+	Force bool `short:"f" long:"force" description:"rewrite even if the working tree has uncommitted changes, they are lost"`
+}
+
+type MigrateExport struct {
+	ui cli.Ui
+}
+
+func NewMigrateExport() (cmd cli.Command, err error) {
+	return &MigrateExport{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *MigrateExport) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &MigrateExportOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Replaces every pointer in the history of the given refs (by default all
+  branches and tags) with the content it describes and removes the bits filter from the
+  root .gitattributes of every commit, e.g before publishing the repository
+  or moving to another tool. It is the inverse of 'git bits migrate import'.
+  Chunks are fetched as needed and each file is verified against its key and
+  checksum while it is combined, history is only rewritten if every file can
+  be combined. History is rewritten like 'git bits migrate rekey' does.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *MigrateExport) Synopsis() string {
+	return "convert pointers in history back into files"
+}
+
+// Usage returns a usage description
+func (cmd *MigrateExport) Usage() string {
+	return "git bits migrate export [<ref>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *MigrateExport) Run(args []string) int {
+	args, err := flags.ParseArgs(&MigrateExportOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 3
+	}
+
+	defer store.Close()
+	if len(args) < 1 {
+		args = []string{"--branches", "--tags"}
+	}
+
+	stats, err := repo.Export(store, bits.ExportOpts{
+		Refs:  args,
+		Force: MigrateExportOpts.Force,
+	})
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to export history: %v", err))
+		return 4
+	}
+
+	cmd.ui.Info(stats.String())
+	return 0
+}
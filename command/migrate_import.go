@@ -0,0 +1,140 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var MigrateImportOpts struct {
+	// Patterns of the files that are converted
+	Include []string `short:"I" long:"include" description:"pattern in the gitattributes syntax of files to convert (e.g '*.bin'), can be given more than once"`
+
+	// Only convert blobs above this size
+	Above string `long:"above" description:"only convert blobs larger than this size (e.g 1MiB)"`
+
+	// Rewrite with uncommitted changes
+	Force bool `short:"f" long:"force" description:"rewrite even if the working tree has uncommitted changes, they are lost"`
+}
+
+type MigrateImport struct {
+	ui cli.Ui
+}
+
+func NewMigrateImport() (cmd cli.Command, err error) {
+	return &MigrateImport{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *MigrateImport) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &MigrateImportOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Converts the files that match the included patterns in the history of the
+  given refs (by default all branches and tags) into pointers, e.g when
+  adopting git-bits in a repository that already holds large files. Matching blobs are split into
+  chunks that are stored locally, and the patterns are tracked in the root
+  .gitattributes of every commit. With --above only larger blobs are converted
+  and the exact paths of the converted files are tracked instead. History is rewritten like 'git bits migrate
+  rekey' does, once pushed with 'git push --force' the pre-push hook pushes
+  the chunks. It reports how much smaller the blobs in history became, the
+  original objects are removed by git once nothing references them anymore.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *MigrateImport) Synopsis() string {
+	return "convert large files in history into pointers"
+}
+
+// Usage returns a usage description
+func (cmd *MigrateImport) Usage() string {
+	return "git bits migrate import --include <pattern> [--above <size>] [<ref>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *MigrateImport) Run(args []string) int {
+	args, err := flags.ParseArgs(&MigrateImportOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	if len(MigrateImportOpts.Include) < 1 {
+		cmd.ui.Error(fmt.Sprintf("expected at least one pattern to include, usage: %s", cmd.Usage()))
+		return 1
+	}
+
+	above := uint64(0)
+	if MigrateImportOpts.Above != "" {
+		above, err = humanize.ParseBytes(MigrateImportOpts.Above)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("unexpected format for size '%s', expected a number of bytes (e.g 1MiB)", MigrateImportOpts.Above))
+			return 1
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 3
+	}
+
+	defer store.Close()
+	if len(args) < 1 {
+		args = []string{"--branches", "--tags"}
+	}
+
+	stats, err := repo.Import(store, bits.ImportOpts{
+		Refs:    args,
+		Include: MigrateImportOpts.Include,
+		Above:   int64(above),
+		Force:   MigrateImportOpts.Force,
+	})
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to import history: %v", err))
+		return 4
+	}
+
+	cmd.ui.Info(stats.String())
+	return 0
+}
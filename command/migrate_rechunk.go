@@ -0,0 +1,129 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var MigrateRechunkOpts struct {
+	// Rewrite with uncommitted changes
+	Force bool `short:"f" long:"force" description:"rewrite even if the working tree has uncommitted changes, they are lost"`
+
+	// Output the storage report as json
+	JSON bool `long:"json" description:"output the storage stats from before and after as a single json object"`
+}
+
+type MigrateRechunk struct {
+	ui cli.Ui
+}
+
+func NewMigrateRechunk() (cmd cli.Command, err error) {
+	return &MigrateRechunk{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *MigrateRechunk) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &MigrateRechunkOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Re-splits every file that is stored as a pointer in the history of the
+  given refs (by default all branches and tags) with the current chunking
+  configuration, e.g after changing 'bits.deduplication-scope' or the chunk
+  sizes, such that files deduplicate against each other again. Chunks are
+  fetched as needed and history is rewritten like 'git bits migrate rekey'
+  does. It reports the unique chunk bytes of the history before and after,
+  chunks that are no longer referenced are removed by 'git bits gc'.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *MigrateRechunk) Synopsis() string {
+	return "re-split history with the current chunking"
+}
+
+// Usage returns a usage description
+func (cmd *MigrateRechunk) Usage() string {
+	return "git bits migrate rechunk [<ref>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *MigrateRechunk) Run(args []string) int {
+	args, err := flags.ParseArgs(&MigrateRechunkOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 3
+	}
+
+	defer store.Close()
+	if len(args) < 1 {
+		args = []string{"--branches", "--tags"}
+	}
+
+	stats, err := repo.Rechunk(store, bits.RechunkOpts{
+		Refs:  args,
+		Force: MigrateRechunkOpts.Force,
+	})
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to re-chunk history: %v", err))
+		return 4
+	}
+
+	if MigrateRechunkOpts.JSON {
+		err = json.NewEncoder(os.Stdout).Encode(map[string]*bits.Stats{"before": stats.Before, "after": stats.After})
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to encode stats: %v", err))
+			return 4
+		}
+
+		return 0
+	}
+
+	cmd.ui.Info(stats.String())
+	return 0
+}
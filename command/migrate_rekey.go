@@ -0,0 +1,150 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var MigrateRekeyOpts struct {
+	// Secret that keyed the existing chunks
+	OldHashSecret string `long:"old-hash-secret" description:"secret that keyed the existing chunks, if it differs from the configured secret"`
+
+	// File that holds the secret that keyed the existing chunks
+	OldHashSecretFile string `long:"old-hash-secret-file" description:"file that holds the secret that keyed the existing chunks"`
+
+	// Rewrite with uncommitted changes
+	Force bool `short:"f" long:"force" description:"rewrite even if the working tree has uncommitted changes, they are lost"`
+
+	// Delete old chunks from the remote
+	DeleteOld bool `long:"delete-old" description:"push the new chunks and delete old chunks from the remote that no ref references anymore, locally or on any git remote"`
+
+	// Print the keys of old chunks
+	Verbose bool `short:"v" long:"verbose" description:"print the key of each old chunk that the rewritten refs no longer reference"`
+}
+
+type MigrateRekey struct {
+	ui cli.Ui
+}
+
+func NewMigrateRekey() (cmd cli.Command, err error) {
+	return &MigrateRekey{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *MigrateRekey) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &MigrateRekeyOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Re-splits every file that is stored as a pointer in the history of the
+  given refs (by default all branches and tags) with the current
+  configuration, such that its chunks are keyed and encrypted anew, e.g after
+  the hash secret leaked or to move to keyed hashing. Chunks are fetched as
+  needed. History is rewritten in the style of 'git filter-repo': every given
+  ref points to rewritten commits afterwards and the mappings of old to new
+  blobs and commits are written to the 'bits-rewrite' directory in the git
+  directory. Remote-tracking refs and the stash are never rewritten.
+  Collaborators need to clone anew, or rebase onto the rewritten history.
+
+  Old chunks are only deleted with --delete-old: the new chunks are pushed
+  first, after which old chunks are deleted from the remote unless a local ref,
+  the index or a ref on any git remote still references them. Refs that were
+  pushed before re-keying keep their chunks until the rewritten history is
+  force pushed, run 'git bits gc --remote' to remove those afterwards.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *MigrateRekey) Synopsis() string {
+	return "re-key and re-encrypt all chunks in history"
+}
+
+// Usage returns a usage description
+func (cmd *MigrateRekey) Usage() string {
+	return "git bits migrate rekey [<ref>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *MigrateRekey) Run(args []string) int {
+	args, err := flags.ParseArgs(&MigrateRekeyOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	oldConf := &bits.Conf{HashSecret: MigrateRekeyOpts.OldHashSecret, HashSecretFile: MigrateRekeyOpts.OldHashSecretFile}
+	oldKey, err := oldConf.HashKey(wd)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to load old hash secret: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 3
+	}
+
+	defer store.Close()
+	if len(args) < 1 {
+		args = []string{"--branches", "--tags"}
+	}
+
+	w := ioutil.Discard
+	if MigrateRekeyOpts.Verbose {
+		w = os.Stdout
+	}
+
+	stats, err := repo.Rekey(store, bits.RekeyOpts{
+		Refs:       args,
+		OldHashKey: oldKey,
+		Force:      MigrateRekeyOpts.Force,
+		DeleteOld:  MigrateRekeyOpts.DeleteOld,
+	}, w)
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to re-key history: %v", err))
+		return 4
+	}
+
+	cmd.ui.Info(stats.String())
+	return 0
+}
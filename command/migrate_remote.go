@@ -0,0 +1,149 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var MigrateRemoteOpts struct {
+	// Remote chunk store to copy chunks from
+	From string `long:"from" required:"true" description:"name of the remote chunk store to copy chunks from, 'origin' is the default remote"`
+
+	// Remote chunk store to copy chunks to
+	To string `long:"to" required:"true" description:"name of the remote chunk store to copy chunks to"`
+
+	// Copy the chunks referenced anywhere
+	All bool `long:"all" description:"copy the chunks referenced by any ref, the reflog or the index (default if no revisions are given)"`
+
+	// Number of concurrent transfers
+	Parallel int `short:"j" long:"parallel" description:"number of chunks that are transferred concurrently (default=8)"`
+
+	// Don't list the destination upfront
+	NoList bool `long:"no-list" description:"don't list the destination upfront, only skip chunks that the local store records as copied"`
+
+	// Read back every chunk to verify it
+	VerifyContent bool `long:"verify-content" description:"read back every chunk from the destination and verify its content against its key"`
+
+	// Print the keys of copied chunks
+	Verbose bool `short:"v" long:"verbose" description:"print the key of each copied chunk"`
+}
+
+type MigrateRemote struct {
+	ui cli.Ui
+}
+
+func NewMigrateRemote() (cmd cli.Command, err error) {
+	return &MigrateRemote{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *MigrateRemote) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &MigrateRemoteOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Copies every chunk referenced by the pointers in the given revisions or
+  range from one remote chunk store to another. Remotes are configured by
+  name, e.g 'git config bits-remote.archive.aws-s3-bucket-name my-bucket'.
+  Chunks that the destination already stores are skipped and every copied
+  chunk is recorded in the local store right away, such that an interrupted
+  migration can be resumed by running it again. It ends by checking that the
+  destination stores every referenced chunk.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *MigrateRemote) Synopsis() string {
+	return "copy referenced chunks between remotes"
+}
+
+// Usage returns a usage description
+func (cmd *MigrateRemote) Usage() string {
+	return "git bits migrate-remote --from <remote> --to <remote> [<rev>...|--all]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *MigrateRemote) Run(args []string) int {
+	MigrateRemoteOpts.Parallel = bits.MigrateRemoteParallel
+	args, err := flags.ParseArgs(&MigrateRemoteOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	if MigrateRemoteOpts.All && len(args) > 0 {
+		cmd.ui.Error("expected either revisions or --all, not both")
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 3
+	}
+
+	defer store.Close()
+	if len(args) < 1 {
+		args = bits.LiveRevs
+	}
+
+	w := ioutil.Discard
+	if MigrateRemoteOpts.Verbose {
+		w = os.Stdout
+	}
+
+	stats, err := repo.MigrateRemote(store, bits.MigrateRemoteOpts{
+		From:          MigrateRemoteOpts.From,
+		To:            MigrateRemoteOpts.To,
+		Revs:          args,
+		Parallel:      MigrateRemoteOpts.Parallel,
+		NoList:        MigrateRemoteOpts.NoList,
+		VerifyContent: MigrateRemoteOpts.VerifyContent,
+	}, w)
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to migrate chunks: %v", err))
+		return 4
+	}
+
+	cmd.ui.Info(stats.String())
+	return 0
+}
@@ -2,6 +2,7 @@ package command
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/mitchellh/cli"
@@ -64,5 +65,25 @@ func (cmd *Pull) Run(args []string) int {
 		return 3
 	}
 
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Warn(fmt.Sprintf("failed to open local store to record chunks: %v", err))
+		return 0
+	}
+
+	defer store.Close()
+	err = repo.SaveChunkRecords(store)
+	if err != nil {
+		cmd.ui.Warn(fmt.Sprintf("failed to record chunks: %v", err))
+	}
+
+	//chunks of the previous checkout may now be evicted from the local cache
+	stats, err := repo.Evict(store, bits.EvictOpts{}, ioutil.Discard)
+	if err != nil && err != bits.ErrNoCacheSize {
+		cmd.ui.Warn(fmt.Sprintf("failed to evict local chunks: %v", err))
+	} else if stats.Removed > 0 {
+		cmd.ui.Info(fmt.Sprintf("evicted from local cache: %s", stats))
+	}
+
 	return 0
 }
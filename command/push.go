@@ -2,6 +2,7 @@ package command
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/mitchellh/cli"
@@ -66,5 +67,13 @@ func (cmd *Push) Run(args []string) int {
 		return 3
 	}
 
+	//pushed chunks may now be evicted from the local cache
+	stats, err := repo.Evict(store, bits.EvictOpts{}, ioutil.Discard)
+	if err != nil && err != bits.ErrNoCacheSize {
+		cmd.ui.Warn(fmt.Sprintf("failed to evict local chunks: %v", err))
+	} else if stats.Removed > 0 {
+		cmd.ui.Info(fmt.Sprintf("evicted from local cache: %s", stats))
+	}
+
 	return 0
 }
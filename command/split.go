@@ -53,11 +53,25 @@ func (cmd *Split) Run(args []string) int {
 		return 2
 	}
 
+	//git provides the path of the file that is cleaned, if
+	//so we can warn about mismatching chunking configuration
+	if len(args) > 0 {
+		err = repo.CheckChunking(args[0])
+		if err != nil {
+			cmd.ui.Warn(fmt.Sprintf("failed to check chunking: %v", err))
+		}
+	}
+
 	err = repo.Split(os.Stdin, os.Stdout)
 	if err != nil {
 		cmd.ui.Error(fmt.Sprintf("failed to split: %v", err))
 		return 3
 	}
 
+	err = repo.RecordChunks()
+	if err != nil {
+		cmd.ui.Warn(fmt.Sprintf("failed to record chunks: %v", err))
+	}
+
 	return 0
 }
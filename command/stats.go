@@ -0,0 +1,131 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var StatsOpts struct {
+	// Also report the size of the remote chunk store
+	Remote bool `short:"r" long:"remote" description:"also report how many chunks the remote stores, this lists every remote chunk"`
+
+	// Number of files to list
+	Top int `short:"n" long:"top" default:"10" description:"number of files in the lists of largest and most shared files"`
+
+	// Output the report as json
+	JSON bool `long:"json" description:"output the report as a single json object"`
+}
+
+type Stats struct {
+	ui cli.Ui
+}
+
+func NewStats() (cmd cli.Command, err error) {
+	return &Stats{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Stats) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &StatsOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Reports on the pointers in the given revisions or range (by default HEAD):
+  the bytes of every distinct file version against the bytes of the unique
+  chunks they consist of, the resulting dedup ratio, a histogram of chunk
+  sizes, the largest files and the files that share the most chunks with
+  other files. It also reports how much the local chunk store holds.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Stats) Synopsis() string {
+	return "report deduplication and storage statistics"
+}
+
+// Usage returns a usage description
+func (cmd *Stats) Usage() string {
+	return "git bits stats [<rev>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Stats) Run(args []string) int {
+	args, err := flags.ParseArgs(&StatsOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 2
+	}
+
+	defer store.Close()
+	if len(args) < 1 {
+		args = []string{"HEAD"}
+	}
+
+	stats, err := repo.Stats(store, bits.StatsOpts{
+		Revs:   args,
+		Remote: StatsOpts.Remote,
+		Top:    StatsOpts.Top,
+	})
+
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to gather stats: %v", err))
+		return 3
+	}
+
+	if StatsOpts.JSON {
+		err = json.NewEncoder(os.Stdout).Encode(stats)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to encode stats: %v", err))
+			return 4
+		}
+
+		return 0
+	}
+
+	stats.WriteText(os.Stdout)
+	return 0
+}
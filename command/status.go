@@ -0,0 +1,159 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var StatusOpts struct {
+	// Output tab separated lines
+	Porcelain bool `long:"porcelain" description:"output each file as a tab separated line that is stable across versions"`
+
+	// Output as json
+	JSON bool `long:"json" description:"output each file as a json object on its own line"`
+
+	// List the remote chunks
+	Remote bool `short:"r" long:"remote" description:"list the chunks the remote stores to tell which chunks are stored remotely or missing"`
+}
+
+type Status struct {
+	ui cli.Ui
+}
+
+func NewStatus() (cmd cli.Command, err error) {
+	return &Status{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Status) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &StatusOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Lists the files in the index that use the bits filter, optionally limited
+  to the given paths. For each file it shows whether the working tree holds
+  its content ('materialized'), a pointer ('pointer') or nothing ('deleted'),
+  and whether it was modified since it was staged. It also shows where the
+  chunks of the staged pointer are stored: 'local', 'partial', 'remote' or
+  'unverified' if some are neither stored locally nor known to be stored
+  remotely, files that are stored in git as is are 'unsplit'. Chunks are known
+  to be stored remotely once pushed or fetched. With --remote the remote is
+  listed instead, files of which some chunks are stored nowhere are 'missing'.
+
+  The porcelain format has the following tab separated fields: worktree state,
+  'modified' or '-', chunk state, number of chunks, local, remote only,
+  missing, unpushed and path. Chunks that are counted as neither local, remote
+  only nor missing are unverified.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Status) Synopsis() string {
+	return "show the state of files that use the bits filter"
+}
+
+// Usage returns a usage description
+func (cmd *Status) Usage() string {
+	return "git bits status [<path>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Status) Run(args []string) int {
+	args, err := flags.ParseArgs(&StatusOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	store, err := repo.LocalStore()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to open local store: %v", err))
+		return 2
+	}
+
+	defer store.Close()
+	status, err := repo.Status(store, bits.StatusOpts{Paths: args, Remote: StatusOpts.Remote})
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get status: %v", err))
+		return 3
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, s := range status {
+		if StatusOpts.JSON {
+			err = enc.Encode(s)
+		} else if StatusOpts.Porcelain {
+			_, err = fmt.Fprintln(os.Stdout, s)
+		} else {
+			notes := []string{}
+			if s.Modified {
+				notes = append(notes, "modified")
+			}
+
+			if s.Unpushed > 0 {
+				notes = append(notes, fmt.Sprintf("%d unpushed chunk(s)", s.Unpushed))
+			}
+
+			if s.Missing > 0 {
+				notes = append(notes, fmt.Sprintf("%d missing chunk(s)", s.Missing))
+			}
+
+			if s.Unverified > 0 {
+				notes = append(notes, fmt.Sprintf("%d unverified chunk(s)", s.Unverified))
+			}
+
+			note := ""
+			if len(notes) > 0 {
+				note = fmt.Sprintf(" (%s)", strings.Join(notes, ", "))
+			}
+
+			_, err = fmt.Fprintf(os.Stdout, "%-12s  %-8s  %s%s\n", s.Worktree, s.State, s.Path, note)
+		}
+
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to write status: %v", err))
+			return 4
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,128 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var TrackOpts struct {
+	// Stage files that match the patterns again
+	Restage bool `long:"restage" description:"stage files that match the patterns again such that they are split"`
+}
+
+type Track struct {
+	ui cli.Ui
+}
+
+func NewTrack() (cmd cli.Command, err error) {
+	return &Track{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Track) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &TrackOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Marks files that match each of the patterns with the bits filter in the
+  .gitattributes file in the root of the working tree, patterns use the
+  gitattributes syntax (e.g '*.bin' or 'assets/**'). Patterns that are already
+  tracked are left as is. Without patterns the tracked patterns are listed.
+  Files that are already staged keep their content in git until they are
+  staged again, which --restage does for files matching the patterns.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Track) Synopsis() string {
+	return "mark files to use the bits filter"
+}
+
+// Usage returns a usage description
+func (cmd *Track) Usage() string {
+	return "git bits track [<pattern>...]"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Track) Run(args []string) int {
+	args, err := flags.ParseArgs(&TrackOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	if len(args) == 0 {
+		patterns, err := repo.Tracked()
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to list tracked patterns: %v", err))
+			return 3
+		}
+
+		for _, p := range patterns {
+			fmt.Fprintln(os.Stdout, p)
+		}
+
+		return 0
+	}
+
+	added, err := repo.Track(args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to track patterns: %v", err))
+		return 3
+	}
+
+	for _, p := range added {
+		cmd.ui.Info(fmt.Sprintf("tracking '%s'", p))
+	}
+
+	if len(added) < len(args) {
+		cmd.ui.Info(fmt.Sprintf("%d pattern(s) were already tracked", len(args)-len(added)))
+	}
+
+	if TrackOpts.Restage {
+		err = repo.Restage(args)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to re-stage files: %v", err))
+			return 4
+		}
+	}
+
+	return 0
+}
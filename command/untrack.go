@@ -0,0 +1,119 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+var UntrackOpts struct {
+	// Stage files that match the patterns again
+	Restage bool `long:"restage" description:"stage files that match the patterns again such that they are stored as is"`
+}
+
+type Untrack struct {
+	ui cli.Ui
+}
+
+func NewUntrack() (cmd cli.Command, err error) {
+	return &Untrack{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Untrack) Help() string {
+	parser := flags.NewNamedParser(cmd.Usage(), flags.PassDoubleDash)
+	_, err := parser.AddGroup("default", "", &UntrackOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	parser.WriteHelp(buf)
+
+	return fmt.Sprintf(`
+  %s
+
+  Removes the bits filter from each of the patterns in the .gitattributes file
+  in the root of the working tree, other attributes of the patterns are kept.
+  Patterns must be given exactly as they are tracked, see 'git bits track'.
+  Files that are already staged keep their pointer in git until they are staged
+  again, which --restage does for files matching the patterns. Make sure the
+  working tree holds their content, not a pointer, before doing so.
+
+%s`, cmd.Synopsis(), buf.String())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Untrack) Synopsis() string {
+	return "stop files from using the bits filter"
+}
+
+// Usage returns a usage description
+func (cmd *Untrack) Usage() string {
+	return "git bits untrack <pattern>..."
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Untrack) Run(args []string) int {
+	args, err := flags.ParseArgs(&UntrackOpts, args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to parse flags: %v", err))
+		return 1
+	}
+
+	if len(args) == 0 {
+		cmd.ui.Error(fmt.Sprintf("expected at least one pattern, usage: %s", cmd.Usage()))
+		return 1
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	removed, err := repo.Untrack(args)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to untrack patterns: %v", err))
+		return 3
+	}
+
+	for _, p := range removed {
+		cmd.ui.Info(fmt.Sprintf("untracked '%s'", p))
+	}
+
+	if len(removed) < len(args) {
+		cmd.ui.Info(fmt.Sprintf("%d pattern(s) were not tracked", len(args)-len(removed)))
+	}
+
+	if UntrackOpts.Restage {
+		err = repo.Restage(args)
+		if err != nil {
+			cmd.ui.Error(fmt.Sprintf("failed to re-stage files: %v", err))
+			return 4
+		}
+	}
+
+	return 0
+}
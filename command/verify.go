@@ -0,0 +1,96 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/cli"
+	"github.com/nerdalize/git-bits/bits"
+)
+
+type Verify struct {
+	ui cli.Ui
+}
+
+func NewVerify() (cmd cli.Command, err error) {
+	return &Verify{
+		ui: &cli.BasicUi{
+			Reader:      os.Stdin,
+			Writer:      os.Stderr,
+			ErrorWriter: os.Stderr,
+		},
+	}, nil
+}
+
+// Help returns long-form help text that includes the command-line
+// usage, a brief few sentences explaining the function of the command,
+// and the complete list of flags the command accepts.
+func (cmd *Verify) Help() string {
+	return fmt.Sprintf(`
+  %s
+
+  Usage: git bits verify [<path>|<ref>...]
+
+  Each argument is either a file in the working tree, which is checked
+  against the pointer that is staged for it, or a git object: all pointers
+  in the tree of a commit are combined and checked against the size and
+  sha256 they record. Without arguments HEAD is verified.
+`, cmd.Synopsis())
+}
+
+// Synopsis returns a one-line, short synopsis of the command.
+// This should be less than 50 characters ideally.
+func (cmd *Verify) Synopsis() string {
+	return "verify files against the checksums in their pointers"
+}
+
+// Run runs the actual command with the given CLI instance and
+// command-line arguments. It returns the exit status when it is
+// finished.
+func (cmd *Verify) Run(args []string) int {
+	wd, err := os.Getwd()
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to get working directory: %v", err))
+		return 1
+	}
+
+	repo, err := bits.NewRepository(wd, os.Stderr)
+	if err != nil {
+		cmd.ui.Error(fmt.Sprintf("failed to setup repository: %v", err))
+		return 2
+	}
+
+	if len(args) < 1 {
+		args = []string{"HEAD"}
+	}
+
+	failed := false
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil || fi.IsDir() {
+			err = repo.VerifyRef(arg, os.Stdout)
+			if err != nil {
+				cmd.ui.Error(fmt.Sprintf("failed to verify '%s': %v", arg, err))
+				failed = true
+			}
+
+			continue
+		}
+
+		err = repo.VerifyFile(filepath.Join(wd, arg))
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "FAIL %s: %v\n", arg, err)
+			failed = true
+			continue
+		}
+
+		fmt.Fprintf(os.Stdout, "ok   %s\n", arg)
+	}
+
+	if failed {
+		return 3
+	}
+
+	return 0
+}
@@ -18,13 +18,29 @@ func main() {
 	c := cli.NewCLI(name, version)
 	c.Args = os.Args[1:]
 	c.Commands = map[string]cli.CommandFactory{
-		"scan":    command.NewScan,
-		"split":   command.NewSplit,
-		"install": command.NewInstall,
-		"fetch":   command.NewFetch,
-		"pull":    command.NewPull,
-		"push":    command.NewPush,
-		"combine": command.NewCombine,
+		"scan":            command.NewScan,
+		"split":           command.NewSplit,
+		"install":         command.NewInstall,
+		"fetch":           command.NewFetch,
+		"pull":            command.NewPull,
+		"push":            command.NewPush,
+		"combine":         command.NewCombine,
+		"verify":          command.NewVerify,
+		"cat":             command.NewCat,
+		"gc":              command.NewGC,
+		"fsck":            command.NewFsck,
+		"evict":           command.NewEvict,
+		"stats":           command.NewStats,
+		"status":          command.NewStatus,
+		"track":           command.NewTrack,
+		"untrack":         command.NewUntrack,
+		"bundle create":   command.NewBundleCreate,
+		"bundle unbundle": command.NewBundleUnbundle,
+		"migrate-remote":  command.NewMigrateRemote,
+		"migrate rekey":   command.NewMigrateRekey,
+		"migrate rechunk": command.NewMigrateRechunk,
+		"migrate import":  command.NewMigrateImport,
+		"migrate export":  command.NewMigrateExport,
 	}
 
 	status, err := c.Run()